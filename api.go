@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// APIError is an error with an HTTP status and a stable code. /api/v1
+// returns it as {"error": {"code": ..., "message": ..., "details": ...}};
+// the legacy endpoints keep returning the message as a plain string.
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// ErrorResponse is the body of every /api/v1 error.
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// StatusResult reports an action on a VM or instance.
+type StatusResult struct {
+	Status      string `json:"status"`
+	Name        string `json:"name"`
+	ID          string `json:"id,omitempty"`
+	PID         string `json:"pid,omitempty"`
+	DiskRemoved bool   `json:"disk_removed,omitempty"`
+}
+
+// StopRequest is the optional body of the v1 stop endpoints.
+type StopRequest struct {
+	Force bool `json:"force,omitempty"` // SIGKILL instead of SIGTERM
+}
+
+// CloneRequest is the body of POST /api/v1/vms/{name}/clone.
+type CloneRequest struct {
+	Name string `json:"name"`
+	Mode string `json:"mode,omitempty"` // "overlay" (default) or "copy"
+
+	// The clone gets neither the source's backup schedule nor its NICs on
+	// segments unless asked, so it does not back up into the source's
+	// chain or join its virtual LANs
+	KeepBackup   bool `json:"keep_backup,omitempty"`
+	KeepSegments bool `json:"keep_segments,omitempty"`
+}
+
+// CloneResult is the body of POST /api/v1/vms/{name}/clone. Job creates
+// the clone's disk in the background.
+type CloneResult struct {
+	Status  string    `json:"status"`
+	VM      *VMConfig `json:"vm"`
+	Job     *ImageJob `json:"job"`
+	Warning string    `json:"warning,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, code, format string, args ...interface{}) *APIError {
+	return &APIError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *APIError) with(key string, value interface{}) *APIError {
+	if e.Details == nil {
+		e.Details = map[string]interface{}{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+// statusCodes are the codes used for errors that carry only a status.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          "invalid_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusMethodNotAllowed:    "method_not_allowed",
+	http.StatusConflict:            "conflict",
+	http.StatusInternalServerError: "internal",
+	http.StatusNotImplemented:      "not_supported",
+}
+
+func statusError(status int, msg string) *APIError {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = "internal"
+	}
+	return &APIError{Status: status, Code: code, Message: msg}
+}
+
+// statusErrorf is statusError with a formatted message.
+func statusErrorf(status int, format string, args ...interface{}) *APIError {
+	return statusError(status, fmt.Sprintf(format, args...))
+}
+
+// classifyError is the fallback for an error that was not given a status:
+// whatever failed, it was not the caller's fault as far as anyone said.
+func classifyError(msg string) *APIError {
+	return statusError(http.StatusInternalServerError, msg)
+}
+
+// fileError gives a missing file a 404; other file errors stay failures.
+func fileError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return statusError(http.StatusNotFound, err.Error())
+	}
+	return err
+}
+
+func asAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return classifyError(err.Error())
+}
+
+func isV1(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/v1/")
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	apiErr := asAPIError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: apiErr})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// legacyError reports an error the way the pre-v1 endpoints do: a 200
+// with the message, except for authorization failures. Under /api/v1 the
+// error itself is kept for the typed response.
+func legacyError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := asAPIError(err)
+	if apiErr.Status == http.StatusForbidden {
+		authError(w, r, apiErr.Status, apiErr.Message)
+		return
+	}
+	if vw, ok := w.(*v1Writer); ok {
+		vw.err = apiErr
+	}
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// v1Writer adapts a legacy handler to /api/v1: JSON and error responses
+// are held back so a 200 carrying {"error": "..."} can be turned into a
+// typed error with the right status. Anything else streams through.
+type v1Writer struct {
+	http.ResponseWriter
+	status    int
+	decided   bool
+	buffering bool
+	buf       bytes.Buffer
+	err       *APIError // set by legacyError
+}
+
+func (v *v1Writer) WriteHeader(status int) {
+	if v.decided {
+		return
+	}
+	v.decided, v.status = true, status
+	isJSON := strings.HasPrefix(v.Header().Get("Content-Type"), "application/json")
+	v.buffering = status >= 400 || (status == http.StatusOK && isJSON)
+	if !v.buffering {
+		v.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (v *v1Writer) Write(b []byte) (int, error) {
+	v.WriteHeader(http.StatusOK)
+	if v.buffering {
+		return v.buf.Write(b)
+	}
+	return v.ResponseWriter.Write(b)
+}
+
+func (v *v1Writer) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok && !v.buffering {
+		f.Flush()
+	}
+}
+
+// Hijack lets the terminal WebSocket upgrade through the adapter.
+func (v *v1Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := v.ResponseWriter.(http.Hijacker); ok {
+		v.decided = true
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijacking not supported")
+}
+
+func (v *v1Writer) finish() {
+	if !v.buffering {
+		return
+	}
+	msg := legacyErrorMessage(v.buf.Bytes())
+
+	switch {
+	case v.status >= 400:
+		if msg == "" {
+			msg = strings.TrimSpace(v.buf.String())
+		}
+		writeAPIError(v.ResponseWriter, statusError(v.status, msg))
+	case msg != "" && v.err != nil:
+		writeAPIError(v.ResponseWriter, v.err)
+	case msg != "":
+		writeAPIError(v.ResponseWriter, classifyError(msg))
+	default:
+		v.ResponseWriter.WriteHeader(v.status)
+		v.ResponseWriter.Write(v.buf.Bytes())
+	}
+}
+
+// legacyErrorMessage returns the message of a legacy error body, which is
+// an object holding only "error". Resources with their own error field,
+// like a failed image job, are not failures of the request.
+func legacyErrorMessage(body []byte) string {
+	var obj map[string]interface{}
+	if json.Unmarshal(body, &obj) != nil || len(obj) != 1 {
+		return ""
+	}
+	msg, _ := obj["error"].(string)
+	return msg
+}
+
+// serveLegacy runs the pre-v1 handler for a v1 path through v1Writer.
+func serveLegacy(w http.ResponseWriter, r *http.Request, path string) {
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = path
+	if _, pattern := http.DefaultServeMux.Handler(r2); pattern == "/" {
+		writeAPIError(w, statusError(http.StatusNotFound, "no such resource: "+r.URL.Path))
+		return
+	}
+	vw := &v1Writer{ResponseWriter: w}
+	http.DefaultServeMux.ServeHTTP(vw, r2)
+	vw.finish()
+}
+
+// handleAPIv1 serves /api/v1/. Instances and VM lifecycle have their own
+// resource routes; everything else is the legacy handler under its v1 path.
+func handleAPIv1(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/")
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case rest == "instances":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, statusError(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		serveLegacy(w, r, "/api/instances")
+
+	case parts[0] == "instances" && len(parts) <= 3:
+		handleV1Instance(w, r, parts[1:])
+
+	case rest == "vms":
+		if r.Method != http.MethodGet {
+			writeAPIError(w, statusError(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		serveLegacy(w, r, "/api/vms")
+
+	case parts[0] == "vms" && len(parts) == 2:
+		handleV1VM(w, r, parts[1])
+
+	case parts[0] == "vms" && len(parts) == 3 && isV1VMAction(parts[2]):
+		handleV1VMAction(w, r, parts[1], parts[2])
+
+	default:
+		serveLegacy(w, r, "/api/"+rest)
+	}
+}
+
+// handleV1Instance serves /api/v1/instances/{id} and .../{id}/stop.
+func handleV1Instance(w http.ResponseWriter, r *http.Request, parts []string) {
+	id := parts[0]
+	if len(parts) == 2 && parts[1] == "stop" {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, statusError(http.StatusMethodNotAllowed, "Method not allowed"))
+			return
+		}
+		var req StopRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, statusError(http.StatusBadRequest, "invalid request body"))
+				return
+			}
+		}
+		inst, err := stopRequested(r, "", id, req.Force)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stopResult(inst, req.Force))
+		return
+	}
+	if len(parts) != 1 {
+		writeAPIError(w, statusError(http.StatusNotFound, "no such resource: "+r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeAPIError(w, statusError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	p := principalFrom(r)
+	for _, inst := range currentInstances() {
+		if inst.ID == id && p.allowsVM(inst.Name) {
+			writeJSON(w, http.StatusOK, inst)
+			return
+		}
+	}
+	writeAPIError(w, newAPIError(http.StatusNotFound, "instance_not_found", "no running QEMU instance with ID %s", id))
+}
+
+// handleV1VM serves GET and DELETE on /api/v1/vms/{name}.
+func handleV1VM(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		out, ok := lookupVM(name)
+		if !ok || !principalFrom(r).allowsVM(name) {
+			writeAPIError(w, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name))
+			return
+		}
+		if !principalFrom(r).allows(roleAdmin) && out.SSHPassword != "" {
+			out.SSHPassword = "********"
+		}
+		writeJSON(w, http.StatusOK, out)
+	case http.MethodDelete:
+		removeDisk := r.URL.Query().Get("disk") != ""
+		if err := deleteVM(name, removeDisk); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, StatusResult{Status: "deleted", Name: name, DiskRemoved: removeDisk})
+	default:
+		writeAPIError(w, statusError(http.StatusMethodNotAllowed, "Method not allowed"))
+	}
+}
+
+func isV1VMAction(action string) bool {
+	switch action {
+	case "start", "stop", "pause", "resume", "shell", "clone":
+		return true
+	}
+	return false
+}
+
+// handleV1VMAction serves /api/v1/vms/{name}/start, stop, pause, resume,
+// shell and clone.
+func handleV1VMAction(w http.ResponseWriter, r *http.Request, name, action string) {
+	method := http.MethodPost
+	if action == "shell" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		writeAPIError(w, statusError(http.StatusMethodNotAllowed, "Method not allowed"))
+		return
+	}
+
+	switch action {
+	case "start":
+		if err := startVM(name); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, StatusResult{Status: "starting", Name: name})
+
+	case "stop":
+		var req StopRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, statusError(http.StatusBadRequest, "invalid request body"))
+				return
+			}
+		}
+		inst, err := stopRequested(r, name, "", req.Force)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, stopResult(inst, req.Force))
+
+	case "pause", "resume":
+		if err := pauseVM(name, action == "pause"); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, pauseResult(name, action == "pause"))
+
+	case "shell":
+		info, err := getShellInfo(name)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+
+	case "clone":
+		var req CloneRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, statusError(http.StatusBadRequest, "invalid request body"))
+			return
+		}
+		vm, job, err := cloneVM(name, req)
+		if err != nil && vm == nil {
+			writeAPIError(w, err)
+			return
+		}
+		resp := CloneResult{Status: "cloned", VM: vm, Job: job}
+		if err != nil {
+			resp.Warning = err.Error()
+		}
+		w.Header().Set("Location", "/api/v1/vms/"+vm.Name)
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
+
+// successorPaths names the v1 replacement of each deprecated endpoint
+// whose route changed shape.
+var successorPaths = map[string]string{
+	"/api/start": "/api/v1/vms/{name}/start",
+	"/api/stop":  "/api/v1/instances/{id}/stop",
+	"/api/shell": "/api/v1/vms/{name}/shell",
+}
+
+// deprecatedAPI marks every pre-v1 API endpoint as deprecated and points
+// at its successor. They keep working unchanged.
+func deprecatedAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		if strings.HasPrefix(path, "/api/") && !isV1(r) && path != "/api/openapi.json" {
+			successor, ok := successorPaths[path]
+			if !ok {
+				successor = "/api/v1/" + strings.TrimPrefix(path, "/api/")
+			}
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
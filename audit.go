@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log. Each entry carries the hash of
+// the one before it, so editing or dropping a line breaks the chain.
+type AuditEntry struct {
+	Seq      int64                  `json:"seq"`
+	Time     time.Time              `json:"time"`
+	User     string                 `json:"user"`
+	Kind     string                 `json:"kind,omitempty"` // principal kind
+	Source   string                 `json:"source"`
+	Action   string                 `json:"action"`
+	Method   string                 `json:"method,omitempty"`
+	Path     string                 `json:"path,omitempty"`
+	VM       string                 `json:"vm,omitempty"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	Outcome  string                 `json:"outcome"` // "ok", "error" or "denied"
+	Error    string                 `json:"error,omitempty"`
+	PrevHash string                 `json:"prev_hash"`
+	Hash     string                 `json:"hash"`
+}
+
+// AuditPage is the body of GET /api/audit. Total counts every match
+// before limit is applied.
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+}
+
+// AuditVerification is the body of GET /api/audit/verify.
+type AuditVerification struct {
+	OK          bool   `json:"ok"`
+	Entries     int    `json:"entries"`
+	LastHash    string `json:"last_hash"`
+	Error       string `json:"error,omitempty"`
+	FirstBadSeq int64  `json:"first_bad_seq,omitempty"`
+}
+
+// AuditHead is the last entry written, kept in state_dir apart from the
+// log. A log cut short, or rewritten from some entry on, no longer ends
+// where the head says.
+type AuditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+var (
+	auditLogPath  = "audit.log"
+	auditHeadPath = "audit-head.json"
+
+	auditMu       sync.Mutex
+	auditSeq      int64
+	auditLastHash string
+)
+
+// Request fields never written to the audit log
+var auditRedacted = map[string]bool{"password": true, "ssh_password": true, "token": true, "data": true, "input": true}
+
+const auditMaxBody = 64 << 10
+
+func (e *AuditEntry) computeHash() string {
+	c := *e
+	c.Hash = ""
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readAuditLog returns every entry in the log, in order.
+func readAuditLog() ([]AuditEntry, error) {
+	f, err := os.Open(auditLogPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*auditMaxBody)
+	for scanner.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, fmt.Errorf("line %d: %v", len(entries)+1, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// readAuditHead returns the recorded head, or nil when none was written
+// yet.
+func readAuditHead() (*AuditHead, error) {
+	data, err := ioutil.ReadFile(auditHeadPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var head AuditHead
+	if err := json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("%s: %v", auditHeadPath, err)
+	}
+	return &head, nil
+}
+
+func writeAuditHead(head AuditHead) error {
+	data, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	tmp := auditHeadPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, auditHeadPath)
+}
+
+// verifyAuditChain checks every entry's hash and link, and that the entry
+// the head records is still in the log, returning the sequence number of
+// the first entry that does not match.
+func verifyAuditChain(entries []AuditEntry, head *AuditHead) (int64, error) {
+	prev := ""
+	for i := range entries {
+		e := &entries[i]
+		if e.PrevHash != prev {
+			return e.Seq, fmt.Errorf("entry %d does not follow the previous entry", e.Seq)
+		}
+		if e.computeHash() != e.Hash {
+			return e.Seq, fmt.Errorf("entry %d was modified", e.Seq)
+		}
+		prev = e.Hash
+	}
+	if head == nil || head.Seq == 0 {
+		return 0, nil
+	}
+	// Entries past the head are ones written just before a crash
+	for i := range entries {
+		if entries[i].Seq == head.Seq {
+			if entries[i].Hash != head.Hash {
+				return head.Seq, fmt.Errorf("entry %d does not match the recorded head", head.Seq)
+			}
+			return 0, nil
+		}
+	}
+	var last int64
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Seq
+	}
+	return last + 1, fmt.Errorf("log ends at entry %d but entry %d was written", last, head.Seq)
+}
+
+// loadAuditLog resumes the chain from the existing log and warns when it
+// no longer verifies. When the log falls short of the head it resumes
+// from the head, so the gap stays visible after the next entry.
+func loadAuditLog() {
+	entries, err := readAuditLog()
+	if err != nil {
+		log.Printf("Warning: failed to read %s: %v", auditLogPath, err)
+	}
+	head, err := readAuditHead()
+	if err != nil {
+		log.Printf("Warning: failed to read audit head: %v", err)
+	}
+	if len(entries) == 0 && head == nil {
+		return
+	}
+	if _, err := verifyAuditChain(entries, head); err != nil {
+		log.Printf("Warning: audit log chain is broken: %v", err)
+	}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		auditSeq, auditLastHash = last.Seq, last.Hash
+	}
+	if head != nil && head.Seq > auditSeq {
+		auditSeq, auditLastHash = head.Seq, head.Hash
+	}
+}
+
+func appendAudit(e AuditEntry) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	auditSeq++
+	e.Seq = auditSeq
+	e.Time = time.Now().UTC()
+	e.PrevHash = auditLastHash
+	e.Hash = e.computeHash()
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	f, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+		return
+	}
+	f.Sync()
+	auditLastHash = e.Hash
+	if err := writeAuditHead(AuditHead{Seq: e.Seq, Hash: e.Hash}); err != nil {
+		log.Printf("Failed to write audit head: %v", err)
+	}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit records an action taken through a request. p may be nil when the
+// caller could not be authenticated.
+func audit(r *http.Request, p *Principal, action, vm string, params map[string]interface{}, outcome, errMsg string) {
+	e := AuditEntry{
+		User:    "unauthenticated",
+		Source:  remoteIP(r),
+		Action:  action,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		VM:      vm,
+		Params:  params,
+		Outcome: outcome,
+		Error:   errMsg,
+	}
+	if p != nil {
+		e.User, e.Kind = p.Name, p.Kind
+	}
+	appendAudit(e)
+}
+
+// auditLocal records an action the command line took in-process, with
+// no server running to do it.
+func auditLocal(action, vm string, params map[string]interface{}, err error) {
+	e := AuditEntry{User: localUsername(), Kind: "local", Source: "cli", Action: action, VM: vm, Params: params, Outcome: "ok"}
+	if err != nil {
+		e.Outcome, e.Error = "error", err.Error()
+	}
+	appendAudit(e)
+}
+
+func localUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return fmt.Sprintf("uid %d", os.Getuid())
+}
+
+// auditAction names an API request for the log, e.g. "start", "clone" or
+// "guest.exec".
+func auditAction(r *http.Request, params map[string]interface{}) (string, string) {
+	path := strings.TrimPrefix(legacyPath(r.URL.Path), "/api/")
+	if strings.HasPrefix(path, "instances/") {
+		action := "instance"
+		if strings.HasSuffix(path, "/stop") {
+			action = "stop"
+			if force, _ := params["force"].(bool); force {
+				action = "force_stop"
+			}
+		}
+		return action, ""
+	}
+	if strings.HasPrefix(path, "vms/") {
+		parts := strings.SplitN(strings.TrimPrefix(path, "vms/"), "/", 2)
+		sub := ""
+		if len(parts) > 1 {
+			sub = strings.TrimSuffix(parts[1], "/")
+		}
+		switch {
+		case sub == "" && r.Method == http.MethodDelete:
+			return "delete", parts[0]
+		case sub == "":
+			return "vm", parts[0]
+		}
+		if sub == "stop" {
+			if force, _ := params["force"].(bool); force {
+				sub = "force_stop"
+			}
+		}
+		return strings.ReplaceAll(sub, "/", "."), parts[0]
+	}
+
+	action := strings.ReplaceAll(strings.TrimSuffix(path, "/"), "/", ".")
+	vm, _ := params["name"].(string)
+	if action == "stop" {
+		if force, _ := params["force"].(bool); force {
+			action = "force_stop"
+		}
+	}
+	return action, vm
+}
+
+// auditParams decodes a JSON request body for the log without consuming
+// it, dropping secrets and bulk data.
+func auditParams(r *http.Request) map[string]interface{} {
+	params := map[string]interface{}{}
+	for key, values := range r.URL.Query() {
+		params[key] = strings.Join(values, ",")
+	}
+	// Uploads are logged by their query parameters only
+	if r.Body == nil || strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		return params
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(r.Body, auditMaxBody+1))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if len(body) > auditMaxBody {
+		params["body"] = "(too large to log)"
+		return params
+	}
+
+	var decoded map[string]interface{}
+	if json.Unmarshal(body, &decoded) == nil {
+		for key, value := range decoded {
+			if auditRedacted[key] {
+				value = "(redacted)"
+			}
+			params[key] = value
+		}
+	}
+	return params
+}
+
+// auditRecorder captures the status and the start of the body of a
+// response, to tell whether the action succeeded.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (a *auditRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	if a.body.Len() < 4096 {
+		a.body.Write(b)
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+func (a *auditRecorder) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// outcome classifies the recorded response. Handlers report most failures
+// as a 200 with an "error" field.
+func (a *auditRecorder) outcome() (string, string) {
+	var resp struct {
+		Error string `json:"error"`
+	}
+	var typed struct {
+		Error *APIError `json:"error"`
+	}
+	resp.Error = legacyErrorMessage(a.body.Bytes())
+	if json.Unmarshal(a.body.Bytes(), &typed) == nil && typed.Error != nil {
+		resp.Error = typed.Error.Message
+	}
+	switch {
+	case a.status == http.StatusUnauthorized || a.status == http.StatusForbidden:
+		return "denied", resp.Error
+	case a.status >= 400:
+		if resp.Error == "" {
+			resp.Error = strings.TrimSpace(a.body.String())
+		}
+		return "error", resp.Error
+	case resp.Error != "":
+		return "error", resp.Error
+	}
+	return "ok", ""
+}
+
+// auditedRequest reports whether a request changes anything and so belongs
+// in the audit log.
+func auditedRequest(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/api/logout"
+}
+
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	auditMu.Lock()
+	entries, err := readAuditLog()
+	var head *AuditHead
+	if err == nil {
+		head, err = readAuditHead()
+	}
+	auditMu.Unlock()
+	if err != nil {
+		legacyError(w, r, err)
+		return
+	}
+
+	if r.URL.Path == "/api/audit/verify" {
+		resp := AuditVerification{OK: true, Entries: len(entries)}
+		if len(entries) > 0 {
+			resp.LastHash = entries[len(entries)-1].Hash
+		}
+		if seq, err := verifyAuditChain(entries, head); err != nil {
+			resp.OK, resp.Error, resp.FirstBadSeq = false, err.Error(), seq
+		}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	page, err := filterAuditLog(entries, r.URL.Query())
+	if err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// filterAuditLog applies the /api/audit query parameters to the log,
+// keeping the newest limit matches.
+func filterAuditLog(entries []AuditEntry, q url.Values) (*AuditPage, error) {
+	var since, until time.Time
+	for key, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		value := q.Get(key)
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err == nil {
+			*t = time.Now().Add(-d)
+		} else if *t, err = time.Parse(time.RFC3339, value); err != nil {
+			return nil, statusErrorf(http.StatusBadRequest, "invalid %s: use RFC 3339 or a duration like 24h", key)
+		}
+	}
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	matched := []AuditEntry{}
+	for _, e := range entries {
+		if (q.Get("user") != "" && e.User != q.Get("user")) ||
+			(q.Get("vm") != "" && e.VM != q.Get("vm")) ||
+			(q.Get("action") != "" && e.Action != q.Get("action")) ||
+			(q.Get("outcome") != "" && e.Outcome != q.Get("outcome")) ||
+			(!since.IsZero() && e.Time.Before(since)) ||
+			(!until.IsZero() && e.Time.After(until)) {
+			continue
+		}
+		matched = append(matched, e)
+	}
+	total := len(matched)
+	if total > limit {
+		matched = matched[total-limit:]
+	}
+	return &AuditPage{Entries: matched, Total: total}, nil
+}
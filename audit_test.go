@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// auditChain links entries the way appendAudit does, numbering them from 1.
+func auditChain(entries ...AuditEntry) []AuditEntry {
+	prev := ""
+	for i := range entries {
+		e := &entries[i]
+		e.Seq = int64(i + 1)
+		e.Time = time.Date(2026, 10, 19, 10, 0, i, 0, time.UTC)
+		e.PrevHash = prev
+		e.Hash = e.computeHash()
+		prev = e.Hash
+	}
+	return entries
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	entries := func() []AuditEntry {
+		return auditChain(
+			AuditEntry{User: "alice", Action: "start", VM: "vm1", Outcome: "ok"},
+			AuditEntry{User: "bob", Action: "stop", VM: "vm1", Outcome: "ok"},
+			AuditEntry{User: "alice", Action: "clone", VM: "vm2", Outcome: "error", Error: "vm_exists"},
+		)
+	}
+	headAt := func(entries []AuditEntry, seq int64) *AuditHead {
+		return &AuditHead{Seq: seq, Hash: entries[seq-1].Hash}
+	}
+	original := entries()
+
+	tests := []struct {
+		name    string
+		entries []AuditEntry
+		head    *AuditHead
+		badSeq  int64
+		errMsg  string // empty when the chain verifies
+	}{
+		{name: "empty log", entries: nil, head: nil},
+		{name: "no head yet", entries: original, head: nil},
+		{name: "head at the last entry", entries: original, head: headAt(original, 3)},
+		{name: "entries past the head", entries: original, head: headAt(original, 2)},
+		{
+			name: "edited entry",
+			entries: func() []AuditEntry {
+				e := entries()
+				e[1].User = "mallory"
+				return e
+			}(),
+			head:   headAt(original, 3),
+			badSeq: 2,
+			errMsg: "entry 2 was modified",
+		},
+		{
+			name: "edited and rehashed entry",
+			entries: func() []AuditEntry {
+				e := entries()
+				e[1].User = "mallory"
+				e[1].Hash = e[1].computeHash()
+				return e
+			}(),
+			head:   headAt(original, 3),
+			badSeq: 3,
+			errMsg: "entry 3 does not follow",
+		},
+		{
+			name:    "deleted entry",
+			entries: append(entries()[:1:1], entries()[2]),
+			head:    headAt(original, 3),
+			badSeq:  3,
+			errMsg:  "entry 3 does not follow",
+		},
+		{
+			name:    "deleted first entries",
+			entries: entries()[1:],
+			head:    headAt(original, 3),
+			badSeq:  2,
+			errMsg:  "entry 2 does not follow",
+		},
+		{
+			name:    "truncated tail",
+			entries: entries()[:2],
+			head:    headAt(original, 3),
+			badSeq:  3,
+			errMsg:  "log ends at entry 2 but entry 3 was written",
+		},
+		{
+			name:    "truncated to nothing",
+			entries: nil,
+			head:    headAt(original, 3),
+			badSeq:  1,
+			errMsg:  "log ends at entry 0 but entry 3 was written",
+		},
+		{
+			name: "rewritten log",
+			entries: auditChain(
+				AuditEntry{User: "alice", Action: "start", VM: "vm1", Outcome: "ok"},
+				AuditEntry{User: "alice", Action: "stop", VM: "vm1", Outcome: "ok"},
+				AuditEntry{User: "alice", Action: "clone", VM: "vm2", Outcome: "error", Error: "vm_exists"},
+			),
+			head:   headAt(original, 3),
+			badSeq: 3,
+			errMsg: "entry 3 does not match the recorded head",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seq, err := verifyAuditChain(tt.entries, tt.head)
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Fatalf("verifyAuditChain() = %d, %v, want nil", seq, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("verifyAuditChain() error = %v, want error containing %q", err, tt.errMsg)
+			}
+			if seq != tt.badSeq {
+				t.Errorf("verifyAuditChain() = %d, want %d", seq, tt.badSeq)
+			}
+		})
+	}
+}
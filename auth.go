@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role levels, each including the ones below it.
+const (
+	roleViewer   = 1 // read-only dashboard and API
+	roleOperator = 2 // start/stop, console, files, captures, backups
+	roleAdmin    = 3 // config edits, image jobs, host cleanup
+)
+
+var roleNames = map[string]int{"viewer": roleViewer, "operator": roleOperator, "admin": roleAdmin}
+
+// AuthToken is a static API token. Only its SHA-256 is stored.
+type AuthToken struct {
+	Name        string   `json:"name"`
+	TokenSHA256 string   `json:"token_sha256"`
+	Role        string   `json:"role"`
+	VMs         []string `json:"vms,omitempty"` // glob patterns, empty means all
+}
+
+// AuthUser is a local account for the web UI, with a bcrypt password hash.
+type AuthUser struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash"`
+	Role         string   `json:"role"`
+	VMs          []string `json:"vms,omitempty"`
+}
+
+type AuthConfig struct {
+	Tokens      []AuthToken      `json:"tokens,omitempty"`
+	Users       []AuthUser       `json:"users,omitempty"`
+	ClientCerts []AuthClientCert `json:"client_certs,omitempty"`
+	SessionTTL  string           `json:"session_ttl,omitempty"` // default 12h
+
+	TLS *TLSSettings `json:"tls,omitempty"`
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Name string   `json:"name"`
+	Kind string   `json:"kind"` // "user", "token", "certificate" or "anonymous"
+	Role string   `json:"role"`
+	VMs  []string `json:"vms,omitempty"`
+}
+
+type session struct {
+	principal Principal
+	expires   time.Time
+}
+
+type principalKey struct{}
+
+const (
+	sessionCookie     = "qm_session"
+	defaultSessionTTL = 12 * time.Hour
+)
+
+var (
+	authConfigPath = "auth.json"
+	authConfig     AuthConfig
+	authEnabled    bool
+
+	sessionsMu sync.Mutex
+	sessions   = map[string]session{}
+
+	anonymousAdmin = Principal{Name: "anonymous", Kind: "anonymous", Role: "admin"}
+
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// dummyPasswordHash is compared against for unknown usernames, so a failed
+// login takes as long whether or not the user exists.
+func dummyPasswordHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("qemu-monitor"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
+
+// loadAuthConfig reads auth.json. Without it, or with no tokens and no
+// users, the API stays open as before.
+func loadAuthConfig() error {
+	data, err := ioutil.ReadFile(authConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("Warning: %s not found, API authentication disabled", authConfigPath)
+			return nil
+		}
+		return err
+	}
+	var cfg AuthConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	for _, warning := range authConfigWarnings(cfg) {
+		log.Printf("Warning: %s", warning)
+	}
+	authConfig = cfg
+	authEnabled = len(cfg.Tokens) > 0 || len(cfg.Users) > 0 || len(cfg.ClientCerts) > 0
+	return nil
+}
+
+// authConfigWarnings lists entries of auth.json that will never match.
+func authConfigWarnings(cfg AuthConfig) []string {
+	var warnings []string
+	for _, t := range cfg.Tokens {
+		if roleNames[t.Role] == 0 {
+			warnings = append(warnings, fmt.Sprintf("token %s has unknown role %q and will be rejected", t.Name, t.Role))
+		}
+	}
+	for _, u := range cfg.Users {
+		if roleNames[u.Role] == 0 {
+			warnings = append(warnings, fmt.Sprintf("user %s has unknown role %q and will be rejected", u.Username, u.Role))
+		}
+	}
+	for _, c := range cfg.ClientCerts {
+		if roleNames[c.Role] == 0 {
+			warnings = append(warnings, fmt.Sprintf("client certificate %s has unknown role %q and will be rejected", c.CommonName, c.Role))
+		}
+	}
+	if tls := cfg.TLS; tls != nil && tls.ClientAuth != "" && tls.ClientAuth != "optional" && tls.ClientAuth != "require" {
+		warnings = append(warnings, fmt.Sprintf("tls.client_auth %q is not \"optional\" or \"require\"", tls.ClientAuth))
+	}
+	return warnings
+}
+
+func sessionTTL() time.Duration {
+	if d, err := time.ParseDuration(authConfig.SessionTTL); err == nil && d > 0 {
+		return d
+	}
+	return defaultSessionTTL
+}
+
+func (p *Principal) allows(role int) bool {
+	return roleNames[p.Role] >= role
+}
+
+func (p *Principal) allowsVM(name string) bool {
+	if len(p.VMs) == 0 {
+		return true
+	}
+	for _, pattern := range p.VMs {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func principalFrom(r *http.Request) *Principal {
+	if p, ok := r.Context().Value(principalKey{}).(*Principal); ok {
+		return p
+	}
+	return &anonymousAdmin
+}
+
+// authenticate resolves a verified client certificate, bearer token or
+// session cookie to a principal.
+func authenticate(r *http.Request) *Principal {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, c := range authConfig.ClientCerts {
+			if ok, _ := filepath.Match(c.CommonName, cn); ok && roleNames[c.Role] != 0 {
+				return &Principal{Name: cn, Kind: "certificate", Role: c.Role, VMs: c.VMs}
+			}
+		}
+	}
+
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(h, "Bearer ")))
+		hash := hex.EncodeToString(sum[:])
+		for _, t := range authConfig.Tokens {
+			if roleNames[t.Role] != 0 && subtle.ConstantTimeCompare([]byte(hash), []byte(strings.ToLower(t.TokenSHA256))) == 1 {
+				return &Principal{Name: t.Name, Kind: "token", Role: t.Role, VMs: t.VMs}
+			}
+		}
+		return nil
+	}
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		s, ok := sessions[c.Value]
+		if !ok {
+			return nil
+		}
+		if time.Now().After(s.expires) {
+			delete(sessions, c.Value)
+			return nil
+		}
+		p := s.principal
+		return &p
+	}
+	return nil
+}
+
+// routeAccess returns the role a request needs and the VM it targets, if
+// the VM is part of the path. Handlers taking the VM from the body check
+// it themselves with authorizeVM.
+func routeAccess(r *http.Request) (int, string) {
+	path := r.URL.Path
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	if strings.HasPrefix(path, "/api/v1/") {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(path, "/api/v1/"), "/"), "/")
+		switch {
+		case len(parts) == 3 && parts[0] == "vms" && (parts[2] == "start" || parts[2] == "stop" || parts[2] == "pause" || parts[2] == "resume"):
+			return roleOperator, parts[1]
+		case len(parts) == 3 && parts[0] == "vms" && parts[2] == "shell":
+			return roleViewer, parts[1]
+		case parts[0] == "instances" && !read:
+			// The VM is checked once the instance ID is resolved
+			return roleOperator, ""
+		}
+		path = legacyPath(path)
+	}
+
+	switch {
+	case path == "/api/start" || path == "/api/stop":
+		return roleOperator, ""
+	case path == "/api/shell":
+		return roleViewer, ""
+	case path == "/api/taps/cleanup" || strings.HasPrefix(path, "/api/audit"):
+		return roleAdmin, ""
+	case strings.HasPrefix(path, "/api/images/"):
+		if read {
+			return roleViewer, ""
+		}
+		return roleAdmin, ""
+	case strings.HasPrefix(path, "/api/vms/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/api/vms/"), "/", 2)
+		name, sub := parts[0], ""
+		if len(parts) > 1 {
+			sub = strings.TrimSuffix(parts[1], "/")
+		}
+		switch {
+		case (sub == "" && !read) || sub == "clone" || sub == "backups/restore":
+			return roleAdmin, name
+		case sub == "terminal" || sub == "serial" || sub == "files" || sub == "guest/exec" ||
+			strings.HasPrefix(sub, "recordings") || strings.HasPrefix(sub, "captures/"):
+			// Consoles, guest data and session recordings
+			return roleOperator, name
+		case read:
+			return roleViewer, name
+		default:
+			return roleOperator, name
+		}
+	case read:
+		return roleViewer, ""
+	default:
+		return roleAdmin, ""
+	}
+}
+
+// legacyPath maps an /api/v1 path to the pre-v1 path of the same resource.
+func legacyPath(path string) string {
+	if strings.HasPrefix(path, "/api/v1/") {
+		return "/api/" + strings.TrimPrefix(path, "/api/v1/")
+	}
+	return path
+}
+
+// sameOrigin rejects cross-site state changes, so a page a user visits
+// cannot drive the API with their session cookie.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func authError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if isV1(r) {
+		writeAPIError(w, statusError(status, msg))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// authMiddleware authenticates every API request and enforces the role
+// required by its route.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p *Principal
+		if auditedRequest(r) {
+			params := auditParams(r)
+			rec := &auditRecorder{ResponseWriter: w}
+			w = rec
+			defer func() {
+				action, vm := auditAction(r, params)
+				outcome, errMsg := rec.outcome()
+				audit(r, p, action, vm, params, outcome, errMsg)
+			}()
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+			authError(w, r, http.StatusForbidden, "cross-origin request refused")
+			return
+		}
+
+		path := r.URL.Path
+		if !strings.HasPrefix(path, "/api/") || legacyPath(path) == "/api/login" || legacyPath(path) == "/api/logout" ||
+			legacyPath(path) == "/api/openapi.json" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p = &anonymousAdmin
+		if authEnabled {
+			if p = authenticate(r); p == nil {
+				authError(w, r, http.StatusUnauthorized, "authentication required")
+				return
+			}
+		}
+
+		role, vm := routeAccess(r)
+		if !p.allows(role) {
+			authError(w, r, http.StatusForbidden, "permission denied: "+p.Role+" role cannot "+r.Method+" "+path)
+			return
+		}
+		if vm != "" && !p.allowsVM(vm) {
+			authError(w, r, http.StatusForbidden, "permission denied for VM "+vm)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// authorizeVM checks the caller may act on a VM named in a request body,
+// writing a 403 when not.
+func authorizeVM(w http.ResponseWriter, r *http.Request, name string) bool {
+	if principalFrom(r).allowsVM(name) {
+		return true
+	}
+	authError(w, r, http.StatusForbidden, "permission denied for VM "+name)
+	return false
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashPassword implements `qemu-monitor hash-password`, printing a bcrypt
+// hash of the password read from stdin for use in auth.json.
+func hashPassword() error {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(hash))
+	return nil
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		authError(w, r, http.StatusBadRequest, "Invalid request")
+		return
+	}
+
+	var user *AuthUser
+	for i := range authConfig.Users {
+		if authConfig.Users[i].Username == req.Username {
+			user = &authConfig.Users[i]
+		}
+	}
+	hash := dummyPasswordHash()
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || user == nil || roleNames[user.Role] == 0 {
+		// Slow down password guessing
+		time.Sleep(500 * time.Millisecond)
+		log.Printf("Failed login for %q from %s", req.Username, r.RemoteAddr)
+		authError(w, r, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		authError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	p := Principal{Name: user.Username, Kind: "user", Role: user.Role, VMs: user.VMs}
+	ttl := sessionTTL()
+	sessionsMu.Lock()
+	sessions[id] = session{principal: p, expires: time.Now().Add(ttl)}
+	sessionsMu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	log.Printf("User %s logged in from %s", user.Username, r.RemoteAddr)
+	json.NewEncoder(w).Encode(p)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		sessionsMu.Lock()
+		delete(sessions, c.Value)
+		sessionsMu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	json.NewEncoder(w).Encode(map[string]string{"status": "logged out"})
+}
+
+// WhoamiResult is the body of GET /api/whoami.
+type WhoamiResult struct {
+	Principal   *Principal `json:"principal"`
+	AuthEnabled bool       `json:"auth_enabled"`
+}
+
+func handleWhoami(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(WhoamiResult{Principal: principalFrom(r), AuthEnabled: authEnabled})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRouteAccess(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		role   int
+		vm     string
+	}{
+		// Listings and other reads
+		{http.MethodGet, "/api/instances", roleViewer, ""},
+		{http.MethodGet, "/api/vms", roleViewer, ""},
+		{http.MethodHead, "/api/topology", roleViewer, ""},
+		{http.MethodGet, "/api/vms/vm1", roleViewer, "vm1"},
+		{http.MethodGet, "/api/vms/vm1/backups", roleViewer, "vm1"},
+		{http.MethodGet, "/api/vms/vm1/guest", roleViewer, "vm1"},
+		{http.MethodGet, "/api/images/", roleViewer, ""},
+		{http.MethodGet, "/api/images/jobs", roleViewer, ""},
+
+		// Lifecycle, with the VM in the body or the path
+		{http.MethodPost, "/api/start", roleOperator, ""},
+		{http.MethodPost, "/api/stop", roleOperator, ""},
+		{http.MethodPost, "/api/shell", roleViewer, ""},
+		{http.MethodPost, "/api/v1/vms/vm1/start", roleOperator, "vm1"},
+		{http.MethodPost, "/api/v1/vms/vm1/stop", roleOperator, "vm1"},
+		{http.MethodPost, "/api/v1/vms/vm1/pause", roleOperator, "vm1"},
+		{http.MethodPost, "/api/v1/vms/vm1/resume", roleOperator, "vm1"},
+		{http.MethodGet, "/api/v1/vms/vm1/shell", roleViewer, "vm1"},
+		{http.MethodDelete, "/api/v1/instances/1234-5678", roleOperator, ""},
+		{http.MethodGet, "/api/v1/instances/1234-5678", roleViewer, ""},
+
+		// Consoles, guest data and recordings need an operator even to read
+		{http.MethodGet, "/api/vms/vm1/terminal", roleOperator, "vm1"},
+		{http.MethodGet, "/api/vms/vm1/serial", roleOperator, "vm1"},
+		{http.MethodGet, "/api/vms/vm1/files", roleOperator, "vm1"},
+		{http.MethodPost, "/api/vms/vm1/guest/exec", roleOperator, "vm1"},
+		{http.MethodGet, "/api/vms/vm1/recordings", roleOperator, "vm1"},
+		{http.MethodGet, "/api/vms/vm1/recordings/20261019-101500.000.cast", roleOperator, "vm1"},
+		{http.MethodGet, "/api/vms/vm1/captures/20261019-101500-net0", roleOperator, "vm1"},
+		{http.MethodGet, "/api/v1/vms/vm1/terminal", roleOperator, "vm1"},
+		{http.MethodGet, "/api/vms/vm1/captures", roleViewer, "vm1"},
+
+		// Other per-VM changes
+		{http.MethodPost, "/api/vms/vm1/forwards", roleOperator, "vm1"},
+		{http.MethodPost, "/api/vms/vm1/backups", roleOperator, "vm1"},
+		{http.MethodPost, "/api/vms/vm1/captures/", roleOperator, "vm1"},
+
+		// Config edits and host-wide operations
+		{http.MethodDelete, "/api/vms/vm1", roleAdmin, "vm1"},
+		{http.MethodDelete, "/api/v1/vms/vm1", roleAdmin, "vm1"},
+		{http.MethodPost, "/api/vms/vm1/clone", roleAdmin, "vm1"},
+		{http.MethodPost, "/api/vms/vm1/backups/restore", roleAdmin, "vm1"},
+		{http.MethodPost, "/api/vms/vm1/backups/restore/", roleAdmin, "vm1"},
+		{http.MethodPost, "/api/images/jobs", roleAdmin, ""},
+		{http.MethodPost, "/api/taps/cleanup", roleAdmin, ""},
+		{http.MethodGet, "/api/audit", roleAdmin, ""},
+		{http.MethodGet, "/api/v1/audit/verify", roleAdmin, ""},
+		{http.MethodPut, "/api/settings", roleAdmin, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			role, vm := routeAccess(r)
+			if role != tt.role || vm != tt.vm {
+				t.Errorf("routeAccess() = %d, %q, want %d, %q", role, vm, tt.role, tt.vm)
+			}
+		})
+	}
+}
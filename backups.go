@@ -0,0 +1,695 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackupPolicy configures live backups of a VM. Without an interval,
+// backups only run when requested through the API.
+type BackupPolicy struct {
+	Dir       string `json:"dir,omitempty"`        // default backups/<vm>
+	Interval  string `json:"interval,omitempty"`   // e.g. "6h"
+	FullEvery int    `json:"full_every,omitempty"` // incrementals between full backups
+	Keep      int    `json:"keep,omitempty"`       // full backup chains to keep
+}
+
+// Backup is one file in a VM's backup directory. Incremental backups are
+// qcow2 overlays on the previous backup, so each file is a restore point.
+type Backup struct {
+	File      string `json:"file"`
+	Kind      string `json:"kind"`  // "full" or "incremental"
+	Chain     string `json:"chain"` // the full backup this file builds on
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"created_at"`
+}
+
+// BackupJob is a QMP backup block job, running or finished.
+type BackupJob struct {
+	VM         string  `json:"vm"`
+	JobID      string  `json:"job_id"`
+	Kind       string  `json:"kind"`
+	Device     string  `json:"device"`
+	File       string  `json:"file"`
+	Status     string  `json:"status"` // running, done, failed, cancelled
+	Offset     int64   `json:"offset"`
+	Len        int64   `json:"len"`
+	Progress   float64 `json:"progress"`
+	Error      string  `json:"error,omitempty"`
+	StartedAt  string  `json:"started_at"`
+	FinishedAt string  `json:"finished_at,omitempty"`
+
+	target    string
+	cancelled bool
+}
+
+const (
+	backupBitmap            = "qm-backup"
+	defaultBackupFullEvery  = 6
+	defaultBackupKeep       = 3
+	backupTimestampFormat   = "20060102-150405"
+	backupSchedulerInterval = time.Minute
+
+	// Present in a backup directory from the start of a full backup until
+	// it succeeds. The new bitmap is added when the full backup starts, so
+	// until then it does not match the last good backup.
+	backupFullPending = ".full-pending"
+)
+
+var (
+	backupsDir = "backups"
+
+	backupsMu      sync.Mutex
+	activeBackups  = map[string]*BackupJob{} // keyed by VM, nil while starting
+	lastBackupJobs = map[string]BackupJob{}
+
+	backupFileRegex = regexp.MustCompile(`^(\d{8}-\d{6})-(full|inc)\.qcow2$`)
+	qmpIDRegex      = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+func backupPolicy(vm *VMConfig) BackupPolicy {
+	p := BackupPolicy{}
+	if vm.Backup != nil {
+		p = *vm.Backup
+	}
+	if p.Dir == "" {
+		p.Dir = filepath.Join(backupsDir, vm.Name)
+	}
+	if p.FullEvery <= 0 {
+		p.FullEvery = defaultBackupFullEvery
+	}
+	if p.Keep <= 0 {
+		p.Keep = defaultBackupKeep
+	}
+	return p
+}
+
+func backupJobID(name string) string {
+	return "qm-backup-" + qmpIDRegex.ReplaceAllString(name, "_")
+}
+
+// listBackups returns a VM's backups oldest first.
+func listBackups(vm *VMConfig) ([]Backup, error) {
+	dir := backupPolicy(vm).Dir
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Backup{}, nil
+		}
+		return nil, err
+	}
+
+	backups := []Backup{}
+	chain := ""
+	for _, e := range entries {
+		m := backupFileRegex.FindStringSubmatch(e.Name())
+		if m == nil || e.IsDir() {
+			continue
+		}
+		b := Backup{File: e.Name(), Kind: "full", Size: e.Size()}
+		if m[2] == "inc" {
+			b.Kind = "incremental"
+		} else {
+			chain = e.Name()
+		}
+		if chain == "" {
+			// Incremental without a full backup before it
+			continue
+		}
+		b.Chain = chain
+		if t, err := time.ParseInLocation(backupTimestampFormat, m[1], time.Local); err == nil {
+			b.CreatedAt = t.Format("2006-01-02 15:04:05")
+		}
+		backups = append(backups, b)
+	}
+	return backups, nil
+}
+
+// backupDevice finds the VM's disk in query-block and whether it already
+// carries the backup dirty bitmap.
+func backupDevice(c *qmpClient) (string, bool, error) {
+	var devices []struct {
+		Device    string `json:"device"`
+		Removable bool   `json:"removable"`
+		Inserted  *struct {
+			DirtyBitmaps []struct {
+				Name string `json:"name"`
+			} `json:"dirty-bitmaps"`
+		} `json:"inserted"`
+		DirtyBitmaps []struct {
+			Name string `json:"name"`
+		} `json:"dirty-bitmaps"`
+	}
+	if err := c.execute("query-block", nil, &devices); err != nil {
+		return "", false, err
+	}
+	for _, d := range devices {
+		if d.Removable || d.Inserted == nil {
+			continue
+		}
+		bitmaps := append(d.Inserted.DirtyBitmaps, d.DirtyBitmaps...)
+		for _, b := range bitmaps {
+			if b.Name == backupBitmap {
+				return d.Device, true, nil
+			}
+		}
+		return d.Device, false, nil
+	}
+	return "", false, fmt.Errorf("no disk found in query-block")
+}
+
+// startBackup starts a live backup of a running VM. kind is "full",
+// "incremental" or "auto", which takes an incremental backup when the
+// dirty bitmap and a previous backup exist and the chain is not full yet.
+func startBackup(name, kind string) (*BackupJob, error) {
+	config, ok := lookupVM(name)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	vm := &config
+	if !isRunning(name) {
+		return nil, newAPIError(http.StatusConflict, "not_running", "VM is not running: %s", name)
+	}
+
+	// Hold the VM's slot from here, so a second request cannot start its
+	// own QMP transaction alongside this one
+	backupsMu.Lock()
+	if _, ok := activeBackups[name]; ok {
+		backupsMu.Unlock()
+		return nil, statusErrorf(http.StatusConflict, "a backup of %s is already running", name)
+	}
+	activeBackups[name] = nil
+	backupsMu.Unlock()
+	job, err := startBackupJob(vm, kind)
+	backupsMu.Lock()
+	if err != nil {
+		delete(activeBackups, name)
+		backupsMu.Unlock()
+		return nil, err
+	}
+	activeBackups[name] = job
+	snapshot := *job
+	backupsMu.Unlock()
+
+	log.Printf("Started %s backup of %s to %s", job.Kind, name, job.target)
+	publishEvent("backup_progress", name, snapshot)
+	go watchBackup(job)
+	return &snapshot, nil
+}
+
+// startBackupJob picks the backup kind and starts the QMP job for it.
+// Called with the VM's activeBackups slot reserved.
+func startBackupJob(vm *VMConfig, kind string) (*BackupJob, error) {
+	name := vm.Name
+	policy := backupPolicy(vm)
+	dir, err := filepath.Abs(policy.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	backups, err := listBackups(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := dialQMP(name)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	device, hasBitmap, err := backupDevice(c)
+	if err != nil {
+		return nil, err
+	}
+
+	incrementals := 0
+	for i := len(backups) - 1; i >= 0 && backups[i].Kind == "incremental"; i-- {
+		incrementals++
+	}
+	_, pendingErr := os.Stat(filepath.Join(dir, backupFullPending))
+	canIncrement := hasBitmap && len(backups) > 0 && os.IsNotExist(pendingErr)
+	switch kind {
+	case "", "auto":
+		kind = "full"
+		if canIncrement && incrementals < policy.FullEvery {
+			kind = "incremental"
+		}
+	case "incremental":
+		if !canIncrement {
+			return nil, statusError(http.StatusConflict, "no previous backup with a matching dirty bitmap, take a full backup first")
+		}
+	case "full":
+	default:
+		return nil, statusErrorf(http.StatusBadRequest, "invalid backup kind: %s", kind)
+	}
+
+	started := time.Now()
+	suffix := "full"
+	if kind == "incremental" {
+		suffix = "inc"
+	}
+	file := fmt.Sprintf("%s-%s.qcow2", started.Format(backupTimestampFormat), suffix)
+	target := filepath.Join(dir, file)
+
+	job := &BackupJob{
+		VM:        name,
+		JobID:     backupJobID(name),
+		Kind:      kind,
+		Device:    device,
+		File:      file,
+		Status:    "running",
+		StartedAt: started.Format("2006-01-02 15:04:05"),
+		target:    target,
+	}
+
+	if kind == "full" {
+		if err := ioutil.WriteFile(filepath.Join(dir, backupFullPending), nil, 0644); err != nil {
+			return nil, err
+		}
+		// Start a fresh bitmap atomically with the full copy, so the next
+		// incremental holds exactly the writes made after this point
+		if hasBitmap {
+			if err := c.execute("block-dirty-bitmap-remove", map[string]string{"node": device, "name": backupBitmap}, nil); err != nil {
+				return nil, err
+			}
+		}
+		err = c.execute("transaction", map[string]interface{}{
+			"actions": []map[string]interface{}{
+				{"type": "block-dirty-bitmap-add", "data": map[string]interface{}{
+					"node": device, "name": backupBitmap, "persistent": !vm.Snapshot,
+				}},
+				{"type": "drive-backup", "data": map[string]interface{}{
+					"job-id": job.JobID, "device": device, "target": target,
+					"sync": "full", "format": "qcow2", "auto-dismiss": false,
+				}},
+			},
+		}, nil)
+	} else {
+		prev := filepath.Join(dir, backups[len(backups)-1].File)
+		output, cerr := exec.Command(qemuCommand("qemu-img"), "create", "-f", "qcow2", "-b", prev, "-F", "qcow2", target).CombinedOutput()
+		if cerr != nil {
+			return nil, fmt.Errorf("failed to create backup target: %v - %s", cerr, strings.TrimSpace(string(output)))
+		}
+		err = c.execute("drive-backup", map[string]interface{}{
+			"job-id": job.JobID, "device": device, "target": target,
+			"sync": "incremental", "bitmap": backupBitmap, "format": "qcow2",
+			"mode": "existing", "auto-dismiss": false,
+		}, nil)
+	}
+	if err != nil {
+		os.Remove(target)
+		return nil, err
+	}
+	return job, nil
+}
+
+// watchBackup follows a backup job through query-block-jobs until QEMU
+// reports it concluded in query-jobs.
+func watchBackup(job *BackupJob) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c, err := dialQMP(job.VM)
+		if err != nil {
+			if !isRunning(job.VM) {
+				finishBackup(job, "VM stopped")
+				return
+			}
+			continue
+		}
+
+		var blockJobs []struct {
+			Device string `json:"device"`
+			Len    int64  `json:"len"`
+			Offset int64  `json:"offset"`
+		}
+		if err := c.execute("query-block-jobs", nil, &blockJobs); err == nil {
+			for _, bj := range blockJobs {
+				if bj.Device != job.JobID {
+					continue
+				}
+				backupsMu.Lock()
+				job.Offset, job.Len = bj.Offset, bj.Len
+				if bj.Len > 0 {
+					job.Progress = float64(bj.Offset) * 100 / float64(bj.Len)
+				}
+				snapshot := *job
+				backupsMu.Unlock()
+				publishEvent("backup_progress", job.VM, snapshot)
+			}
+		}
+
+		var jobs []struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		}
+		if err := c.execute("query-jobs", nil, &jobs); err != nil {
+			c.Close()
+			continue
+		}
+		for _, j := range jobs {
+			if j.ID != job.JobID || j.Status != "concluded" {
+				continue
+			}
+			c.execute("job-dismiss", map[string]string{"id": job.JobID}, nil)
+			c.Close()
+			finishBackup(job, j.Error)
+			return
+		}
+		c.Close()
+	}
+}
+
+func finishBackup(job *BackupJob, errMsg string) {
+	backupsMu.Lock()
+	job.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	switch {
+	case job.cancelled:
+		job.Status = "cancelled"
+	case errMsg != "":
+		job.Status = "failed"
+		job.Error = errMsg
+	default:
+		job.Status = "done"
+		job.Progress = 100
+	}
+	delete(activeBackups, job.VM)
+	lastBackupJobs[job.VM] = *job
+	snapshot := *job
+	backupsMu.Unlock()
+
+	if snapshot.Status != "done" {
+		os.Remove(job.target)
+		if job.Kind == "full" {
+			// The bitmap only counts writes since this backup started;
+			// the pending marker keeps the next backup full even if it
+			// cannot be removed now
+			if err := qmpExecute(job.VM, "block-dirty-bitmap-remove", map[string]string{"node": job.Device, "name": backupBitmap}, nil); err != nil {
+				log.Printf("Failed to remove backup bitmap of %s: %v", job.VM, err)
+			}
+		}
+		log.Printf("Backup of %s %s: %s", job.VM, snapshot.Status, errMsg)
+		publishEvent("backup_failed", job.VM, snapshot)
+		return
+	}
+
+	log.Printf("Finished %s backup of %s (%s)", job.Kind, job.VM, job.File)
+	publishEvent("backup_completed", job.VM, snapshot)
+	if job.Kind == "full" {
+		os.Remove(filepath.Join(filepath.Dir(job.target), backupFullPending))
+		if err := pruneBackups(job.VM); err != nil {
+			log.Printf("Failed to prune backups of %s: %v", job.VM, err)
+		}
+	}
+}
+
+func cancelBackup(name string) error {
+	backupsMu.Lock()
+	job, reserved := activeBackups[name]
+	if job != nil {
+		job.cancelled = true
+	}
+	backupsMu.Unlock()
+	if reserved && job == nil {
+		return statusErrorf(http.StatusConflict, "the backup of %s is still starting", name)
+	}
+	if job == nil {
+		return statusErrorf(http.StatusNotFound, "no backup running for %s", name)
+	}
+	return qmpExecute(name, "block-job-cancel", map[string]string{"device": job.JobID}, nil)
+}
+
+// pruneBackups deletes the oldest full backup chains beyond the policy's
+// keep count. Files that a VM disk is backed by (after a restore) are kept.
+func pruneBackups(name string) error {
+	config, ok := lookupVM(name)
+	if !ok {
+		return nil
+	}
+	vm := &config
+	policy := backupPolicy(vm)
+	backups, err := listBackups(vm)
+	if err != nil {
+		return err
+	}
+
+	chains := []string{}
+	for _, b := range backups {
+		if b.Kind == "full" {
+			chains = append(chains, b.Chain)
+		}
+	}
+	if len(chains) <= policy.Keep {
+		return nil
+	}
+	expired := map[string]bool{}
+	for _, chain := range chains[:len(chains)-policy.Keep] {
+		expired[chain] = true
+	}
+
+	inUse := map[string]bool{}
+	vms := configuredVMs()
+	for i := range vms {
+		other := &vms[i]
+		if other.Disk == "" {
+			continue
+		}
+		chain, err := imageInfo(resolveVMPath(other, other.Disk), isRunning(other.Name))
+		if err != nil {
+			continue
+		}
+		for _, layer := range chain {
+			inUse[filepath.Clean(layer.Filename)] = true
+		}
+	}
+
+	dir, _ := filepath.Abs(policy.Dir)
+	for _, b := range backups {
+		if !expired[b.Chain] {
+			continue
+		}
+		path := filepath.Join(dir, b.File)
+		if inUse[path] {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			log.Printf("Failed to remove backup %s: %v", path, err)
+			continue
+		}
+		log.Printf("Pruned backup %s of %s", b.File, name)
+	}
+	return nil
+}
+
+// restoreBackup points a stopped VM at a backup by giving it a new qcow2
+// overlay backed by that restore point. The backup itself stays untouched
+// and the previous disk is left in place.
+func restoreBackup(name, file string) (string, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	vm := findVMConfig(name)
+	if vm == nil {
+		return "", newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	if isRunning(name) {
+		return "", newAPIError(http.StatusConflict, "vm_running", "VM is running, stop it before restoring: %s", name)
+	}
+	if !backupFileRegex.MatchString(file) {
+		return "", statusErrorf(http.StatusBadRequest, "invalid backup: %s", file)
+	}
+	dir, err := filepath.Abs(backupPolicy(vm).Dir)
+	if err != nil {
+		return "", err
+	}
+	backing := filepath.Join(dir, file)
+	if _, err := os.Stat(backing); err != nil {
+		return "", statusErrorf(http.StatusNotFound, "backup not found: %s", file)
+	}
+
+	diskDir := "."
+	if vm.Disk != "" {
+		diskDir = filepath.Dir(vm.Disk)
+	}
+	disk := filepath.Join(diskDir, fmt.Sprintf("%s-restore-%s.qcow2", name, time.Now().Format(backupTimestampFormat)))
+	output, err := exec.Command(qemuCommand("qemu-img"), "create", "-f", "qcow2", "-b", backing, "-F", "qcow2", resolveVMPath(vm, disk)).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to create restore overlay: %v - %s", err, strings.TrimSpace(string(output)))
+	}
+
+	previous := vm.Disk
+	vm.Disk = disk
+	if err := saveVMsConfig(); err != nil {
+		return disk, newAPIError(http.StatusInternalServerError, "not_persisted", "restore overlay created but not persisted: %v", err)
+	}
+	log.Printf("Restored %s from backup %s (previous disk %s)", name, file, previous)
+	publishEvent("backup_restored", name, map[string]string{"file": file, "disk": disk, "previous_disk": previous})
+	return disk, nil
+}
+
+// backupScheduler starts an "auto" backup of every running VM whose
+// newest backup is older than its policy interval.
+func backupScheduler() {
+	ticker := time.NewTicker(backupSchedulerInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		vms := configuredVMs()
+		for i := range vms {
+			vm := &vms[i]
+			if vm.Backup == nil || vm.Backup.Interval == "" || !isRunning(vm.Name) {
+				continue
+			}
+			interval, err := time.ParseDuration(vm.Backup.Interval)
+			if err != nil {
+				continue
+			}
+			backupsMu.Lock()
+			_, active := activeBackups[vm.Name]
+			backupsMu.Unlock()
+			if active {
+				continue
+			}
+
+			backups, err := listBackups(vm)
+			if err != nil {
+				continue
+			}
+			if len(backups) > 0 {
+				last, err := time.ParseInLocation("2006-01-02 15:04:05", backups[len(backups)-1].CreatedAt, time.Local)
+				if err == nil && time.Since(last) < interval {
+					continue
+				}
+			}
+			if _, err := startBackup(vm.Name, "auto"); err != nil {
+				log.Printf("Scheduled backup of %s failed: %v", vm.Name, err)
+			}
+		}
+	}
+}
+
+// backupConflicts reports backup policies that cannot be scheduled.
+func backupConflicts() []string {
+	conflicts := []string{}
+	for _, vm := range vmsConfig.VMs {
+		if vm.Backup == nil || vm.Backup.Interval == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(vm.Backup.Interval); err != nil {
+			conflicts = append(conflicts, fmt.Sprintf("VM %s has invalid backup interval %q", vm.Name, vm.Backup.Interval))
+		}
+	}
+	return conflicts
+}
+
+// BackupStatus is the body of GET /api/vms/{name}/backups.
+type BackupStatus struct {
+	Backups []Backup     `json:"backups"`
+	Policy  BackupPolicy `json:"policy"`
+	Active  *BackupJob   `json:"active,omitempty"`
+	Last    *BackupJob   `json:"last,omitempty"`
+}
+
+// BackupRequest is the body of POST /api/vms/{name}/backups.
+type BackupRequest struct {
+	Kind string `json:"kind,omitempty"` // "auto" (default), "full" or "incremental"
+}
+
+// backupStatus lists a VM's backups, newest first, with its running and
+// last finished backup job.
+func backupStatus(vm *VMConfig) (*BackupStatus, error) {
+	backups, err := listBackups(vm)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(backups, func(i, j int) bool { return backups[i].File > backups[j].File })
+	resp := &BackupStatus{Backups: backups, Policy: backupPolicy(vm)}
+	backupsMu.Lock()
+	defer backupsMu.Unlock()
+	if job := activeBackups[vm.Name]; job != nil {
+		active := *job
+		resp.Active = &active
+	}
+	if job, ok := lastBackupJobs[vm.Name]; ok {
+		resp.Last = &job
+	}
+	return resp, nil
+}
+
+func handleBackups(w http.ResponseWriter, r *http.Request, name, sub string) {
+	config, ok := lookupVM(name)
+	if !ok {
+		legacyError(w, r, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name))
+		return
+	}
+	vm := &config
+
+	switch sub {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			resp, err := backupStatus(vm)
+			if err != nil {
+				legacyError(w, r, err)
+				return
+			}
+			json.NewEncoder(w).Encode(resp)
+		case http.MethodPost:
+			var req BackupRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			job, err := startBackup(name, req.Kind)
+			if err != nil {
+				legacyError(w, r, err)
+				return
+			}
+			json.NewEncoder(w).Encode(job)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "cancel":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := cancelBackup(name); err != nil {
+			legacyError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "cancelling", "name": name})
+	case "restore":
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			File string `json:"file"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.File == "" {
+			legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+			return
+		}
+		disk, err := restoreBackup(name, req.File)
+		if err != nil {
+			legacyError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "restored", "name": name, "disk": disk})
+	default:
+		http.NotFound(w, r)
+	}
+}
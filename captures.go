@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture is a packet capture on one NIC of a VM, active or finished.
+type Capture struct {
+	ID         string `json:"id"`
+	VM         string `json:"vm"`
+	Netdev     string `json:"netdev"`
+	Method     string `json:"method"` // "filter-dump" or "tcpdump"
+	File       string `json:"file"`
+	StartedAt  string `json:"started_at"`
+	MaxBytes   int64  `json:"max_bytes"`
+	MaxSeconds int    `json:"max_seconds"`
+	Bytes      int64  `json:"bytes"`
+	Active     bool   `json:"active"`
+	StopReason string `json:"stop_reason,omitempty"`
+
+	path    string
+	tcpdump *exec.Cmd
+	helper  io.Closer     // connection to the helper running tcpdump
+	copied  chan struct{} // closed once the helper's output is written
+	stop    chan string
+}
+
+const (
+	defaultCaptureMaxBytes   = 100 << 20
+	defaultCaptureMaxSeconds = 600
+)
+
+var (
+	capturesDir = "captures"
+
+	capturesMu     sync.Mutex
+	activeCaptures = map[string]*Capture{} // keyed by captureKey
+)
+
+// captureKey identifies an active capture. IDs are only unique per VM,
+// since they are made of the start time and netdev.
+func captureKey(vm, id string) string {
+	return vm + "/" + id
+}
+
+func captureObjectID(id string) string {
+	return "qm-cap-" + id
+}
+
+// startCapture begins capturing a NIC to a pcap file. NICs with a host
+// interface are captured with tcpdump, everything else with a QEMU
+// filter-dump object on the netdev.
+func startCapture(name, netdev string, maxBytes int64, maxSeconds int) (*Capture, error) {
+	config, ok := lookupVM(name)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	vm := &config
+	if !isRunning(name) {
+		return nil, newAPIError(http.StatusConflict, "not_running", "VM is not running: %s", name)
+	}
+	var nic *VMNetwork
+	for i := range vm.Networks {
+		if vm.Networks[i].ID == netdev {
+			nic = &vm.Networks[i]
+		}
+	}
+	if nic == nil {
+		return nil, newAPIError(http.StatusNotFound, "not_found", "netdev not found: %s", netdev)
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCaptureMaxBytes
+	}
+	if maxSeconds <= 0 {
+		maxSeconds = defaultCaptureMaxSeconds
+	}
+
+	dir := filepath.Join(capturesDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	id := started.Format("20060102-150405") + "-" + netdev
+	path, err := filepath.Abs(filepath.Join(dir, id+".pcap"))
+	if err != nil {
+		return nil, err
+	}
+
+	ifname := nicIfname(name, *nic)
+	method := "filter-dump"
+	if ifname != "" {
+		method = "tcpdump"
+	}
+	c := &Capture{
+		ID:         id,
+		VM:         name,
+		Netdev:     netdev,
+		Method:     method,
+		File:       id + ".pcap",
+		StartedAt:  started.Format("2006-01-02 15:04:05"),
+		MaxBytes:   maxBytes,
+		MaxSeconds: maxSeconds,
+		Active:     true,
+		path:       path,
+		stop:       make(chan string, 1),
+	}
+
+	// Reserve the NIC before starting, so two requests cannot both pass
+	capturesMu.Lock()
+	for _, other := range activeCaptures {
+		if other.VM == name && other.Netdev == netdev {
+			capturesMu.Unlock()
+			return nil, statusErrorf(http.StatusConflict, "capture %s already running on %s", other.ID, netdev)
+		}
+	}
+	activeCaptures[captureKey(name, id)] = c
+	capturesMu.Unlock()
+	if err := startCaptureMethod(c, ifname); err != nil {
+		capturesMu.Lock()
+		delete(activeCaptures, captureKey(name, id))
+		capturesMu.Unlock()
+		return nil, err
+	}
+
+	capturesMu.Lock()
+	snapshot := *c
+	capturesMu.Unlock()
+	go watchCapture(c)
+	log.Printf("Started %s capture %s on %s/%s", c.Method, id, name, netdev)
+	publishEvent("capture_started", name, snapshot)
+	return &snapshot, nil
+}
+
+// startCaptureMethod starts tcpdump on the NIC's host interface, or a QEMU
+// filter-dump object on the netdev when it has none. c is already listed
+// in activeCaptures, so its fields are set under capturesMu.
+func startCaptureMethod(c *Capture, ifname string) error {
+	if ifname == "" {
+		return qmpExecute(c.VM, "object-add", map[string]interface{}{
+			"qom-type": "filter-dump",
+			"id":       captureObjectID(c.ID),
+			"netdev":   c.Netdev,
+			"file":     c.path,
+		}, nil)
+	}
+	if helperAvailable() {
+		return startHelperCapture(c, ifname)
+	}
+	tcpdump := privilegedCommand("tcpdump", "-i", ifname, "-U", "-w", c.path)
+	if err := tcpdump.Start(); err != nil {
+		return fmt.Errorf("failed to start tcpdump: %v", err)
+	}
+	capturesMu.Lock()
+	c.tcpdump = tcpdump
+	capturesMu.Unlock()
+	return nil
+}
+
+// startHelperCapture has the privileged helper run tcpdump and writes
+// the output it passes back to the capture file. Closing c.helper stops it.
+func startHelperCapture(c *Capture, ifname string) error {
+	conn, _, files, err := openHelper(helperRequest{Op: "capture", VM: c.VM, Ifnames: []string{ifname}})
+	if err != nil {
+		return err
+	}
+	if len(files) != 1 {
+		conn.Close()
+		closeFiles(files)
+		return fmt.Errorf("privileged helper sent no capture output")
+	}
+	out, err := os.Create(c.path)
+	if err != nil {
+		conn.Close()
+		closeFiles(files)
+		return err
+	}
+	copied := make(chan struct{})
+	capturesMu.Lock()
+	c.helper = conn
+	c.copied = copied
+	capturesMu.Unlock()
+	go func() {
+		if _, err := io.Copy(out, files[0]); err != nil {
+			log.Printf("Capture %s: %v", c.ID, err)
+		}
+		files[0].Close()
+		out.Close()
+		close(copied)
+	}()
+	return nil
+}
+
+// watchCapture enforces the size and time limits of an active capture.
+func watchCapture(c *Capture) {
+	deadline := time.After(time.Duration(c.MaxSeconds) * time.Second)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	reason := ""
+	for reason == "" {
+		select {
+		case reason = <-c.stop:
+		case <-deadline:
+			reason = "time limit"
+		case <-ticker.C:
+			if st, err := os.Stat(c.path); err == nil {
+				capturesMu.Lock()
+				c.Bytes = st.Size()
+				capturesMu.Unlock()
+				if st.Size() >= c.MaxBytes {
+					reason = "size limit"
+				}
+			}
+			if !isRunning(c.VM) {
+				reason = "VM stopped"
+			}
+		}
+	}
+	finishCapture(c, reason)
+}
+
+func finishCapture(c *Capture, reason string) {
+	if c.helper != nil {
+		c.helper.Close()
+		<-c.copied
+	} else if c.tcpdump != nil {
+		c.tcpdump.Process.Signal(os.Interrupt)
+		c.tcpdump.Wait()
+	} else if reason != "VM stopped" {
+		if err := qmpExecute(c.VM, "object-del", map[string]string{"id": captureObjectID(c.ID)}, nil); err != nil {
+			log.Printf("Failed to remove capture filter %s: %v", c.ID, err)
+		}
+	}
+
+	capturesMu.Lock()
+	c.Active = false
+	c.StopReason = reason
+	if st, err := os.Stat(c.path); err == nil {
+		c.Bytes = st.Size()
+	}
+	delete(activeCaptures, captureKey(c.VM, c.ID))
+	snapshot := *c
+	capturesMu.Unlock()
+
+	log.Printf("Stopped capture %s on %s (%s, %d bytes)", c.ID, c.VM, reason, snapshot.Bytes)
+	publishEvent("capture_stopped", c.VM, snapshot)
+}
+
+func stopCapture(name, id string) error {
+	capturesMu.Lock()
+	c := activeCaptures[captureKey(name, id)]
+	capturesMu.Unlock()
+	if c == nil {
+		return statusErrorf(http.StatusNotFound, "no active capture: %s", id)
+	}
+	select {
+	case c.stop <- "stopped by user":
+	default:
+	}
+	return nil
+}
+
+// listCaptures returns finished capture files and active captures for a VM.
+func listCaptures(name string) ([]Capture, error) {
+	captures := []Capture{}
+	active := map[string]bool{}
+
+	capturesMu.Lock()
+	for _, c := range activeCaptures {
+		if c.VM == name {
+			captures = append(captures, *c)
+			active[c.ID] = true
+		}
+	}
+	capturesMu.Unlock()
+
+	entries, err := ioutil.ReadDir(filepath.Join(capturesDir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".pcap")
+		if e.IsDir() || id == e.Name() || active[id] {
+			continue
+		}
+		// IDs start with the capture's start time
+		started := e.ModTime()
+		if len(id) >= 15 {
+			if t, err := time.ParseInLocation("20060102-150405", id[:15], time.Local); err == nil {
+				started = t
+			}
+		}
+		captures = append(captures, Capture{
+			ID:        id,
+			VM:        name,
+			File:      e.Name(),
+			StartedAt: started.Format("2006-01-02 15:04:05"),
+			Bytes:     e.Size(),
+		})
+	}
+	sort.Slice(captures, func(i, j int) bool { return captures[i].ID > captures[j].ID })
+	return captures, nil
+}
+
+func capturePath(name, id string) (string, error) {
+	if id == "" || id != filepath.Base(id) {
+		return "", statusErrorf(http.StatusBadRequest, "invalid capture id: %s", id)
+	}
+	return filepath.Join(capturesDir, name, id+".pcap"), nil
+}
+
+// followCapture streams a capture file while it is still being written,
+// so a browser download tracks the live capture until it stops.
+func followCapture(w http.ResponseWriter, r *http.Request, name, id, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		legacyError(w, r, fileError(err))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".pcap"))
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		capturesMu.Lock()
+		_, active := activeCaptures[captureKey(name, id)]
+		capturesMu.Unlock()
+		if !active {
+			io.Copy(w, f)
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func handleCaptures(w http.ResponseWriter, r *http.Request, name, sub string) {
+	if !vmDefined(name) {
+		legacyError(w, r, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name))
+		return
+	}
+
+	if sub == "" {
+		switch r.Method {
+		case http.MethodGet:
+			captures, err := listCaptures(name)
+			if err != nil {
+				legacyError(w, r, err)
+				return
+			}
+			json.NewEncoder(w).Encode(captures)
+		case http.MethodPost:
+			var req struct {
+				Netdev     string `json:"netdev"`
+				MaxBytes   int64  `json:"max_bytes"`
+				MaxSeconds int    `json:"max_seconds"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Netdev == "" {
+				legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+				return
+			}
+			c, err := startCapture(name, req.Netdev, req.MaxBytes, req.MaxSeconds)
+			if err != nil {
+				legacyError(w, r, err)
+				return
+			}
+			json.NewEncoder(w).Encode(c)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id := sub
+	if strings.HasSuffix(sub, "/stop") {
+		id = strings.TrimSuffix(sub, "/stop")
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := stopCapture(name, id); err != nil {
+			legacyError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "stopping", "id": id})
+		return
+	}
+
+	path, err := capturePath(name, id)
+	if err != nil {
+		legacyError(w, r, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("follow") != "" {
+			followCapture(w, r, name, id, path)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".pcap"))
+		http.ServeFile(w, r, path)
+	case http.MethodDelete:
+		capturesMu.Lock()
+		_, active := activeCaptures[captureKey(name, id)]
+		capturesMu.Unlock()
+		if active {
+			legacyError(w, r, statusError(http.StatusConflict, "capture is still running, stop it first"))
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			legacyError(w, r, fileError(err))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted", "id": id})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"qemu-monitor/client"
+)
+
+// The command line mirrors the v1 API. Client commands talk to a running
+// server through the client package, or act in-process when no server
+// answers, so they also work while the monitor is down.
+
+// cliCommand is one subcommand of the binary.
+type cliCommand struct {
+	Name    string
+	Args    string
+	Summary string
+	Run     func(args []string) error
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{"serve", "[--settings FILE] [--listen ADDR]...", "Run the web UI and API server (the default)", runServe},
+		{"ls", "[-a]", "List running instances, with -a also stopped VMs", runList},
+		{"start", "NAME", "Start a VM", runStart},
+		{"stop", "NAME [--force]", "Stop a VM, with --force by SIGKILL", runStop},
+		{"console", "NAME [--serial]", "Open a shell on a VM over its SSH port, or its serial console", runConsole},
+		{"top", "[-d INTERVAL]", "Full-screen dashboard of instances with live CPU and memory", runTop},
+		{"ssh", "NAME [-- SSH ARGS]", "Run ssh to a VM", runSSH},
+		{"snapshot", "NAME [--kind K] [--list]", "Take or list live backups of a VM", runSnapshot},
+		{"logs", "[-f] [-n N] NAME", "Show a VM's audit trail, with -f follow it", runLogs},
+		{"config", "validate", "Check vms.json and auth.json", runConfig},
+		{"openapi", "[-go FILE]", "Print the OpenAPI spec or generate the Go client types", runOpenAPI},
+		{"hash-password", "", "Read a password on stdin and print its bcrypt hash", func([]string) error { return hashPassword() }},
+		{"helper", "USER", "Run the privileged helper for USER (as root)", runHelper},
+	}
+}
+
+// runCommand dispatches os.Args. Without a command the server starts, as
+// it always has.
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		return runServe(nil)
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		printUsage()
+		return nil
+	}
+	for _, cmd := range cliCommands {
+		if cmd.Name == args[0] {
+			return cmd.Run(args[1:])
+		}
+	}
+	printUsage()
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: qemu-monitor <command> [flags] [args]\n\nCommands:")
+	tw := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.Name, cmd.Args, cmd.Summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(os.Stderr, "\nClient commands take --server, --token, --ca, --local and -o table|json.\nRun qemu-monitor <command> -h for its flags.")
+}
+
+// cliOptions are the flags shared by the client commands. The server
+// defaults come from the environment.
+type cliOptions struct {
+	server   string
+	token    string
+	ca       string
+	local    bool
+	output   string
+	settings *settingsFlags
+}
+
+func newCLIFlags(name string) (*flag.FlagSet, *cliOptions) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := &cliOptions{}
+	fs.StringVar(&o.server, "server", os.Getenv("QEMU_MONITOR_URL"), "server URL (default the first listen address in the settings, in-process when it does not answer)")
+	fs.StringVar(&o.token, "token", os.Getenv("QEMU_MONITOR_TOKEN"), "API token")
+	fs.StringVar(&o.ca, "ca", os.Getenv("QEMU_MONITOR_CA"), "CA certificate to trust for an https server")
+	fs.BoolVar(&o.local, "local", false, "act in-process, without a server")
+	fs.StringVar(&o.output, "o", "table", "output format: table or json")
+	o.settings = addSettingsFlags(fs, false)
+	return fs, o
+}
+
+// parseArgs parses flags placed anywhere among the arguments, as in
+// `stop NAME --force`. Everything after "--" is returned untouched.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var rest []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, rest = args[:i], args[i+1:]
+			break
+		}
+	}
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	return append(positional, rest...)
+}
+
+// oneName returns the single VM name a command takes.
+func oneName(fs *flag.FlagSet, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: qemu-monitor %s NAME", fs.Name())
+	}
+	return args[0], nil
+}
+
+// cliBackend carries out client commands, through the API of a running
+// server or in-process.
+type cliBackend interface {
+	Instances() (*client.Response, error)
+	VMs() (*client.VMsConfig, error)
+	StartVM(name string) (*client.StatusResult, error)
+	StopVM(name string, force bool) (*client.StatusResult, error)
+	PauseVM(name string, pause bool) (*client.StatusResult, error)
+	Shell(name string) (*client.ShellInfo, error)
+	Backups(name string) (*client.BackupStatus, error)
+	StartBackup(name, kind string) (*client.BackupJob, error)
+	Audit(q client.AuditQuery) (*client.AuditPage, error)
+	Serial(name string) (io.ReadWriteCloser, error)
+}
+
+// backend picks the server to talk to. An explicit --server must answer;
+// the default one, where the settings say the server listens, falls back
+// to in-process when nothing listens there.
+func (o *cliOptions) backend() (cliBackend, error) {
+	if err := o.settings.apply(); err != nil {
+		return nil, err
+	}
+	if o.local {
+		return newLocalBackend()
+	}
+	server, socket := o.server, ""
+	if server == "" {
+		server, socket = defaultServer()
+	}
+	c := client.New(server, o.token)
+	if socket != "" {
+		c.HTTPClient = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}}
+	} else if err := o.trustCA(c); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err := c.Ping(ctx)
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest && strings.HasPrefix(server, "http:") {
+		// Plain HTTP sent to a server with TLS enabled
+		c.BaseURL = "https:" + strings.TrimPrefix(server, "http:")
+		err = c.Ping(ctx)
+	}
+	switch {
+	case err == nil:
+		return &remoteBackend{c: c}, nil
+	case o.server != "":
+		return nil, fmt.Errorf("server %s not reachable: %v", server, err)
+	case !nothingListening(err):
+		// A server is there but failed to answer; acting in-process would
+		// go behind its back
+		return nil, fmt.Errorf("server %s did not answer: %v (use --local to act without it)", server, err)
+	}
+	return newLocalBackend()
+}
+
+// nothingListening reports whether a request failed because no server
+// runs at the address, as opposed to one that is slow, broken or not
+// trusted.
+func nothingListening(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)
+}
+
+// trustCA makes the client trust --ca, or else the CA the server
+// generated in tls/ when there is one.
+func (o *cliOptions) trustCA(c *client.Client) error {
+	path := o.ca
+	if path == "" {
+		path = filepath.Join(tlsDir, "ca.crt")
+		if _, err := os.Stat(path); err != nil {
+			return nil
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", path)
+	}
+	c.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	return nil
+}
+
+// remoteBackend goes through a server's v1 API.
+type remoteBackend struct {
+	c *client.Client
+}
+
+func (b *remoteBackend) Instances() (*client.Response, error) {
+	return b.c.Instances(context.Background())
+}
+
+func (b *remoteBackend) VMs() (*client.VMsConfig, error) {
+	return b.c.VMs(context.Background())
+}
+
+func (b *remoteBackend) StartVM(name string) (*client.StatusResult, error) {
+	return b.c.StartVM(context.Background(), name)
+}
+
+func (b *remoteBackend) StopVM(name string, force bool) (*client.StatusResult, error) {
+	return b.c.StopVM(context.Background(), name, force)
+}
+
+func (b *remoteBackend) PauseVM(name string, pause bool) (*client.StatusResult, error) {
+	if pause {
+		return b.c.PauseVM(context.Background(), name)
+	}
+	return b.c.ResumeVM(context.Background(), name)
+}
+
+func (b *remoteBackend) Shell(name string) (*client.ShellInfo, error) {
+	info, err := b.c.Shell(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	// Forwarded ports are on the server's host, not this one
+	if u, err := url.Parse(b.c.BaseURL); err == nil && !isLoopback(u.Hostname()) {
+		info.SSHCommand = strings.Replace(info.SSHCommand, "@localhost", "@"+u.Hostname(), 1)
+		info.HTTPURL = strings.Replace(info.HTTPURL, "//localhost:", "//"+u.Hostname()+":", 1)
+	}
+	return info, nil
+}
+
+func (b *remoteBackend) Backups(name string) (*client.BackupStatus, error) {
+	return b.c.Backups(context.Background(), name)
+}
+
+func (b *remoteBackend) StartBackup(name, kind string) (*client.BackupJob, error) {
+	return b.c.StartBackup(context.Background(), name, kind)
+}
+
+func (b *remoteBackend) Audit(q client.AuditQuery) (*client.AuditPage, error) {
+	return b.c.Audit(context.Background(), q)
+}
+
+func (b *remoteBackend) Serial(name string) (io.ReadWriteCloser, error) {
+	conn, err := b.c.Serial(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	return &wsStream{conn: conn}, nil
+}
+
+func isLoopback(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// localBackend acts in-process on vms.json and the QEMU processes of this
+// host. Changes are recorded in the audit log as the local user.
+type localBackend struct {
+	auditOnce sync.Once
+}
+
+func newLocalBackend() (*localBackend, error) {
+	if err := makeSettingsDirs(); err != nil {
+		return nil, err
+	}
+	if err := refreshLocalInstances(); err != nil {
+		return nil, err
+	}
+	if err := loadVMsConfig(); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", configPath, err)
+	}
+	return &localBackend{}, nil
+}
+
+// refreshLocalInstances lists the QEMU processes the way the server's
+// updater does, as far as commands need it.
+func refreshLocalInstances() error {
+	instances, err := getQEMUInstances()
+	if err != nil {
+		return err
+	}
+	trackRunStates(instances)
+	setInstances(instances)
+	return nil
+}
+
+// convert copies a server type into its client twin through JSON, which
+// both encode the same way.
+func convert(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (b *localBackend) audit(action, vm string, params map[string]interface{}, err error) {
+	b.auditOnce.Do(loadAuditLog)
+	auditLocal(action, vm, params, err)
+}
+
+// Instances relists the processes when the last listing is older than a
+// second, so commands that poll, like top, see changes.
+func (b *localBackend) Instances() (*client.Response, error) {
+	if _, updated := instancesSnapshot(); time.Since(updated) >= time.Second {
+		if err := refreshLocalInstances(); err != nil {
+			return nil, err
+		}
+	}
+	instances, updated := instancesSnapshot()
+	var out client.Response
+	err := convert(Response{
+		Instances:   instances,
+		Count:       len(instances),
+		LastUpdated: updated.Format("2006-01-02 15:04:05"),
+		Conflicts:   configConflicts(),
+	}, &out)
+	return &out, err
+}
+
+func (b *localBackend) VMs() (*client.VMsConfig, error) {
+	var out client.VMsConfig
+	return &out, convert(vmsConfig, &out)
+}
+
+func (b *localBackend) StartVM(name string) (*client.StatusResult, error) {
+	err := startVM(name)
+	b.audit("start", name, nil, err)
+	if err != nil {
+		return nil, err
+	}
+	return &client.StatusResult{Status: "starting", Name: name}, nil
+}
+
+func (b *localBackend) StopVM(name string, force bool) (*client.StatusResult, error) {
+	inst, err := stopInstance(name, "", force, func(string) bool { return true })
+	action := "stop"
+	if force {
+		action = "force_stop"
+	}
+	b.audit(action, name, nil, err)
+	if err != nil {
+		return nil, err
+	}
+	var out client.StatusResult
+	return &out, convert(stopResult(inst, force), &out)
+}
+
+func (b *localBackend) PauseVM(name string, pause bool) (*client.StatusResult, error) {
+	err := pauseVM(name, pause)
+	action := "resume"
+	if pause {
+		action = "pause"
+	}
+	b.audit(action, name, nil, err)
+	if err != nil {
+		return nil, err
+	}
+	var out client.StatusResult
+	return &out, convert(pauseResult(name, pause), &out)
+}
+
+func (b *localBackend) Shell(name string) (*client.ShellInfo, error) {
+	info, err := getShellInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	var out client.ShellInfo
+	return &out, convert(info, &out)
+}
+
+func (b *localBackend) Backups(name string) (*client.BackupStatus, error) {
+	vm, ok := lookupVM(name)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	status, err := backupStatus(&vm)
+	if err != nil {
+		return nil, err
+	}
+	var out client.BackupStatus
+	return &out, convert(status, &out)
+}
+
+// StartBackup waits for the backup to finish, since the job is watched by
+// this process.
+func (b *localBackend) StartBackup(name, kind string) (*client.BackupJob, error) {
+	job, err := startBackup(name, kind)
+	b.audit("backups", name, map[string]interface{}{"kind": kind}, err)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		time.Sleep(time.Second)
+		backupsMu.Lock()
+		active, running := activeBackups[name]
+		if active != nil {
+			fmt.Fprintf(os.Stderr, "\r%s: %.0f%%", job.File, active.Progress)
+		}
+		last := lastBackupJobs[name]
+		backupsMu.Unlock()
+		if !running {
+			fmt.Fprintln(os.Stderr)
+			var out client.BackupJob
+			return &out, convert(last, &out)
+		}
+	}
+}
+
+func (b *localBackend) Audit(q client.AuditQuery) (*client.AuditPage, error) {
+	entries, err := readAuditLog()
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"user": q.User, "vm": q.VM, "action": q.Action, "outcome": q.Outcome,
+		"since": q.Since, "until": q.Until,
+	} {
+		values.Set(key, value)
+	}
+	if q.Limit > 0 {
+		values.Set("limit", fmt.Sprint(q.Limit))
+	}
+	page, err := filterAuditLog(entries, values)
+	if err != nil {
+		return nil, err
+	}
+	var out client.AuditPage
+	return &out, convert(page, &out)
+}
+
+func (b *localBackend) Serial(name string) (io.ReadWriteCloser, error) {
+	sc, output, backlog, err := attachSerial(name)
+	if err != nil {
+		return nil, err
+	}
+	return &localSerial{sc: sc, output: output, pending: backlog}, nil
+}
+
+// printResult writes v as indented JSON, or runs table to print it for
+// people.
+func (o *cliOptions) printResult(v interface{}, table func(tw *tabwriter.Writer)) error {
+	switch o.output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "table":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format: %s", o.output)
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// listRow is one line of `ls`.
+type listRow struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	PID    string `json:"pid,omitempty"`
+	ID     string `json:"id,omitempty"`
+	CPUs   string `json:"cpus,omitempty"`
+	Memory string `json:"memory,omitempty"`
+	Uptime string `json:"uptime,omitempty"`
+	Type   string `json:"type"`
+}
+
+func runList(args []string) error {
+	fs, o := newCLIFlags("ls")
+	all := fs.Bool("a", false, "include configured VMs that are not running")
+	if len(parseArgs(fs, args)) > 0 {
+		return fmt.Errorf("usage: qemu-monitor ls [-a]")
+	}
+	b, err := o.backend()
+	if err != nil {
+		return err
+	}
+	resp, err := b.Instances()
+	if err != nil {
+		return err
+	}
+
+	rows := []listRow{}
+	running := map[string]bool{}
+	for _, inst := range resp.Instances {
+		running[inst.Name] = true
+		rows = append(rows, listRow{inst.Name, inst.Status, inst.PID, inst.ID, inst.CPUCount, inst.Memory, inst.Uptime, inst.Type})
+	}
+	if *all {
+		vms, err := b.VMs()
+		if err != nil {
+			return err
+		}
+		for _, vm := range vms.VMs {
+			if !running[vm.Name] {
+				rows = append(rows, listRow{Name: vm.Name, Status: "stopped", CPUs: vm.CPUs, Memory: vm.Memory, Type: "custom"})
+			}
+		}
+	}
+
+	return o.printResult(rows, func(tw *tabwriter.Writer) {
+		fmt.Fprintln(tw, "NAME\tSTATUS\tPID\tID\tCPUS\tMEMORY\tUPTIME\tTYPE")
+		for _, r := range rows {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", dash(r.Name), dash(r.Status), dash(r.PID), dash(r.ID),
+				dash(r.CPUs), dash(r.Memory), dash(r.Uptime), r.Type)
+		}
+		for _, conflict := range resp.Conflicts {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", conflict)
+		}
+	})
+}
+
+func runStart(args []string) error {
+	fs, o := newCLIFlags("start")
+	name, err := oneName(fs, parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	b, err := o.backend()
+	if err != nil {
+		return err
+	}
+	result, err := b.StartVM(name)
+	if err != nil {
+		return err
+	}
+	return o.printResult(result, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "Starting %s\n", name)
+	})
+}
+
+func runStop(args []string) error {
+	fs, o := newCLIFlags("stop")
+	force := fs.Bool("force", false, "kill with SIGKILL instead of SIGTERM")
+	name, err := oneName(fs, parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	b, err := o.backend()
+	if err != nil {
+		return err
+	}
+	result, err := b.StopVM(name, *force)
+	if err != nil {
+		return err
+	}
+	return o.printResult(result, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "%s %s (PID %s)\n", result.Name, result.Status, result.PID)
+	})
+}
+
+func runSnapshot(args []string) error {
+	fs, o := newCLIFlags("snapshot")
+	kind := fs.String("kind", "auto", "auto, full or incremental")
+	list := fs.Bool("list", false, "list backups instead of taking one")
+	name, err := oneName(fs, parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	b, err := o.backend()
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		status, err := b.Backups(name)
+		if err != nil {
+			return err
+		}
+		return o.printResult(status, func(tw *tabwriter.Writer) {
+			fmt.Fprintln(tw, "FILE\tKIND\tCHAIN\tSIZE\tCREATED")
+			for _, backup := range status.Backups {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", backup.File, backup.Kind, backup.Chain, humanSize(backup.Size), backup.CreatedAt)
+			}
+		})
+	}
+
+	job, err := b.StartBackup(name, *kind)
+	if err != nil {
+		return err
+	}
+	if _, remote := b.(*remoteBackend); remote {
+		// Follow the job until the server reports it finished
+		for job.Status == "running" {
+			fmt.Fprintf(os.Stderr, "\r%s: %.0f%%", job.File, job.Progress)
+			time.Sleep(time.Second)
+			status, err := b.Backups(name)
+			if err != nil {
+				return err
+			}
+			switch {
+			case status.Active != nil:
+				job = status.Active
+			case status.Last != nil && status.Last.JobID == job.JobID:
+				job = status.Last
+				fmt.Fprintln(os.Stderr)
+			}
+		}
+	}
+	if job.Error != "" {
+		return fmt.Errorf("backup of %s %s: %s", name, job.Status, job.Error)
+	}
+	return o.printResult(job, func(tw *tabwriter.Writer) {
+		fmt.Fprintf(tw, "%s backup of %s %s: %s\n", job.Kind, name, job.Status, job.File)
+	})
+}
+
+func humanSize(n int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	size := float64(n)
+	i := 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", size, units[i])
+}
+
+func runLogs(args []string) error {
+	fs, o := newCLIFlags("logs")
+	follow := fs.Bool("f", false, "keep printing new entries")
+	lines := fs.Int("n", 20, "number of past entries to show")
+	name, err := oneName(fs, parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	b, err := o.backend()
+	if err != nil {
+		return err
+	}
+
+	show := func(entries []client.AuditEntry) {
+		if o.output == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			for _, e := range entries {
+				enc.Encode(e)
+			}
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, e := range entries {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.User, e.Action, e.Outcome, e.Error)
+		}
+		tw.Flush()
+	}
+
+	page, err := b.Audit(client.AuditQuery{VM: name, Limit: *lines})
+	if err != nil {
+		return err
+	}
+	show(page.Entries)
+	if !*follow {
+		return nil
+	}
+
+	var last client.AuditEntry
+	if len(page.Entries) > 0 {
+		last = page.Entries[len(page.Entries)-1]
+	}
+	for {
+		time.Sleep(2 * time.Second)
+		q := client.AuditQuery{VM: name, Limit: 1000}
+		if !last.Time.IsZero() {
+			q.Since = last.Time.Format(time.RFC3339Nano)
+		}
+		page, err := b.Audit(q)
+		if err != nil {
+			return err
+		}
+		var fresh []client.AuditEntry
+		for _, e := range page.Entries {
+			if e.Seq > last.Seq {
+				fresh = append(fresh, e)
+			}
+		}
+		if len(fresh) > 0 {
+			show(fresh)
+			last = fresh[len(fresh)-1]
+		}
+	}
+}
+
+// configReport is the result of `config validate`.
+type configReport struct {
+	Valid    bool     `json:"valid"`
+	VMs      int      `json:"vms"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func runConfig(args []string) error {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	output := fs.String("o", "table", "output format: table or json")
+	sf := addSettingsFlags(fs, true)
+	args = parseArgs(fs, args)
+	if len(args) != 1 || args[0] != "validate" {
+		return fmt.Errorf("usage: qemu-monitor config validate")
+	}
+	if err := sf.apply(); err != nil {
+		return err
+	}
+
+	readOnlyState = true
+	report := validateConfig()
+	o := &cliOptions{output: *output}
+	err := o.printResult(report, func(tw *tabwriter.Writer) {
+		for _, msg := range report.Errors {
+			fmt.Fprintf(tw, "error\t%s\n", msg)
+		}
+		for _, msg := range report.Warnings {
+			fmt.Fprintf(tw, "warning\t%s\n", msg)
+		}
+		if report.Valid {
+			fmt.Fprintf(tw, "%s and %s are valid (%d VMs)\n", configPath, authConfigPath, report.VMs)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !report.Valid {
+		return fmt.Errorf("%d problems found", len(report.Errors))
+	}
+	return nil
+}
+
+// validateConfig checks vms.json and auth.json as the server would load
+// them, without writing any state.
+func validateConfig() configReport {
+	report := configReport{Errors: []string{}, Warnings: []string{}}
+	fail := func(format string, args ...interface{}) {
+		report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+	}
+
+	if data, err := ioutil.ReadFile(configPath); err != nil {
+		fail("%v", err)
+	} else if err := json.Unmarshal(data, &vmsConfig); err != nil {
+		fail("%s: %s", configPath, jsonErrorPosition(data, err))
+	} else {
+		loadPortAssignments()
+		allocatePorts()
+		deriveServicePorts()
+		deriveMACs()
+		report.VMs = len(vmsConfig.VMs)
+
+		seen := map[string]bool{}
+		for _, vm := range vmsConfig.VMs {
+			switch {
+			case vm.Name == "":
+				fail("a VM has no name")
+			case seen[vm.Name]:
+				fail("VM %s is defined more than once", vm.Name)
+			}
+			seen[vm.Name] = true
+			if vm.Disk == "" {
+				fail("VM %s has no disk", vm.Name)
+			} else if _, err := os.Stat(resolveVMPath(&vm, vm.Disk)); err != nil {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("VM %s: disk %s", vm.Name, err))
+			}
+			if err := checkQEMUArgs(&vm); err != nil && vm.Name != "" {
+				fail("VM %s: %v", vm.Name, err)
+			}
+		}
+		if instances, err := getQEMUInstances(); err == nil {
+			setInstances(instances)
+		}
+		for _, conflict := range configConflicts() {
+			fail("%s", conflict)
+		}
+	}
+
+	if data, err := ioutil.ReadFile(authConfigPath); err == nil {
+		var cfg AuthConfig
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			fail("%s: %s", authConfigPath, jsonErrorPosition(data, err))
+		} else {
+			report.Warnings = append(report.Warnings, authConfigWarnings(cfg)...)
+		}
+	} else if !os.IsNotExist(err) {
+		fail("%v", err)
+	}
+
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+// jsonErrorPosition adds the line and column to a JSON syntax error.
+func jsonErrorPosition(data []byte, err error) string {
+	var syntax *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	offset := int64(-1)
+	switch {
+	case errors.As(err, &syntax):
+		offset = syntax.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	}
+	if offset < 0 {
+		return err.Error()
+	}
+	before := data[:offset]
+	line := strings.Count(string(before), "\n") + 1
+	col := int(offset) - strings.LastIndex(string(before), "\n")
+	return fmt.Sprintf("line %d, column %d: %v", line, col, err)
+}
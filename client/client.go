@@ -0,0 +1,434 @@
+// Package client is a Go client for the qemu-monitor v1 API.
+//
+// The request and response types in types_gen.go are generated from the
+// server's own types; regenerate them after changing an API type with
+// `go generate ./client`.
+package client
+
+//go:generate go run .. openapi -go types_gen.go -package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client calls a qemu-monitor server. Token is sent as a bearer token when
+// set; HTTPClient defaults to http.DefaultClient, and can carry a TLS
+// config with the server's CA or a client certificate, or dial a unix
+// socket the server listens on.
+type Client struct {
+	BaseURL    string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL, e.g.
+// "https://host:5450".
+func New(baseURL, token string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), Token: token}
+}
+
+// Error is an error response from the server.
+type Error struct {
+	StatusCode int
+	APIError
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+// PortForward host ports are either a fixed number or "auto", in which
+// case AssignedHost is the port the server allocated.
+type PortForward struct {
+	Host         int
+	Auto         bool
+	Guest        int
+	Protocol     string
+	AssignedHost int
+}
+
+func (pf *PortForward) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Host         json.RawMessage `json:"host"`
+		Guest        int             `json:"guest"`
+		Protocol     string          `json:"protocol"`
+		AssignedHost int             `json:"assigned_host"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*pf = PortForward{Guest: raw.Guest, Protocol: raw.Protocol, AssignedHost: raw.AssignedHost}
+	if string(raw.Host) == `"auto"` {
+		pf.Auto = true
+		return nil
+	}
+	return json.Unmarshal(raw.Host, &pf.Host)
+}
+
+func (pf PortForward) MarshalJSON() ([]byte, error) {
+	var host interface{} = pf.Host
+	if pf.Auto {
+		host = "auto"
+	}
+	return json.Marshal(struct {
+		Host     interface{} `json:"host"`
+		Guest    int         `json:"guest"`
+		Protocol string      `json:"protocol,omitempty"`
+	}{host, pf.Guest, pf.Protocol})
+}
+
+// do sends a request and decodes a JSON response into out, which may be
+// nil.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var e ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == nil {
+			return &Error{StatusCode: resp.StatusCode, APIError: APIError{Code: "http_error", Message: resp.Status}}
+		}
+		return &Error{StatusCode: resp.StatusCode, APIError: *e.Error}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) get(ctx context.Context, path string, out interface{}) error {
+	return c.do(ctx, http.MethodGet, path, nil, out)
+}
+
+// Ping checks a server is answering, without authenticating.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.get(ctx, "/api/openapi.json", nil)
+}
+
+// Instances lists the running QEMU instances the caller may see.
+func (c *Client) Instances(ctx context.Context) (*Response, error) {
+	var out Response
+	if err := c.get(ctx, "/api/v1/instances", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Instance returns one running instance by ID.
+func (c *Client) Instance(ctx context.Context, id string) (*QEMUInstance, error) {
+	var out QEMUInstance
+	if err := c.get(ctx, "/api/v1/instances/"+url.PathEscape(id), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StopInstance stops an instance by ID, with SIGKILL when force is set.
+func (c *Client) StopInstance(ctx context.Context, id string, force bool) (*StatusResult, error) {
+	var out StatusResult
+	if err := c.do(ctx, http.MethodPost, "/api/v1/instances/"+url.PathEscape(id)+"/stop", StopRequest{Force: force}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// VMs returns the configured VMs the caller may see.
+func (c *Client) VMs(ctx context.Context) (*VMsConfig, error) {
+	var out VMsConfig
+	if err := c.get(ctx, "/api/v1/vms", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// VM returns one VM's configuration.
+func (c *Client) VM(ctx context.Context, name string) (*VMConfig, error) {
+	var out VMConfig
+	if err := c.get(ctx, "/api/v1/vms/"+url.PathEscape(name), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StartVM starts a configured VM. The server answers once QEMU is
+// launched, before the guest has booted.
+func (c *Client) StartVM(ctx context.Context, name string) (*StatusResult, error) {
+	var out StatusResult
+	if err := c.do(ctx, http.MethodPost, "/api/v1/vms/"+url.PathEscape(name)+"/start", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StopVM stops a VM by name, with SIGKILL when force is set.
+func (c *Client) StopVM(ctx context.Context, name string, force bool) (*StatusResult, error) {
+	var out StatusResult
+	if err := c.do(ctx, http.MethodPost, "/api/v1/vms/"+url.PathEscape(name)+"/stop", StopRequest{Force: force}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// PauseVM stops a running VM's vCPUs. The QEMU process and the guest's
+// memory are kept.
+func (c *Client) PauseVM(ctx context.Context, name string) (*StatusResult, error) {
+	var out StatusResult
+	if err := c.do(ctx, http.MethodPost, "/api/v1/vms/"+url.PathEscape(name)+"/pause", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ResumeVM lets a paused VM run again.
+func (c *Client) ResumeVM(ctx context.Context, name string) (*StatusResult, error) {
+	var out StatusResult
+	if err := c.do(ctx, http.MethodPost, "/api/v1/vms/"+url.PathEscape(name)+"/resume", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// DeleteVM removes a VM from the configuration, and its disk when
+// removeDisk is set.
+func (c *Client) DeleteVM(ctx context.Context, name string, removeDisk bool) (*StatusResult, error) {
+	path := "/api/v1/vms/" + url.PathEscape(name)
+	if removeDisk {
+		path += "?disk=1"
+	}
+	var out StatusResult
+	if err := c.do(ctx, http.MethodDelete, path, nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Shell returns how to reach a VM over SSH and HTTP.
+func (c *Client) Shell(ctx context.Context, name string) (*ShellInfo, error) {
+	var out ShellInfo
+	if err := c.get(ctx, "/api/v1/vms/"+url.PathEscape(name)+"/shell", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CloneVM clones a VM as name. mode is "overlay" (the default when empty)
+// or "copy"; the result's Job tracks the new disk.
+func (c *Client) CloneVM(ctx context.Context, source, name, mode string) (*CloneResult, error) {
+	var out CloneResult
+	if err := c.do(ctx, http.MethodPost, "/api/v1/vms/"+url.PathEscape(source)+"/clone", CloneRequest{Name: name, Mode: mode}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Backups returns a VM's backups and its running and last backup job.
+func (c *Client) Backups(ctx context.Context, name string) (*BackupStatus, error) {
+	var out BackupStatus
+	if err := c.get(ctx, "/api/v1/vms/"+url.PathEscape(name)+"/backups", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StartBackup starts a live backup of a running VM. kind is "auto" (the
+// default when empty), "full" or "incremental".
+func (c *Client) StartBackup(ctx context.Context, name, kind string) (*BackupJob, error) {
+	var out BackupJob
+	if err := c.do(ctx, http.MethodPost, "/api/v1/vms/"+url.PathEscape(name)+"/backups", BackupRequest{Kind: kind}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Images lists the disks of configured and running VMs.
+func (c *Client) Images(ctx context.Context) (*ImageList, error) {
+	var out ImageList
+	if err := c.get(ctx, "/api/v1/images", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ImageJobs lists running and recent image jobs.
+func (c *Client) ImageJobs(ctx context.Context) ([]ImageJob, error) {
+	var out []ImageJob
+	if err := c.get(ctx, "/api/v1/images/jobs", &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// CreateImageJob starts a qemu-img operation.
+func (c *Client) CreateImageJob(ctx context.Context, req ImageJobRequest) (*ImageJob, error) {
+	var out ImageJob
+	if err := c.do(ctx, http.MethodPost, "/api/v1/images/jobs", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// ImageJob returns one image job by ID.
+func (c *Client) ImageJob(ctx context.Context, id string) (*ImageJob, error) {
+	var out ImageJob
+	if err := c.get(ctx, "/api/v1/images/jobs/"+url.PathEscape(id), &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// AuditQuery filters the audit log. Since and Until take RFC 3339 times
+// or durations like "24h".
+type AuditQuery struct {
+	User, VM, Action, Outcome string
+	Since, Until              string
+	Limit                     int
+}
+
+// Audit searches the audit log.
+func (c *Client) Audit(ctx context.Context, q AuditQuery) (*AuditPage, error) {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"user": q.User, "vm": q.VM, "action": q.Action, "outcome": q.Outcome,
+		"since": q.Since, "until": q.Until,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	path := "/api/v1/audit"
+	if len(values) > 0 {
+		path += "?" + values.Encode()
+	}
+	var out AuditPage
+	if err := c.get(ctx, path, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// VerifyAudit checks the audit log's hash chain on the server.
+func (c *Client) VerifyAudit(ctx context.Context) (*AuditVerification, error) {
+	var out AuditVerification
+	if err := c.get(ctx, "/api/v1/audit/verify", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Settings returns the server's effective settings and where each came
+// from.
+func (c *Client) Settings(ctx context.Context) (*Settings, error) {
+	var out Settings
+	if err := c.get(ctx, "/api/v1/settings", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Whoami returns the principal the server authenticated the client as.
+func (c *Client) Whoami(ctx context.Context) (*WhoamiResult, error) {
+	var out WhoamiResult
+	if err := c.get(ctx, "/api/v1/whoami", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// TerminalMessage is sent to a terminal connection: keystrokes as "input"
+// and window size changes as "resize". The server sends guest output as
+// binary messages.
+type TerminalMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
+// Terminal opens an interactive shell on a running VM over its SSH port,
+// relayed by the server.
+func (c *Client) Terminal(ctx context.Context, name string, cols, rows int) (*websocket.Conn, error) {
+	query := url.Values{"cols": {strconv.Itoa(cols)}, "rows": {strconv.Itoa(rows)}}
+	return c.dial(ctx, "/api/v1/vms/"+url.PathEscape(name)+"/terminal", query)
+}
+
+// Serial attaches to a running VM's serial console, which has the QEMU
+// monitor multiplexed on it. It speaks the terminal protocol; recent
+// output is sent first.
+func (c *Client) Serial(ctx context.Context, name string) (*websocket.Conn, error) {
+	return c.dial(ctx, "/api/v1/vms/"+url.PathEscape(name)+"/serial", nil)
+}
+
+// dial opens a WebSocket to the server.
+func (c *Client) dial(ctx context.Context, path string, query url.Values) (*websocket.Conn, error) {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path = path
+	u.RawQuery = query.Encode()
+
+	dialer := *websocket.DefaultDialer
+	if c.HTTPClient != nil {
+		if transport, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+			dialer.TLSClientConfig = transport.TLSClientConfig
+			dialer.NetDialContext = transport.DialContext
+		}
+	}
+	header := http.Header{}
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode >= 400 {
+			defer resp.Body.Close()
+			var e ErrorResponse
+			if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != nil {
+				return nil, &Error{StatusCode: resp.StatusCode, APIError: *e.Error}
+			}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
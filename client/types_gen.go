@@ -0,0 +1,337 @@
+// Code generated by qemu-monitor openapi -go; DO NOT EDIT.
+
+package client
+
+import "time"
+
+type APIError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type AuditEntry struct {
+	Seq      int64                  `json:"seq"`
+	Time     time.Time              `json:"time"`
+	User     string                 `json:"user"`
+	Kind     string                 `json:"kind,omitempty"`
+	Source   string                 `json:"source"`
+	Action   string                 `json:"action"`
+	Method   string                 `json:"method,omitempty"`
+	Path     string                 `json:"path,omitempty"`
+	VM       string                 `json:"vm,omitempty"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	Outcome  string                 `json:"outcome"`
+	Error    string                 `json:"error,omitempty"`
+	PrevHash string                 `json:"prev_hash"`
+	Hash     string                 `json:"hash"`
+}
+
+type AuditPage struct {
+	Entries []AuditEntry `json:"entries"`
+	Total   int          `json:"total"`
+}
+
+type AuditVerification struct {
+	OK          bool   `json:"ok"`
+	Entries     int    `json:"entries"`
+	LastHash    string `json:"last_hash"`
+	Error       string `json:"error,omitempty"`
+	FirstBadSeq int64  `json:"first_bad_seq,omitempty"`
+}
+
+type Backup struct {
+	File      string `json:"file"`
+	Kind      string `json:"kind"`
+	Chain     string `json:"chain"`
+	Size      int64  `json:"size"`
+	CreatedAt string `json:"created_at"`
+}
+
+type BackupJob struct {
+	VM         string  `json:"vm"`
+	JobID      string  `json:"job_id"`
+	Kind       string  `json:"kind"`
+	Device     string  `json:"device"`
+	File       string  `json:"file"`
+	Status     string  `json:"status"`
+	Offset     int64   `json:"offset"`
+	Len        int64   `json:"len"`
+	Progress   float64 `json:"progress"`
+	Error      string  `json:"error,omitempty"`
+	StartedAt  string  `json:"started_at"`
+	FinishedAt string  `json:"finished_at,omitempty"`
+}
+
+type BackupPolicy struct {
+	Dir       string `json:"dir,omitempty"`
+	Interval  string `json:"interval,omitempty"`
+	FullEvery int    `json:"full_every,omitempty"`
+	Keep      int    `json:"keep,omitempty"`
+}
+
+type BackupRequest struct {
+	Kind string `json:"kind,omitempty"`
+}
+
+type BackupStatus struct {
+	Backups []Backup     `json:"backups"`
+	Policy  BackupPolicy `json:"policy"`
+	Active  *BackupJob   `json:"active,omitempty"`
+	Last    *BackupJob   `json:"last,omitempty"`
+}
+
+type CloneRequest struct {
+	Name         string `json:"name"`
+	Mode         string `json:"mode,omitempty"`
+	KeepBackup   bool   `json:"keep_backup,omitempty"`
+	KeepSegments bool   `json:"keep_segments,omitempty"`
+}
+
+type CloneResult struct {
+	Status  string    `json:"status"`
+	VM      *VMConfig `json:"vm"`
+	Job     *ImageJob `json:"job"`
+	Warning string    `json:"warning,omitempty"`
+}
+
+type DiskImage struct {
+	VM      string       `json:"vm"`
+	Path    string       `json:"path"`
+	Running bool         `json:"running"`
+	Chain   []ImageLayer `json:"chain,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+type ImageBitmap struct {
+	Name        string   `json:"name"`
+	Granularity int64    `json:"granularity"`
+	Flags       []string `json:"flags,omitempty"`
+}
+
+type ImageJob struct {
+	ID         string  `json:"id"`
+	Op         string  `json:"op"`
+	Path       string  `json:"path"`
+	Output     string  `json:"output,omitempty"`
+	Status     string  `json:"status"`
+	Progress   float64 `json:"progress"`
+	Result     string  `json:"result,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	StartedAt  string  `json:"started_at"`
+	FinishedAt string  `json:"finished_at,omitempty"`
+}
+
+type ImageJobRequest struct {
+	Op            string `json:"op"`
+	VM            string `json:"vm,omitempty"`
+	Path          string `json:"path"`
+	Format        string `json:"format,omitempty"`
+	Size          string `json:"size,omitempty"`
+	Backing       string `json:"backing,omitempty"`
+	BackingFormat string `json:"backing_format,omitempty"`
+	Output        string `json:"output,omitempty"`
+	Compress      bool   `json:"compress,omitempty"`
+	Repair        string `json:"repair,omitempty"`
+	Shrink        bool   `json:"shrink,omitempty"`
+}
+
+type ImageLayer struct {
+	Filename    string          `json:"filename"`
+	Format      string          `json:"format"`
+	VirtualSize int64           `json:"virtual_size"`
+	ActualSize  int64           `json:"actual_size"`
+	BackingFile string          `json:"backing_file,omitempty"`
+	Encrypted   bool            `json:"encrypted,omitempty"`
+	Encryption  string          `json:"encryption,omitempty"`
+	Snapshots   []ImageSnapshot `json:"snapshots,omitempty"`
+	Bitmaps     []ImageBitmap   `json:"bitmaps,omitempty"`
+}
+
+type ImageList struct {
+	Images []DiskImage `json:"images"`
+}
+
+type ImageSnapshot struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize int64  `json:"vm_state_size"`
+	Date        int64  `json:"date"`
+	VMClock     int64  `json:"vm_clock"`
+}
+
+type ImpairmentProfile struct {
+	Name         string  `json:"name"`
+	DelayMs      int     `json:"delay_ms,omitempty"`
+	JitterMs     int     `json:"jitter_ms,omitempty"`
+	LossPct      float64 `json:"loss_pct,omitempty"`
+	DuplicatePct float64 `json:"duplicate_pct,omitempty"`
+	CorruptPct   float64 `json:"corrupt_pct,omitempty"`
+	ReorderPct   float64 `json:"reorder_pct,omitempty"`
+	RateKbit     int     `json:"rate_kbit,omitempty"`
+}
+
+type LiveForward struct {
+	Netdev   string `json:"netdev"`
+	Protocol string `json:"protocol"`
+	Host     int    `json:"host"`
+	Guest    int    `json:"guest"`
+	Source   string `json:"source"`
+}
+
+type Network struct {
+	Type       string            `json:"type"`
+	ID         string            `json:"id,omitempty"`
+	MAC        string            `json:"mac"`
+	Addresses  []ResolvedAddress `json:"addresses,omitempty"`
+	Ifname     string            `json:"ifname,omitempty"`
+	Impairment string            `json:"impairment,omitempty"`
+}
+
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type Principal struct {
+	Name string   `json:"name"`
+	Kind string   `json:"kind"`
+	Role string   `json:"role"`
+	VMs  []string `json:"vms,omitempty"`
+}
+
+type QEMUInstance struct {
+	ID            string        `json:"id"`
+	PID           string        `json:"pid"`
+	PPID          string        `json:"ppid"`
+	User          string        `json:"user"`
+	CPUTime       string        `json:"cpu_time"`
+	StartTime     string        `json:"start_time"`
+	Memory        string        `json:"memory"`
+	CPUCount      string        `json:"cpu_count"`
+	DiskImage     string        `json:"disk_image"`
+	Disks         []string      `json:"disks,omitempty"`
+	Name          string        `json:"name"`
+	Machine       string        `json:"machine"`
+	Networks      []Network     `json:"networks"`
+	Type          string        `json:"type"`
+	Status        string        `json:"status"`
+	Uptime        string        `json:"uptime"`
+	CPUPercent    float64       `json:"cpu_percent"`
+	RSS           int64         `json:"rss"`
+	GuestHostname string        `json:"guest_hostname,omitempty"`
+	GuestOS       string        `json:"guest_os,omitempty"`
+	GuestIPs      []string      `json:"guest_ips,omitempty"`
+	Forwards      []LiveForward `json:"forwards,omitempty"`
+}
+
+type ResolvedAddress struct {
+	IP       string `json:"ip"`
+	Source   string `json:"source"`
+	LastSeen string `json:"last_seen"`
+}
+
+type Response struct {
+	Instances   []QEMUInstance `json:"instances"`
+	Count       int            `json:"count"`
+	LastUpdated string         `json:"last_updated"`
+	Conflicts   []string       `json:"conflicts,omitempty"`
+	LeakedTaps  []string       `json:"leaked_taps,omitempty"`
+}
+
+type Segment struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Address string `json:"address,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+type Settings struct {
+	Listen       []string          `json:"listen"`
+	PollInterval string            `json:"poll_interval"`
+	Config       string            `json:"config"`
+	StateDir     string            `json:"state_dir"`
+	LogDir       string            `json:"log_dir"`
+	RuntimeDir   string            `json:"runtime_dir"`
+	QEMUPath     []string          `json:"qemu_path"`
+	QEMUBinary   string            `json:"qemu_binary"`
+	File         string            `json:"file,omitempty"`
+	Sources      map[string]string `json:"sources"`
+}
+
+type ShellInfo struct {
+	Name       string           `json:"name"`
+	Running    bool             `json:"running"`
+	SSHCommand string           `json:"ssh_command,omitempty"`
+	SSHPort    int              `json:"ssh_port,omitempty"`
+	Interfaces []ShellInterface `json:"interfaces,omitempty"`
+	HTTPURL    string           `json:"http_url,omitempty"`
+	HTTPPort   int              `json:"http_port,omitempty"`
+}
+
+type ShellInterface struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	MAC         string            `json:"mac"`
+	Addresses   []ResolvedAddress `json:"addresses"`
+	SSHCommands []string          `json:"ssh_commands"`
+}
+
+type StatusResult struct {
+	Status      string `json:"status"`
+	Name        string `json:"name"`
+	ID          string `json:"id,omitempty"`
+	PID         string `json:"pid,omitempty"`
+	DiskRemoved bool   `json:"disk_removed,omitempty"`
+}
+
+type StopRequest struct {
+	Force bool `json:"force,omitempty"`
+}
+
+type VMConfig struct {
+	Name        string        `json:"name"`
+	Disk        string        `json:"disk"`
+	Memory      string        `json:"memory"`
+	CPUs        string        `json:"cpus"`
+	BIOS        string        `json:"bios"`
+	Snapshot    bool          `json:"snapshot"`
+	Networks    []VMNetwork   `json:"networks"`
+	SSHPort     *int          `json:"ssh_port"`
+	HTTPPort    *int          `json:"http_port"`
+	WorkingDir  string        `json:"working_dir"`
+	GuestAgent  bool          `json:"guest_agent,omitempty"`
+	Parent      string        `json:"parent,omitempty"`
+	Backup      *BackupPolicy `json:"backup,omitempty"`
+	SSHUser     string        `json:"ssh_user,omitempty"`
+	SSHPassword string        `json:"ssh_password,omitempty"`
+	SSHKey      string        `json:"ssh_key,omitempty"`
+}
+
+type VMNetwork struct {
+	Type         string        `json:"type"`
+	ID           string        `json:"id"`
+	MAC          string        `json:"mac,omitempty"`
+	PortForwards []PortForward `json:"port_forwards,omitempty"`
+	Segment      string        `json:"segment,omitempty"`
+	Ifname       string        `json:"ifname,omitempty"`
+	Bridge       string        `json:"bridge,omitempty"`
+	MTU          int           `json:"mtu,omitempty"`
+}
+
+type VMsConfig struct {
+	VMs                []VMConfig          `json:"vms"`
+	PortRange          *PortRange          `json:"port_range,omitempty"`
+	Segments           []Segment           `json:"segments,omitempty"`
+	ImpairmentProfiles []ImpairmentProfile `json:"impairment_profiles,omitempty"`
+}
+
+type WhoamiResult struct {
+	Principal   *Principal `json:"principal"`
+	AuthEnabled bool       `json:"auth_enabled"`
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// vmNamePattern is what a new VM may be called. The name ends up in file,
+// tap and QMP names, so it is kept to characters safe in all of them.
+var vmNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// cloneVM adds a new VM definition based on an existing one. Its disk is a
+// qcow2 overlay backed by the source disk ("overlay") or a full copy
+// ("copy"), created as an image job. MACs, tap names and host ports are
+// left to be derived or allocated for the new name.
+func cloneVM(source string, req CloneRequest) (*VMConfig, *ImageJob, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	name, mode := req.Name, req.Mode
+
+	src := findVMConfig(source)
+	if src == nil {
+		return nil, nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", source)
+	}
+	if !vmNamePattern.MatchString(name) || name == "." || name == ".." {
+		return nil, nil, newAPIError(http.StatusBadRequest, "invalid_name", "invalid VM name: %q", name)
+	}
+	if findVMConfig(name) != nil {
+		return nil, nil, newAPIError(http.StatusConflict, "vm_exists", "VM already exists: %s", name)
+	}
+	if src.Disk == "" {
+		return nil, nil, newAPIError(http.StatusConflict, "no_disk", "VM %s has no disk to clone", source)
+	}
+	// The source disk must be quiescent for a copy, and a base must never
+	// change under its overlays
+	if isRunning(source) {
+		return nil, nil, newAPIError(http.StatusConflict, "vm_running", "VM is running, stop it before cloning: %s", source)
+	}
+
+	srcPath := resolveVMPath(src, src.Disk)
+	disk := filepath.Join(filepath.Dir(src.Disk), name+".qcow2")
+
+	jobReq := ImageJobRequest{VM: source, Path: disk}
+	switch mode {
+	case "", "overlay":
+		mode = "overlay"
+		chain, err := imageInfo(srcPath, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		jobReq.Op = "create"
+		jobReq.Backing = filepath.Base(srcPath)
+		jobReq.BackingFormat = chain[0].Format
+	case "copy":
+		jobReq.Op = "convert"
+		jobReq.Path = src.Disk
+		jobReq.Output = disk
+	default:
+		return nil, nil, newAPIError(http.StatusBadRequest, "invalid_mode", "invalid clone mode: %s", mode)
+	}
+
+	job, err := startImageJob(jobReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vm := *src
+	vm.Name = name
+	vm.Disk = disk
+	vm.Parent = ""
+	if mode == "overlay" {
+		vm.Parent = source
+	}
+	if vm.sshPortDerived {
+		vm.SSHPort, vm.sshPortDerived = nil, false
+	}
+	if vm.httpPortDerived {
+		vm.HTTPPort, vm.httpPortDerived = nil, false
+	}
+	// Explicit service ports belong to the source; the clone derives its
+	// own from the reallocated forwards
+	vm.SSHPort, vm.HTTPPort = nil, nil
+	if !req.KeepBackup {
+		vm.Backup = nil
+	}
+	vm.Networks = []VMNetwork{}
+	for _, net := range src.Networks {
+		if net.Segment != "" && !req.KeepSegments {
+			continue
+		}
+		net.MAC, net.macDerived = "", false
+		net.Ifname = ""
+		net.PortForwards = append([]PortForward(nil), net.PortForwards...)
+		for j := range net.PortForwards {
+			net.PortForwards[j].Host = 0
+			net.PortForwards[j].Auto = true
+		}
+		vm.Networks = append(vm.Networks, net)
+	}
+
+	vmsConfig.VMs = append(vmsConfig.VMs, vm)
+	allocatePorts()
+	deriveServicePorts()
+	deriveMACs()
+	// Handlers encode the result after the lock is released
+	clone := *findVMConfig(name)
+	if err := saveVMsConfig(); err != nil {
+		return &clone, job, newAPIError(http.StatusInternalServerError, "not_persisted", "clone created but not persisted: %v", err)
+	}
+
+	log.Printf("Cloned %s to %s (%s)", source, name, mode)
+	publishEvent("vm_cloned", name, map[string]string{"source": source, "mode": mode})
+	return &clone, job, nil
+}
+
+// dependentVMs lists the VMs whose disk is an overlay on the given VM's
+// disk, either recorded as clones or found in their backing chain.
+func dependentVMs(name string) []string {
+	vm := findVMConfig(name)
+	if vm == nil || vm.Disk == "" {
+		return nil
+	}
+	base := filepath.Clean(resolveVMPath(vm, vm.Disk))
+
+	dependents := []string{}
+	for i := range vmsConfig.VMs {
+		other := &vmsConfig.VMs[i]
+		if other.Name == name || other.Disk == "" {
+			continue
+		}
+		if other.Parent == name {
+			dependents = append(dependents, other.Name)
+			continue
+		}
+		chain, err := imageInfo(resolveVMPath(other, other.Disk), isRunning(other.Name))
+		if err != nil {
+			continue
+		}
+		for _, layer := range chain[1:] {
+			if filepath.Clean(layer.Filename) == base {
+				dependents = append(dependents, other.Name)
+				break
+			}
+		}
+	}
+	return dependents
+}
+
+// checkBaseImage refuses to boot a base image read-write while overlays
+// depend on it; snapshot mode leaves the base untouched.
+func checkBaseImage(vm *VMConfig) error {
+	if vm.Snapshot {
+		return nil
+	}
+	if dependents := dependentVMs(vm.Name); len(dependents) > 0 {
+		return newAPIError(http.StatusConflict, "vm_has_dependents", "disk is the base of %v, start it in snapshot mode instead", dependents)
+	}
+	return nil
+}
+
+// deleteVM removes a VM definition, and its disk when removeDisk is set.
+// Base images with dependent overlays are kept.
+func deleteVM(name string, removeDisk bool) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	vm := findVMConfig(name)
+	if vm == nil {
+		return newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	if isRunning(name) {
+		return newAPIError(http.StatusConflict, "vm_running", "VM is running: %s", name)
+	}
+	if dependents := dependentVMs(name); len(dependents) > 0 {
+		return newAPIError(http.StatusConflict, "vm_has_dependents", "VM %s is the base of %v, delete those first", name, dependents).
+			with("dependents", dependents)
+	}
+	disk := resolveVMPath(vm, vm.Disk)
+	if vm.Disk != "" && imageJobBusy(disk) {
+		return newAPIError(http.StatusConflict, "image_busy", "an image job is running on the disk of %s", name)
+	}
+
+	vms := []VMConfig{}
+	for _, v := range vmsConfig.VMs {
+		if v.Name != name {
+			vms = append(vms, v)
+		}
+	}
+	vmsConfig.VMs = vms
+	if err := saveVMsConfig(); err != nil {
+		return newAPIError(http.StatusInternalServerError, "not_persisted", "VM deleted but not persisted: %v", err)
+	}
+
+	for key := range portAssignments {
+		if strings.HasPrefix(key, name+"/") {
+			delete(portAssignments, key)
+		}
+	}
+	if err := savePortAssignments(); err != nil {
+		log.Printf("Warning: failed to save %s: %v", portStatePath, err)
+	}
+
+	if removeDisk && disk != "" {
+		if err := os.Remove(disk); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("VM deleted but disk was not removed: %v", err)
+		}
+	}
+	log.Printf("Deleted VM %s", name)
+	publishEvent("vm_deleted", name, nil)
+	return nil
+}
+
+func handleClone(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CloneRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+		return
+	}
+
+	vm, job, err := cloneVM(name, req)
+	if err != nil && vm == nil {
+		legacyError(w, r, err)
+		return
+	}
+	resp := map[string]interface{}{"status": "cloned", "vm": vm, "job": job}
+	if err != nil {
+		resp["error"] = err.Error()
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleDeleteVM(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	removeDisk := r.URL.Query().Get("disk") != ""
+	if err := deleteVM(name, removeDisk); err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "deleted", "name": name, "disk_removed": removeDisk})
+}
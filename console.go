@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+
+	"qemu-monitor/client"
+)
+
+// runConsole opens the same shell as the web terminal: relayed by the
+// server's terminal websocket, or straight to the VM's SSH port when no
+// server is running. With --serial it attaches to the serial console.
+func runConsole(args []string) error {
+	fs, o := newCLIFlags("console")
+	serial := fs.Bool("serial", false, "attach to the serial console instead of a shell (Ctrl-] detaches)")
+	name, err := oneName(fs, parseArgs(fs, args))
+	if err != nil {
+		return err
+	}
+	b, err := o.backend()
+	if err != nil {
+		return err
+	}
+
+	fd := int(os.Stdin.Fd())
+	cols, rows := 80, 24
+	if term.IsTerminal(fd) {
+		if w, h, err := term.GetSize(fd); err == nil {
+			cols, rows = w, h
+		}
+	}
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	// Raw mode once connected, so keys like Ctrl-C go to the guest
+	raw := func() func() {
+		if !term.IsTerminal(fd) {
+			return func() {}
+		}
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return func() {}
+		}
+		return func() { term.Restore(fd, state) }
+	}
+
+	if *serial {
+		stream, err := b.Serial(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Serial console of %s, Ctrl-] to detach\r\n", name)
+		defer raw()()
+		return relaySerial(stream, readInput())
+	}
+
+	if remote, ok := b.(*remoteBackend); ok {
+		conn, err := remote.c.Terminal(context.Background(), name, cols, rows)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		defer raw()()
+		return relayTerminal(conn, fd, winch)
+	}
+
+	sshClient, err := dialGuestSSH(name)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return fmt.Errorf("ssh session failed: %v", err)
+	}
+	defer session.Close()
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err := session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		return fmt.Errorf("pty request failed: %v", err)
+	}
+	session.Stdin, session.Stdout, session.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := session.Shell(); err != nil {
+		return fmt.Errorf("shell failed: %v", err)
+	}
+	defer raw()()
+	go func() {
+		for range winch {
+			if w, h, err := term.GetSize(fd); err == nil {
+				session.WindowChange(h, w)
+			}
+		}
+	}()
+	if err := session.Wait(); err != nil {
+		if _, exited := err.(*ssh.ExitError); !exited {
+			return err
+		}
+	}
+	return nil
+}
+
+// relayTerminal copies stdin to a terminal websocket and its output to
+// stdout until the guest shell exits.
+func relayTerminal(conn *websocket.Conn, fd int, winch chan os.Signal) error {
+	send := func(msg client.TerminalMessage) error {
+		data, _ := json.Marshal(msg)
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 && send(client.TerminalMessage{Type: "input", Data: string(buf[:n])}) != nil {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for range winch {
+			if w, h, err := term.GetSize(fd); err == nil {
+				send(client.TerminalMessage{Type: "resize", Cols: w, Rows: h})
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) || err == io.EOF {
+				return nil
+			}
+			if _, closed := err.(*websocket.CloseError); closed {
+				return nil
+			}
+			return err
+		}
+		os.Stdout.Write(data)
+	}
+}
+
+// detachKey, Ctrl-], leaves a serial console as in telnet.
+const detachKey = 0x1d
+
+// readInput delivers what is typed on stdin, chunk by chunk, until stdin
+// closes.
+func readInput() <-chan []byte {
+	input := make(chan []byte)
+	go func() {
+		defer close(input)
+		for {
+			buf := make([]byte, 1024)
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				input <- buf[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return input
+}
+
+// relaySerial connects a serial console to the terminal until the console
+// closes or the detach key is typed. The console is closed on return.
+func relaySerial(stream io.ReadWriteCloser, input <-chan []byte) error {
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(os.Stdout, stream)
+		copied <- err
+	}()
+
+	for {
+		select {
+		case err := <-copied:
+			stream.Close()
+			return err
+		case data, ok := <-input:
+			i := bytes.IndexByte(data, detachKey)
+			if i >= 0 {
+				data = data[:i]
+			}
+			if len(data) > 0 {
+				if _, err := stream.Write(data); err != nil {
+					stream.Close()
+					return err
+				}
+			}
+			if !ok || i >= 0 {
+				// Wait for the output to stop before the caller draws
+				stream.Close()
+				<-copied
+				return nil
+			}
+		}
+	}
+}
+
+// wsStream reads and writes a terminal WebSocket as a byte stream.
+type wsStream struct {
+	conn    *websocket.Conn
+	pending []byte
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if _, closed := err.(*websocket.CloseError); closed {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		s.pending = data
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	data, _ := json.Marshal(client.TerminalMessage{Type: "input", Data: string(p)})
+	if err := s.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *wsStream) Close() error {
+	return s.conn.Close()
+}
+
+// localSerial is a serial console attached in-process.
+type localSerial struct {
+	sc      *serialConsole
+	output  chan []byte
+	pending []byte
+}
+
+func (s *localSerial) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		data, ok := <-s.output
+		if !ok {
+			return 0, io.EOF
+		}
+		s.pending = data
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *localSerial) Write(p []byte) (int, error) {
+	return s.sc.Write(p)
+}
+
+func (s *localSerial) Close() error {
+	s.sc.detach(s.output)
+	return nil
+}
+
+// runSSH replaces this process with ssh, using the command the shell info
+// gives for the VM. Arguments after "--" are passed to ssh.
+func runSSH(args []string) error {
+	fs, o := newCLIFlags("ssh")
+	args = parseArgs(fs, args)
+	if len(args) == 0 {
+		return fmt.Errorf("usage: qemu-monitor ssh NAME [-- SSH ARGS]")
+	}
+	b, err := o.backend()
+	if err != nil {
+		return err
+	}
+	info, err := b.Shell(args[0])
+	if err != nil {
+		return err
+	}
+
+	command := info.SSHCommand
+	if command == "" {
+		for _, iface := range info.Interfaces {
+			if len(iface.SSHCommands) > 0 {
+				command = iface.SSHCommands[0]
+				break
+			}
+		}
+	}
+	if command == "" {
+		return fmt.Errorf("VM %s has no ssh_port and no known guest address", args[0])
+	}
+	if !info.Running {
+		return fmt.Errorf("VM is not running: %s", args[0])
+	}
+
+	path, err := exec.LookPath("ssh")
+	if err != nil {
+		return err
+	}
+	argv := append(strings.Fields(command), args[1:]...)
+	return syscall.Exec(path, argv, os.Environ())
+}
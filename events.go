@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event is a single message on the /api/events stream.
+type Event struct {
+	Type string      `json:"type"`
+	VM   string      `json:"vm,omitempty"`
+	Time string      `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+var (
+	eventSubsMu sync.Mutex
+	eventSubs   = map[chan Event]struct{}{}
+)
+
+// publishEvent fans an event out to every connected subscriber. Slow
+// subscribers drop events rather than block the publisher.
+func publishEvent(eventType, vm string, data interface{}) {
+	ev := Event{
+		Type: eventType,
+		VM:   vm,
+		Time: time.Now().Format("2006-01-02 15:04:05"),
+		Data: data,
+	}
+
+	eventSubsMu.Lock()
+	defer eventSubsMu.Unlock()
+	for ch := range eventSubs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func subscribeEvents() chan Event {
+	ch := make(chan Event, 64)
+	eventSubsMu.Lock()
+	eventSubs[ch] = struct{}{}
+	eventSubsMu.Unlock()
+	return ch
+}
+
+func unsubscribeEvents(ch chan Event) {
+	eventSubsMu.Lock()
+	delete(eventSubs, ch)
+	eventSubsMu.Unlock()
+}
+
+// handleEvents streams events to the client as Server-Sent Events.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	p := principalFrom(r)
+	ch := subscribeEvents()
+	defer unsubscribeEvents(ch)
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case ev := <-ch:
+			if ev.VM != "" && !p.allowsVM(ev.VM) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			flusher.Flush()
+		}
+	}
+}
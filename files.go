@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// TransferProgress is published on the event stream while a file transfer
+// is in flight.
+type TransferProgress struct {
+	ID        string `json:"id"`
+	Direction string `json:"direction"` // "upload" or "download"
+	Path      string `json:"path"`
+	Bytes     int64  `json:"bytes"`
+	Total     int64  `json:"total"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+const progressInterval = 500 * time.Millisecond
+
+var transferSeq int64
+
+// transfer tracks the bytes moved by a file transfer and periodically
+// publishes a transfer_progress event.
+type transfer struct {
+	vm       string
+	progress TransferProgress
+	last     time.Time
+}
+
+func (t *transfer) add(n int) {
+	t.progress.Bytes += int64(n)
+	if time.Since(t.last) >= progressInterval {
+		t.last = time.Now()
+		publishEvent("transfer_progress", t.vm, t.progress)
+	}
+}
+
+func (t *transfer) finish(err error) {
+	t.progress.Done = true
+	if err != nil {
+		t.progress.Error = err.Error()
+	}
+	publishEvent("transfer_progress", t.vm, t.progress)
+}
+
+type progressReader struct {
+	r io.Reader
+	t *transfer
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.t.add(n)
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	t *transfer
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.t.add(n)
+	return n, err
+}
+
+func newTransferID() string {
+	return strconv.FormatInt(atomic.AddInt64(&transferSeq, 1), 10)
+}
+
+func openGuestSFTP(name string) (*ssh.Client, *sftp.Client, error) {
+	conn, err := dialGuestSSH(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("sftp session failed: %v", err)
+	}
+	return conn, client, nil
+}
+
+// uploadGuestFile streams r into remotePath on the guest.
+func uploadGuestFile(name, remotePath string, r io.Reader, size int64, id string) (int64, error) {
+	conn, client, err := openGuestSFTP(name)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	f, err := client.Create(remotePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create %s: %v", remotePath, err)
+	}
+	defer f.Close()
+
+	t := &transfer{
+		vm:       name,
+		progress: TransferProgress{ID: id, Direction: "upload", Path: remotePath, Total: size},
+	}
+	_, err = io.Copy(f, &progressReader{r: r, t: t})
+	if err != nil {
+		err = fmt.Errorf("upload of %s failed: %v", remotePath, err)
+	}
+	t.finish(err)
+	return t.progress.Bytes, err
+}
+
+func handleFiles(w http.ResponseWriter, r *http.Request, name string) {
+	remotePath := r.URL.Query().Get("path")
+	if remotePath == "" || !path.IsAbs(remotePath) {
+		legacyError(w, r, statusError(http.StatusBadRequest, "path must be an absolute guest path"))
+		return
+	}
+
+	// Clients may pass their own id to match progress events to a transfer
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		id = newTransferID()
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		n, err := uploadGuestFile(name, remotePath, r.Body, r.ContentLength, id)
+		if err != nil {
+			legacyError(w, r, err)
+			return
+		}
+		log.Printf("Uploaded %d bytes to %s:%s", n, name, remotePath)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "uploaded", "name": name, "path": remotePath, "bytes": n, "id": id})
+	case http.MethodGet:
+		downloadGuestFile(w, r, name, remotePath, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// downloadGuestFile streams remotePath from the guest into the response.
+func downloadGuestFile(w http.ResponseWriter, r *http.Request, name, remotePath, id string) {
+	conn, client, err := openGuestSFTP(name)
+	if err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	defer conn.Close()
+	defer client.Close()
+
+	f, err := client.Open(remotePath)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, os.ErrNotExist) {
+			status = http.StatusNotFound
+		}
+		legacyError(w, r, statusErrorf(status, "failed to open %s: %v", remotePath, err))
+		return
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	if st.IsDir() {
+		legacyError(w, r, statusError(http.StatusBadRequest, "path is a directory: "+remotePath))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(remotePath)))
+	w.Header().Set("Content-Length", strconv.FormatInt(st.Size(), 10))
+
+	t := &transfer{
+		vm:       name,
+		progress: TransferProgress{ID: id, Direction: "download", Path: remotePath, Total: st.Size()},
+	}
+	_, err = io.Copy(&progressWriter{w: w, t: t}, f)
+	t.finish(err)
+	if err != nil {
+		log.Printf("Download of %s:%s failed: %v", name, remotePath, err)
+		return
+	}
+	log.Printf("Downloaded %d bytes from %s:%s", t.progress.Bytes, name, remotePath)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// LiveForward is a host port forward active on a running VM's user-mode NIC.
+type LiveForward struct {
+	Netdev   string `json:"netdev"`
+	Protocol string `json:"protocol"`
+	Host     int    `json:"host"`
+	Guest    int    `json:"guest"`
+	Source   string `json:"source"` // "config" or "runtime"
+}
+
+var (
+	liveForwardsMu sync.Mutex
+	liveForwards   = map[string][]LiveForward{}
+)
+
+func forwardProtocol(protocol string) string {
+	if protocol == "" {
+		return "tcp"
+	}
+	return protocol
+}
+
+// configForwards returns the forwards QEMU was launched with for a VM.
+func configForwards(vm *VMConfig) []LiveForward {
+	forwards := []LiveForward{}
+	for _, net := range vm.Networks {
+		if net.Type != "user" {
+			continue
+		}
+		for _, pf := range net.PortForwards {
+			forwards = append(forwards, LiveForward{
+				Netdev:   net.ID,
+				Protocol: forwardProtocol(pf.Protocol),
+				Host:     pf.Host,
+				Guest:    pf.Guest,
+				Source:   "config",
+			})
+		}
+	}
+	return forwards
+}
+
+// trackLiveForwards seeds forwards for newly seen VMs, drops state for VMs
+// that are gone and copies the current set onto each instance.
+func trackLiveForwards(instances []QEMUInstance) {
+	liveForwardsMu.Lock()
+	defer liveForwardsMu.Unlock()
+
+	running := map[string]bool{}
+	for i := range instances {
+		name := instances[i].Name
+		running[name] = true
+		if _, ok := liveForwards[name]; !ok {
+			if vm := findVMConfig(name); vm != nil {
+				liveForwards[name] = configForwards(vm)
+			}
+		}
+		if forwards, ok := liveForwards[name]; ok {
+			instances[i].Forwards = append([]LiveForward(nil), forwards...)
+		}
+	}
+	for name := range liveForwards {
+		if !running[name] {
+			delete(liveForwards, name)
+		}
+	}
+}
+
+// liveHostPorts returns host ports held by runtime forwards, mapped to VM.
+func liveHostPorts() map[int]string {
+	liveForwardsMu.Lock()
+	defer liveForwardsMu.Unlock()
+
+	ports := map[int]string{}
+	for name, forwards := range liveForwards {
+		for _, f := range forwards {
+			ports[f.Host] = name
+		}
+	}
+	return ports
+}
+
+func findUserNetwork(vm *VMConfig, netdev string) (*VMNetwork, error) {
+	for i := range vm.Networks {
+		if vm.Networks[i].ID == netdev {
+			if vm.Networks[i].Type != "user" {
+				return nil, statusErrorf(http.StatusConflict, "netdev %s is %s, port forwards need a user-mode NIC", netdev, vm.Networks[i].Type)
+			}
+			return &vm.Networks[i], nil
+		}
+	}
+	return nil, statusErrorf(http.StatusNotFound, "netdev not found: %s", netdev)
+}
+
+// addForward adds a host forward to a running VM via hostfwd_add. A zero
+// host port is allocated from the port range.
+func addForward(name, netdev, protocol string, host, guest int, persist bool) (*LiveForward, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	vm := findVMConfig(name)
+	if vm == nil {
+		return nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	if !isRunning(name) {
+		return nil, newAPIError(http.StatusConflict, "not_running", "VM is not running: %s", name)
+	}
+	net, err := findUserNetwork(vm, netdev)
+	if err != nil {
+		return nil, err
+	}
+	protocol = forwardProtocol(protocol)
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, statusErrorf(http.StatusBadRequest, "invalid protocol: %s", protocol)
+	}
+	if guest <= 0 || guest > 65535 {
+		return nil, statusErrorf(http.StatusBadRequest, "invalid guest port: %d", guest)
+	}
+
+	// Ports auto-assigned to other VMs stay theirs, even while those are
+	// stopped
+	claimed := claimedHostPorts()
+	reserveAssignedPorts(claimed)
+	live := liveHostPorts()
+	auto := host == 0
+	if auto {
+		for port := range live {
+			claimed[port] = append(claimed[port], live[port])
+		}
+		host = findFreePort(portRangeConfig(), claimed, protocol)
+		if host == 0 {
+			return nil, statusError(http.StatusConflict, "no free host port available")
+		}
+	} else {
+		if owner, ok := live[host]; ok {
+			return nil, statusErrorf(http.StatusConflict, "host port %d is already forwarded for VM %s", host, owner)
+		}
+		for _, other := range claimed[host] {
+			if other != name {
+				return nil, statusErrorf(http.StatusConflict, "host port %d is claimed by VM %s", host, other)
+			}
+		}
+		if !hostPortFree(host, protocol) {
+			return nil, statusErrorf(http.StatusConflict, "host port %d is already in use", host)
+		}
+	}
+
+	c, err := dialQMP(name)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	output, err := c.hmp(fmt.Sprintf("hostfwd_add %s %s::%d-:%d", netdev, protocol, host, guest))
+	if err != nil {
+		return nil, err
+	}
+	if output != "" {
+		return nil, newAPIError(http.StatusInternalServerError, "qmp_failed", "hostfwd_add failed: %s", output)
+	}
+
+	forward := LiveForward{Netdev: netdev, Protocol: protocol, Host: host, Guest: guest, Source: "runtime"}
+	liveForwardsMu.Lock()
+	liveForwards[name] = append(liveForwards[name], forward)
+	liveForwardsMu.Unlock()
+	log.Printf("Added %s forward %d -> %s:%d on %s", protocol, host, name, guest, netdev)
+
+	if persist {
+		net.PortForwards = append(net.PortForwards, PortForward{Host: host, Guest: guest, Protocol: storedProtocol(protocol), Auto: auto})
+		if auto {
+			portAssignments[portAssignmentKey(name, netdev, guest)] = host
+			if err := savePortAssignments(); err != nil {
+				return &forward, newAPIError(http.StatusInternalServerError, "not_persisted", "forward added but its port assignment not persisted: %v", err)
+			}
+		}
+		deriveServicePorts()
+		if err := saveVMsConfig(); err != nil {
+			return &forward, newAPIError(http.StatusInternalServerError, "not_persisted", "forward added but not persisted: %v", err)
+		}
+	}
+	return &forward, nil
+}
+
+// removeForward removes a host forward from a running VM via hostfwd_remove.
+func removeForward(name, netdev, protocol string, host int, persist bool) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	vm := findVMConfig(name)
+	if vm == nil {
+		return newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	if !isRunning(name) {
+		return newAPIError(http.StatusConflict, "not_running", "VM is not running: %s", name)
+	}
+	net, err := findUserNetwork(vm, netdev)
+	if err != nil {
+		return err
+	}
+	protocol = forwardProtocol(protocol)
+	if protocol != "tcp" && protocol != "udp" {
+		return statusErrorf(http.StatusBadRequest, "invalid protocol: %s", protocol)
+	}
+
+	c, err := dialQMP(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	output, err := c.hmp(fmt.Sprintf("hostfwd_remove %s %s::%d", netdev, protocol, host))
+	if err != nil {
+		return err
+	}
+	if output != "" && output != fmt.Sprintf("host forwarding rule for %s::%d removed", protocol, host) {
+		return newAPIError(http.StatusInternalServerError, "qmp_failed", "hostfwd_remove failed: %s", output)
+	}
+
+	liveForwardsMu.Lock()
+	forwards := liveForwards[name][:0]
+	for _, f := range liveForwards[name] {
+		if !(f.Netdev == netdev && f.Protocol == protocol && f.Host == host) {
+			forwards = append(forwards, f)
+		}
+	}
+	liveForwards[name] = forwards
+	liveForwardsMu.Unlock()
+	log.Printf("Removed %s forward %d from %s on %s", protocol, host, name, netdev)
+
+	if persist {
+		kept := []PortForward{}
+		released := false
+		for _, p := range net.PortForwards {
+			if !(p.Host == host && forwardProtocol(p.Protocol) == protocol) {
+				kept = append(kept, p)
+				continue
+			}
+			key := portAssignmentKey(name, netdev, p.Guest)
+			if p.Auto && portAssignments[key] == host {
+				delete(portAssignments, key)
+				released = true
+			}
+		}
+		net.PortForwards = kept
+		if released {
+			if err := savePortAssignments(); err != nil {
+				return newAPIError(http.StatusInternalServerError, "not_persisted", "forward removed but its port assignment not persisted: %v", err)
+			}
+		}
+		deriveServicePorts()
+		if err := saveVMsConfig(); err != nil {
+			return newAPIError(http.StatusInternalServerError, "not_persisted", "forward removed but not persisted: %v", err)
+		}
+	}
+	return nil
+}
+
+// storedProtocol keeps tcp implicit so vms.json entries stay unchanged.
+func storedProtocol(protocol string) string {
+	if protocol == "tcp" {
+		return ""
+	}
+	return protocol
+}
+
+func handleForwards(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method == http.MethodGet {
+		liveForwardsMu.Lock()
+		forwards := append([]LiveForward{}, liveForwards[name]...)
+		liveForwardsMu.Unlock()
+		json.NewEncoder(w).Encode(forwards)
+		return
+	}
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Netdev   string          `json:"netdev"`
+		Protocol string          `json:"protocol"`
+		Host     json.RawMessage `json:"host"`
+		Guest    int             `json:"guest"`
+		Persist  bool            `json:"persist"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Netdev == "" {
+		legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+		return
+	}
+	if req.Persist && !principalFrom(r).allows(roleAdmin) {
+		legacyError(w, r, statusError(http.StatusForbidden, "persisting forwards edits the config and needs the admin role"))
+		return
+	}
+	host := 0
+	if string(req.Host) != `"auto"` && len(req.Host) > 0 {
+		if err := json.Unmarshal(req.Host, &host); err != nil {
+			legacyError(w, r, statusError(http.StatusBadRequest, "host must be a port number or \"auto\""))
+			return
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		forward, err := addForward(name, req.Netdev, req.Protocol, host, req.Guest, req.Persist)
+		if err != nil {
+			legacyError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "added", "name": name, "forward": forward})
+		return
+	}
+
+	if host == 0 {
+		legacyError(w, r, statusError(http.StatusBadRequest, "host port is required"))
+		return
+	}
+	if err := removeForward(name, req.Netdev, req.Protocol, host, req.Persist); err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "removed", "name": name, "host": host})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sshDialTimeout = 10 * time.Second
+
+// dialGuestSSH opens an SSH connection to a running VM through its forwarded
+// SSH port on localhost.
+func dialGuestSSH(name string) (*ssh.Client, error) {
+	vmConfig, ok := lookupVM(name)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	vm := &vmConfig
+	if vm.SSHPort == nil {
+		return nil, statusErrorf(http.StatusConflict, "no ssh_port configured for VM: %s", name)
+	}
+	if !isRunning(name) {
+		return nil, newAPIError(http.StatusConflict, "not_running", "VM is not running: %s", name)
+	}
+
+	user := vm.SSHUser
+	if user == "" {
+		user = "root"
+	}
+
+	var auth []ssh.AuthMethod
+	if vm.SSHKey != "" {
+		keyPath := vm.SSHKey
+		if !filepath.IsAbs(keyPath) && vm.WorkingDir != "" {
+			keyPath = filepath.Join(vm.WorkingDir, keyPath)
+		}
+		key, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ssh_key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh_key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	password := vm.SSHPassword
+	auth = append(auth,
+		ssh.Password(password),
+		ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}),
+	)
+
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: auth,
+		// Guests are reached over a localhost port forward and their host
+		// keys change every time an image is rebuilt.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         sshDialTimeout,
+	}
+
+	addr := net.JoinHostPort("localhost", strconv.Itoa(*vm.SSHPort))
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("ssh to %s failed: %v", name, err)
+	}
+	return client, nil
+}
@@ -0,0 +1,780 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The privileged helper is this binary run as root with `qemu-monitor
+// helper <user>`. It listens on a unix socket only <user> can open and
+// does a fixed set of things, each checked against its own read of
+// vms.json: launch a configured VM, signal a QEMU process of a configured
+// VM, create or delete the tap devices of a configured VM, and run tc or
+// tcpdump on one of the user's taps.
+//
+// vms.json is written by the unprivileged monitor, so the helper trusts
+// none of it: it only launches VMs that need privilege, with a command line
+// checked by checkQEMUArgs; it hands QEMU the disk chain as files it opened
+// and checked itself; it only touches host interfaces that are the user's
+// taps, and bridges root allowed in helperBridgeConf.
+
+const defaultHelperSocket = "/var/run/qemu-monitor-helper.sock"
+
+var (
+	helperMode bool   // set in the helper process itself
+	tapOwner   string // user taps are created for, so QEMU can open them unprivileged
+	helperUID  int    // uid of that user, who must own the files a launch opens
+	helperGID  int
+
+	// helperMu serialises requests, which each reload vms.json into the
+	// process's config
+	helperMu sync.Mutex
+
+	// Taps the helper handed out, which it may delete even without the
+	// monitor's prefix. Guarded by tapsMu.
+	helperTaps = map[string]bool{}
+)
+
+// firmwareDirs hold firmware root may load for any VM, as installed by
+// QEMU packages on Linux and by Homebrew.
+var firmwareDirs = []string{
+	"/usr/share/qemu",
+	"/usr/share/qemu-efi-aarch64",
+	"/usr/share/AAVMF",
+	"/usr/share/edk2",
+	"/usr/local/share/qemu",
+	"/opt/homebrew/share/qemu",
+}
+
+// helperBridgeConf lists the bridges the helper may attach taps to, one
+// "allow <bridge>" per line, as for qemu-bridge-helper. It must belong to
+// root; the helper never creates bridges.
+var helperBridgeConf = "/etc/qemu/bridge.conf"
+
+// helperRequest is one request to the helper. A launch carries the
+// listening sockets for QEMU's QMP, serial and guest agent chardevs, in
+// that order, as file descriptors alongside the request.
+type helperRequest struct {
+	Op      string   `json:"op"` // "launch", "signal", "create-taps", "delete-taps", "tc" or "capture"
+	VM      string   `json:"vm,omitempty"`
+	ID      string   `json:"id,omitempty"`
+	Signal  string   `json:"signal,omitempty"`
+	Ifnames []string `json:"ifnames,omitempty"`
+	Args    []string `json:"args,omitempty"` // tc arguments
+}
+
+type helperResponse struct {
+	PID   int      `json:"pid,omitempty"`
+	Taps  []string `json:"taps,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+func helperSocketPath() string {
+	if path := os.Getenv("QEMU_MONITOR_HELPER_SOCKET"); path != "" {
+		return path
+	}
+	return defaultHelperSocket
+}
+
+// helperAvailable reports whether a helper socket is present. Without one
+// the monitor falls back to sudo.
+func helperAvailable() bool {
+	if os.Geteuid() == 0 {
+		return false
+	}
+	info, err := os.Stat(helperSocketPath())
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
+
+// callHelper sends one request to the helper, with files to pass along,
+// and waits for its answer.
+func callHelper(req helperRequest, files ...*os.File) (*helperResponse, error) {
+	conn, resp, received, err := openHelper(req, files...)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	closeFiles(received)
+	return resp, nil
+}
+
+// openHelper is callHelper for requests that go on after the answer: the
+// connection is left open, and files the helper sent back are returned.
+func openHelper(req helperRequest, files ...*os.File) (*net.UnixConn, *helperResponse, []*os.File, error) {
+	c, err := net.DialTimeout("unix", helperSocketPath(), 2*time.Second)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("privileged helper unavailable: %v", err)
+	}
+	conn := c.(*net.UnixConn)
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	if err := writeHelperMsg(conn, req, files); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	var resp helperResponse
+	received, err := readHelperMsg(conn, &resp)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("privileged helper: %v", err)
+	}
+	if resp.Error != "" {
+		conn.Close()
+		closeFiles(received)
+		return nil, nil, nil, fmt.Errorf("privileged helper: %s", resp.Error)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, &resp, received, nil
+}
+
+// writeHelperMsg sends v as one line of JSON, with files attached.
+func writeHelperMsg(conn *net.UnixConn, v interface{}, files []*os.File) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if len(files) > 0 {
+		fds := make([]int, len(files))
+		for i, f := range files {
+			fds[i] = int(f.Fd())
+		}
+		oob = syscall.UnixRights(fds...)
+	}
+	_, _, err = conn.WriteMsgUnix(append(data, '\n'), oob, nil)
+	return err
+}
+
+// readHelperMsg reads one line of JSON into v and returns the files that
+// came with it.
+func readHelperMsg(conn *net.UnixConn, v interface{}) ([]*os.File, error) {
+	var data []byte
+	var files []*os.File
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(16*4))
+	for !bytes.Contains(data, []byte{'\n'}) {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if oobn > 0 {
+			msgs, _ := syscall.ParseSocketControlMessage(oob[:oobn])
+			for _, msg := range msgs {
+				fds, _ := syscall.ParseUnixRights(&msg)
+				for _, fd := range fds {
+					syscall.CloseOnExec(fd)
+					files = append(files, os.NewFile(uintptr(fd), "helper-fd"))
+				}
+			}
+		}
+		data = append(data, buf[:n]...)
+		if err != nil {
+			if err == io.EOF && len(data) > 0 {
+				break
+			}
+			closeFiles(files)
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(data), v); err != nil {
+		closeFiles(files)
+		return nil, err
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// vmNeedsPrivilege reports whether QEMU must run as root for a VM. On Linux
+// taps are created for the monitor's user beforehand, so only vmnet
+// networking needs it; elsewhere launches stay privileged as before.
+func vmNeedsPrivilege(vm *VMConfig) bool {
+	if runtime.GOOS != "linux" {
+		return true
+	}
+	for _, net := range vm.Networks {
+		if strings.HasPrefix(net.Type, "vmnet") {
+			return true
+		}
+	}
+	return false
+}
+
+// runHelper implements `qemu-monitor helper <user>`.
+func runHelper(args []string) error {
+	fs := flag.NewFlagSet("helper", flag.ExitOnError)
+	sf := addSettingsFlags(fs, true)
+	args = parseArgs(fs, args)
+	if len(args) != 1 {
+		return fmt.Errorf("usage: qemu-monitor helper <user>")
+	}
+	if err := sf.apply(); err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("the helper must run as root")
+	}
+	u, err := user.Lookup(args[0])
+	if err != nil {
+		return err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	helperMode = true
+	tapOwner = u.Username
+	helperUID, helperGID = uid, gid
+	if err := loadVMsConfig(); err != nil {
+		return fmt.Errorf("failed to load %s: %v", configPath, err)
+	}
+
+	path := helperSocketPath()
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	if err := os.Chown(path, uid, gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	log.Printf("Privileged helper listening on %s for user %s", path, u.Username)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveHelperConn(conn)
+	}
+}
+
+func serveHelperConn(c net.Conn) {
+	conn := c.(*net.UnixConn)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	var req helperRequest
+	files, err := readHelperMsg(conn, &req)
+	if err != nil {
+		writeHelperMsg(conn, helperResponse{Error: "invalid request"}, nil)
+		return
+	}
+	defer closeFiles(files)
+
+	if req.Op == "capture" {
+		serveHelperCapture(conn, req)
+		return
+	}
+	resp, err := handleHelperRequest(req, files)
+	if err != nil {
+		log.Printf("Helper refused %s %s%s: %v", req.Op, req.VM, req.ID, err)
+		resp = &helperResponse{Error: err.Error()}
+	}
+	writeHelperMsg(conn, resp, nil)
+}
+
+// reloadHelperConfig reads vms.json afresh for a request, so nothing the
+// file no longer says carries over from an earlier one. Called with
+// helperMu held.
+func reloadHelperConfig() error {
+	vmsConfig = VMsConfig{}
+	return loadVMsConfig()
+}
+
+func handleHelperRequest(req helperRequest, files []*os.File) (*helperResponse, error) {
+	helperMu.Lock()
+	defer helperMu.Unlock()
+
+	// Always act on the config as it is on disk, never on the caller's view
+	if err := reloadHelperConfig(); err != nil {
+		return nil, err
+	}
+
+	switch req.Op {
+	case "launch":
+		vm := findVMConfig(req.VM)
+		if vm == nil {
+			return nil, fmt.Errorf("VM configuration not found: %s", req.VM)
+		}
+		instances, err := getQEMUInstances()
+		if err != nil {
+			return nil, err
+		}
+		for _, inst := range instances {
+			if inst.Name == vm.Name {
+				return nil, fmt.Errorf("VM already running with PID %s", inst.PID)
+			}
+		}
+		launch, disk, err := helperLaunchConfig(vm)
+		if err != nil {
+			return nil, err
+		}
+		defer closeFiles(disk)
+		if err := helperSocketFDs(launch, files); err != nil {
+			return nil, err
+		}
+		cmd := buildQEMUCommand(launch)
+		// QEMU gets the sockets first, then the disk layers, from fd 3 on
+		cmd.ExtraFiles = append(append([]*os.File{}, files...), disk...)
+		for i := range disk {
+			cmd.Args = append(cmd.Args, "-add-fd", fmt.Sprintf("fd=%d,set=%d", 3+len(files)+i, launch.diskFDSets[i]))
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		go cmd.Wait()
+		log.Printf("Launched %s with PID %d", vm.Name, cmd.Process.Pid)
+		return &helperResponse{PID: cmd.Process.Pid}, nil
+
+	case "signal":
+		sig := map[string]syscall.Signal{"TERM": syscall.SIGTERM, "KILL": syscall.SIGKILL}[req.Signal]
+		if sig == 0 {
+			return nil, fmt.Errorf("signal not allowed: %s", req.Signal)
+		}
+		instances, err := getQEMUInstances()
+		if err != nil {
+			return nil, err
+		}
+		for i := range instances {
+			inst := &instances[i]
+			if inst.ID != req.ID {
+				continue
+			}
+			if !ownedInstance(inst) || !instanceAlive(inst) {
+				break
+			}
+			pid, _ := strconv.Atoi(inst.PID)
+			if err := syscall.Kill(pid, sig); err != nil {
+				return nil, err
+			}
+			log.Printf("Sent SIG%s to %s (PID %d)", req.Signal, inst.Name, pid)
+			return &helperResponse{}, nil
+		}
+		return nil, fmt.Errorf("no owned QEMU instance with ID %s", req.ID)
+
+	case "create-taps":
+		vm := findVMConfig(req.VM)
+		if vm == nil {
+			return nil, fmt.Errorf("VM configuration not found: %s", req.VM)
+		}
+		if err := checkQEMUArgs(vm); err != nil {
+			return nil, err
+		}
+		if err := helperCheckTaps(vm); err != nil {
+			return nil, err
+		}
+		if err := provisionTaps(vm); err != nil {
+			return nil, err
+		}
+		tapsMu.Lock()
+		taps := provisionedTaps[vm.Name]
+		delete(provisionedTaps, vm.Name)
+		delete(tapsProvisionedAt, vm.Name)
+		for _, ifname := range taps {
+			helperTaps[ifname] = true
+		}
+		tapsMu.Unlock()
+		return &helperResponse{Taps: taps}, nil
+
+	case "delete-taps":
+		instances, err := getQEMUInstances()
+		if err != nil {
+			return nil, err
+		}
+		running := map[string]bool{}
+		for _, inst := range instances {
+			running[inst.Name] = true
+		}
+		owner := map[string]string{}
+		for _, vm := range vmsConfig.VMs {
+			for _, net := range vm.Networks {
+				if isTapNetwork(net) {
+					owner[nicIfname(vm.Name, net)] = vm.Name
+				}
+			}
+		}
+		tapsMu.Lock()
+		for _, ifname := range req.Ifnames {
+			if !helperTaps[ifname] && !tapOwnedBy(ifname, helperUID) {
+				tapsMu.Unlock()
+				return nil, fmt.Errorf("not a tap of %s: %s", tapOwner, ifname)
+			}
+			if vm, known := owner[ifname]; known && running[vm] {
+				tapsMu.Unlock()
+				return nil, fmt.Errorf("tap %s is in use by %s", ifname, vm)
+			}
+		}
+		for _, ifname := range req.Ifnames {
+			delete(helperTaps, ifname)
+		}
+		tapsMu.Unlock()
+		cleanupTaps(req.Ifnames)
+		return &helperResponse{}, nil
+
+	case "tc":
+		// Only qdiscs, and only on the user's taps
+		args := req.Args
+		if len(args) < 4 || args[0] != "qdisc" || (args[1] != "replace" && args[1] != "del") || args[2] != "dev" {
+			return nil, fmt.Errorf("tc command not allowed: %s", strings.Join(args, " "))
+		}
+		if !helperTapAllowed(args[3]) {
+			return nil, fmt.Errorf("not a tap of %s: %s", tapOwner, args[3])
+		}
+		if err := runTC(args...); err != nil {
+			return nil, err
+		}
+		return &helperResponse{}, nil
+	}
+	return nil, fmt.Errorf("unknown operation: %s", req.Op)
+}
+
+// helperTapAllowed reports whether ifname is a tap the helper created or
+// one that belongs to the helper's user.
+func helperTapAllowed(ifname string) bool {
+	tapsMu.Lock()
+	created := helperTaps[ifname]
+	tapsMu.Unlock()
+	return created || tapOwnedBy(ifname, helperUID)
+}
+
+// serveHelperCapture runs tcpdump on one of the user's taps and hands the
+// read end of its output back to the caller. The capture lasts until the
+// caller closes the connection.
+func serveHelperCapture(conn *net.UnixConn, req helperRequest) {
+	fail := func(err error) {
+		log.Printf("Helper refused capture %v: %v", req.Ifnames, err)
+		writeHelperMsg(conn, helperResponse{Error: err.Error()}, nil)
+	}
+	if len(req.Ifnames) != 1 || !helperTapAllowed(req.Ifnames[0]) {
+		fail(fmt.Errorf("not a tap of %s: %v", tapOwner, req.Ifnames))
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer r.Close()
+	cmd := exec.Command("tcpdump", "-i", req.Ifnames[0], "-U", "-w", "-")
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		fail(fmt.Errorf("failed to start tcpdump: %v", err))
+		return
+	}
+	log.Printf("Capturing on %s", req.Ifnames[0])
+	writeHelperMsg(conn, helperResponse{PID: cmd.Process.Pid}, []*os.File{r})
+	r.Close()
+
+	conn.SetDeadline(time.Time{})
+	io.Copy(ioutil.Discard, conn)
+	cmd.Process.Signal(syscall.SIGTERM)
+	cmd.Wait()
+	log.Printf("Stopped capture on %s", req.Ifnames[0])
+}
+
+// helperCheckTaps refuses, before anything runs as root, a VM whose tap
+// NICs name a host interface that is not one of the user's taps, or a
+// bridge that is missing or not allowed in helperBridgeConf.
+func helperCheckTaps(vm *VMConfig) error {
+	var bridges map[string]bool
+	for _, net := range vm.Networks {
+		if !isTapNetwork(net) {
+			continue
+		}
+		ifname := nicIfname(vm.Name, net)
+		if linkExists(ifname) && !helperTapAllowed(ifname) {
+			return fmt.Errorf("netdev %s: %s is not a tap of %s", net.ID, ifname, tapOwner)
+		}
+		if net.Bridge == "" {
+			continue
+		}
+		if bridges == nil {
+			var err error
+			if bridges, err = helperAllowedBridges(); err != nil {
+				return err
+			}
+		}
+		if !bridges[net.Bridge] && !bridges["all"] {
+			return fmt.Errorf("netdev %s: bridge %s is not allowed in %s", net.ID, net.Bridge, helperBridgeConf)
+		}
+		if !linkExists(net.Bridge) {
+			return fmt.Errorf("netdev %s: bridge %s does not exist", net.ID, net.Bridge)
+		}
+	}
+	return nil
+}
+
+// helperAllowedBridges reads the bridges root allows in helperBridgeConf.
+// A file root does not control allows nothing.
+func helperAllowedBridges() (map[string]bool, error) {
+	f, err := os.Open(helperBridgeConf)
+	if err != nil {
+		return nil, fmt.Errorf("no bridges allowed: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || st.Uid != 0 || info.Mode()&0022 != 0 {
+		return nil, fmt.Errorf("%s must belong to root and be writable only by root", helperBridgeConf)
+	}
+	allowed := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "allow" {
+			allowed[fields[1]] = true
+		}
+	}
+	return allowed, scanner.Err()
+}
+
+// helperSocketFDs numbers the chardev sockets a launch request carried as
+// QEMU will see them.
+func helperSocketFDs(vm *VMConfig, files []*os.File) error {
+	names := []string{"qmp", "serial"}
+	if vm.GuestAgent {
+		names = append(names, "qga")
+	}
+	if len(files) != len(names) {
+		return fmt.Errorf("launch needs %d sockets, got %d", len(names), len(files))
+	}
+	vm.socketFDs = map[string]int{}
+	for i, f := range files {
+		typ, err := syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_TYPE)
+		if err != nil || typ != syscall.SOCK_STREAM {
+			return fmt.Errorf("%s: not a stream socket", names[i])
+		}
+		vm.socketFDs[names[i]] = 3 + i
+	}
+	return nil
+}
+
+// helperLaunchConfig checks a VM before the helper launches it as root and
+// returns it with its firmware as a checked absolute path, so a symlink
+// swapped afterwards is not followed, and its disk as an explicit chain
+// over files the helper opened and checked. The caller passes the files
+// to QEMU and closes them.
+func helperLaunchConfig(vm *VMConfig) (*VMConfig, []*os.File, error) {
+	if !vmNeedsPrivilege(vm) {
+		return nil, nil, fmt.Errorf("VM %s does not need privilege, the monitor launches it itself", vm.Name)
+	}
+	if err := checkQEMUArgs(vm); err != nil {
+		return nil, nil, err
+	}
+	launch := *vm
+	var err error
+	if launch.BIOS, err = helperFilePath(resolveVMPath(vm, vm.BIOS), true); err != nil {
+		return nil, nil, err
+	}
+	disk, err := helperFilePath(resolveVMPath(vm, vm.Disk), false)
+	if err != nil {
+		return nil, nil, err
+	}
+	launch.Disk = disk
+	files, err := helperDiskChain(&launch, disk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &launch, files, nil
+}
+
+// helperImageChain lists a disk's backing chain with qemu-img run as the
+// helper's user, so root never follows the names in its headers.
+func helperImageChain(path string) ([]ImageLayer, error) {
+	cmd := exec.Command(qemuCommand("qemu-img"), "info", "--output=json", "--backing-chain", path)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(helperUID), Gid: uint32(helperGID)}}
+	return runImageInfo(cmd)
+}
+
+// helperDiskChain opens every layer of the disk as root, checks the open
+// files rather than their paths, and sets the VM's -drive to a JSON
+// description that names each layer's backing explicitly and ends in
+// null. QEMU reaches the layers through fd sets, so a backing name written
+// into a header, or a path swapped, after the check changes nothing.
+func helperDiskChain(vm *VMConfig, disk string) ([]*os.File, error) {
+	chain, err := helperImageChain(disk)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	fail := func(err error) ([]*os.File, error) {
+		closeFiles(files)
+		return nil, err
+	}
+
+	// The top layer is opened for writing too; QEMU picks the fd whose
+	// mode matches each open
+	var root, node map[string]interface{}
+	for i, layer := range chain {
+		if layer.Format != "qcow2" && layer.Format != "raw" {
+			return fail(fmt.Errorf("%s: unsupported image format %q", layer.Filename, layer.Format))
+		}
+		modes := []int{os.O_RDONLY}
+		if i == 0 {
+			modes = append(modes, os.O_RDWR)
+		}
+		for _, mode := range modes {
+			f, err := helperOpenImage(layer.Filename, mode)
+			if err != nil {
+				return fail(err)
+			}
+			files = append(files, f)
+			vm.diskFDSets = append(vm.diskFDSets, i+1)
+		}
+		layerNode := map[string]interface{}{
+			"driver": layer.Format,
+			"file":   map[string]interface{}{"driver": "file", "filename": fmt.Sprintf("/dev/fdset/%d", i+1)},
+		}
+		if layer.Format == "qcow2" {
+			layerNode["backing"] = nil
+		}
+		if node == nil {
+			root = layerNode
+		} else {
+			node["backing"] = layerNode
+		}
+		node = layerNode
+	}
+	data, err := json.Marshal(root)
+	if err != nil {
+		return fail(err)
+	}
+	// QEMU option values escape commas by doubling them
+	vm.diskDrive = "file=json:" + strings.ReplaceAll(string(data), ",", ",,") + ",if=virtio"
+	return files, nil
+}
+
+// helperOpenImage opens a disk layer as root and accepts it only if the
+// open file, not whatever the path names by now, is a regular file owned
+// by the helper's user.
+func helperOpenImage(path string, mode int) (*os.File, error) {
+	f, err := os.OpenFile(path, mode|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || !info.Mode().IsRegular() || int(st.Uid) != helperUID {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a file owned by %s", path, tapOwner)
+	}
+	// Non-blocking only so a FIFO could not hang the open
+	if err := syscall.SetNonblock(int(f.Fd()), false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// helperFilePath resolves a file root is asked to open. It must be a
+// regular file owned by the helper's user, or with firmware, a root-owned
+// file in a firmware directory that only root can change.
+func helperFilePath(path string, firmware bool) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("not an absolute path: %s", path)
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return "", err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.Mode().IsRegular() || !ok || strings.Contains(real, ",") {
+		return "", fmt.Errorf("not a regular file: %s", path)
+	}
+	if int(st.Uid) == helperUID {
+		return real, nil
+	}
+	if firmware && st.Uid == 0 && info.Mode()&0022 == 0 {
+		for _, dir := range firmwareDirs {
+			if strings.HasPrefix(real, dir+string(filepath.Separator)) {
+				return real, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s is not owned by %s", path, tapOwner)
+}
+
+// vmSocketPaths are the chardev sockets of a VM, in the order the helper
+// takes them.
+func vmSocketPaths(vm *VMConfig) []string {
+	paths := []string{qmpSocketPath(vm.Name), serialSocketPath(vm.Name)}
+	if vm.GuestAgent {
+		paths = append(paths, qgaSocketPath(vm.Name))
+	}
+	return paths
+}
+
+// listenVMSockets creates a VM's chardev sockets as the monitor's user and
+// returns their listening fds.
+func listenVMSockets(vm *VMConfig) ([]*os.File, error) {
+	var files []*os.File
+	for _, path := range vmSocketPaths(vm) {
+		os.Remove(path)
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		l.SetUnlinkOnClose(false)
+		f, err := l.File()
+		l.Close()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// chownVMSockets hands the sockets a QEMU started through sudo creates
+// back to the monitor's user, who could not connect to them otherwise.
+func chownVMSockets(vm *VMConfig) {
+	paths := vmSocketPaths(vm)
+	deadline := time.Now().Add(10 * time.Second)
+	for _, path := range paths {
+		for time.Now().Before(deadline) {
+			if _, err := os.Stat(path); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	if output, err := privilegedCommand("chown", append([]string{owner}, paths...)...).CombinedOutput(); err != nil {
+		log.Printf("Failed to hand over the sockets of %s: %v - %s", vm.Name, err, strings.TrimSpace(string(output)))
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCheckQEMUArgs(t *testing.T) {
+	saved := vmsConfig
+	defer func() { vmsConfig = saved }()
+	vmsConfig = VMsConfig{Segments: []Segment{
+		{Name: "lan", Kind: "udp-mcast", Address: "239.0.0.1"},
+		{Name: "bad", Kind: "stream", Address: "127.0.0.1,id=x"},
+	}}
+
+	base := func() VMConfig {
+		return VMConfig{
+			Name:   "vm1",
+			Disk:   "/images/vm1.qcow2",
+			Memory: "4G",
+			CPUs:   "2",
+			BIOS:   "/usr/share/qemu/OVMF.fd",
+			Networks: []VMNetwork{
+				{Type: "user", ID: "net0", MAC: "52:54:00:12:34:56", PortForwards: []PortForward{{Host: 2222, Guest: 22}}},
+				{Type: "tap", ID: "net1", Ifname: "qmtap0", Bridge: "br0"},
+				{ID: "net2", Segment: "lan"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		edit   func(vm *VMConfig)
+		errMsg string // empty when the VM is accepted
+	}{
+		{"valid", func(vm *VMConfig) {}, ""},
+		{"memory in MB", func(vm *VMConfig) { vm.Memory = "4096" }, ""},
+		{"udp forward", func(vm *VMConfig) { vm.Networks[0].PortForwards[0].Protocol = "udp" }, ""},
+		{"empty name", func(vm *VMConfig) { vm.Name = "" }, "invalid VM name"},
+		{"comma in name", func(vm *VMConfig) { vm.Name = "vm1,debug" }, "invalid VM name"},
+		{"slash in name", func(vm *VMConfig) { vm.Name = "../vm1" }, "invalid VM name"},
+		{"option in cpus", func(vm *VMConfig) { vm.CPUs = "2,maxcpus=64" }, "invalid cpus"},
+		{"empty cpus", func(vm *VMConfig) { vm.CPUs = "" }, "invalid cpus"},
+		{"option in memory", func(vm *VMConfig) { vm.Memory = "4G -snapshot" }, "invalid memory"},
+		{"comma in disk", func(vm *VMConfig) { vm.Disk = "/images/vm1.qcow2,readonly=on" }, "disk path must not contain a comma"},
+		{"comma in bios", func(vm *VMConfig) { vm.BIOS = "/tmp/x,y.fd" }, "bios path must not contain a comma"},
+		{"invalid netdev id", func(vm *VMConfig) { vm.Networks[0].ID = "0net" }, "invalid netdev id"},
+		{"option in netdev id", func(vm *VMConfig) { vm.Networks[0].ID = "net0,hostfwd=tcp::1-:1" }, "invalid netdev id"},
+		{"invalid MAC", func(vm *VMConfig) { vm.Networks[0].MAC = "52:54:00:12:34:56,x" }, "invalid MAC"},
+		{"unsupported type", func(vm *VMConfig) { vm.Networks[0].Type = "socket" }, "unsupported type"},
+		{"comma in ifname", func(vm *VMConfig) { vm.Networks[1].Ifname = "qmtap0,script=/tmp/x" }, "invalid ifname or bridge"},
+		{"slash in bridge", func(vm *VMConfig) { vm.Networks[1].Bridge = "../br0" }, "invalid ifname or bridge"},
+		{"unsupported protocol", func(vm *VMConfig) { vm.Networks[0].PortForwards[0].Protocol = "sctp" }, "unsupported protocol"},
+		{"comma in segment address", func(vm *VMConfig) { vm.Networks[2].Segment = "bad" }, "must not contain a comma"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm := base()
+			tt.edit(&vm)
+			err := checkQEMUArgs(&vm)
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Fatalf("checkQEMUArgs() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("checkQEMUArgs() = %v, want error containing %q", err, tt.errMsg)
+			}
+		})
+	}
+}
+
+// fakeQEMUImg puts a qemu-img on qemuPath that prints <image>.json, so a
+// test can give each image the backing chain it needs.
+func fakeQEMUImg(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor a; do last=$a; done\ncat \"$last.json\" || exit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	saved := qemuPath
+	qemuPath = []string{dir}
+	t.Cleanup(func() { qemuPath = saved })
+}
+
+func TestHelperLaunchConfig(t *testing.T) {
+	if os.Geteuid() != 0 || runtime.GOOS != "linux" {
+		t.Skip("the helper runs as root on Linux")
+	}
+	fakeQEMUImg(t)
+	savedUID, savedGID := helperUID, helperGID
+	defer func() { helperUID, helperGID = savedUID, savedGID }()
+	helperUID, helperGID = os.Getuid(), os.Getgid()
+
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	bios := write("bios.fd", "")
+	base := write("base.raw", "")
+	top := write("top.qcow2", "")
+	write("top.qcow2.json", `[{"filename": "`+top+`", "format": "qcow2", "full-backing-filename": "`+base+`"},
+		{"filename": "`+base+`", "format": "raw"}]`)
+	vmdk := write("disk.vmdk", "")
+	write("disk.vmdk.json", `[{"filename": "`+vmdk+`", "format": "vmdk"}]`)
+	other := os.Getuid() + 1
+	foreign := write("foreign.qcow2", "")
+	foreignBase := write("foreign-base.raw", "")
+	for _, path := range []string{foreign, foreignBase} {
+		if err := os.Chown(path, other, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	onForeign := write("on-foreign.qcow2", "")
+	write("on-foreign.qcow2.json", `[{"filename": "`+onForeign+`", "format": "qcow2"},
+		{"filename": "`+foreignBase+`", "format": "raw"}]`)
+	link := filepath.Join(dir, "link.qcow2")
+	if err := os.Symlink(top, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "dir.qcow2"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := func(disk string) VMConfig {
+		return VMConfig{
+			Name: "vm1", Disk: disk, BIOS: bios, Memory: "1G", CPUs: "1",
+			Networks: []VMNetwork{{Type: "vmnet-shared", ID: "net0"}},
+		}
+	}
+	drive := `file=json:{"backing":{"driver":"raw",,"file":{"driver":"file",,"filename":"/dev/fdset/2"}},,` +
+		`"driver":"qcow2",,"file":{"driver":"file",,"filename":"/dev/fdset/1"}},if=virtio`
+
+	tests := []struct {
+		name      string
+		vm        VMConfig
+		owner     int // helperUID for the case; -1 keeps the current user
+		errMsg    string
+		disk      string
+		drive     string
+		fdSets    []int
+		openFiles int
+	}{
+		{name: "qcow2 on raw", vm: vm(top), owner: -1, disk: top, drive: drive, fdSets: []int{1, 1, 2}, openFiles: 3},
+		{name: "symlinked disk is resolved", vm: vm(link), owner: -1, disk: top, drive: drive, fdSets: []int{1, 1, 2}, openFiles: 3},
+		{name: "no privilege needed", vm: func() VMConfig { v := vm(top); v.Networks[0].Type = "user"; return v }(), owner: -1, errMsg: "does not need privilege"},
+		{name: "bad QEMU args", vm: func() VMConfig { v := vm(top); v.CPUs = "1,maxcpus=8"; return v }(), owner: -1, errMsg: "invalid cpus"},
+		{name: "relative disk", vm: vm("top.qcow2"), owner: -1, errMsg: "not an absolute path"},
+		{name: "missing disk", vm: vm(filepath.Join(dir, "missing.qcow2")), owner: -1, errMsg: "no such file"},
+		{name: "directory as disk", vm: vm(filepath.Join(dir, "dir.qcow2")), owner: -1, errMsg: "not a regular file"},
+		{name: "unsupported format", vm: vm(vmdk), owner: -1, errMsg: "unsupported image format"},
+		{name: "disk of another user", vm: vm(foreign), owner: -1, errMsg: "is not owned by"},
+		{name: "backing file of another user", vm: vm(onForeign), owner: -1, errMsg: "is not a file owned by"},
+		{name: "helper for another user", vm: vm(top), owner: other, errMsg: "is not owned by"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helperUID = os.Getuid()
+			if tt.owner >= 0 {
+				helperUID = tt.owner
+			}
+			config := tt.vm
+			launch, files, err := helperLaunchConfig(&config)
+			defer closeFiles(files)
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("helperLaunchConfig() = %v, want error containing %q", err, tt.errMsg)
+				}
+				if files != nil {
+					t.Errorf("helperLaunchConfig() returned %d files with an error", len(files))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("helperLaunchConfig() = %v", err)
+			}
+			if launch.Disk != tt.disk || launch.BIOS != bios {
+				t.Errorf("disk, bios = %s, %s, want %s, %s", launch.Disk, launch.BIOS, tt.disk, bios)
+			}
+			if launch.diskDrive != tt.drive {
+				t.Errorf("diskDrive = %s\nwant %s", launch.diskDrive, tt.drive)
+			}
+			if !reflect.DeepEqual(launch.diskFDSets, tt.fdSets) {
+				t.Errorf("diskFDSets = %v, want %v", launch.diskFDSets, tt.fdSets)
+			}
+			if len(files) != tt.openFiles {
+				t.Errorf("got %d files, want %d", len(files), tt.openFiles)
+			}
+			if config.diskDrive != "" || config.Disk != tt.vm.Disk {
+				t.Errorf("helperLaunchConfig() changed the VM it was given")
+			}
+		})
+	}
+}
@@ -7,6 +7,9 @@ const indexHTML = `<!DOCTYPE html>
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
     <title>QEMU Instance Monitor</title>
     <link href="https://fonts.googleapis.com/css2?family=JetBrains+Mono:wght@400;500;700&family=Orbitron:wght@700;900&display=swap" rel="stylesheet">
+    <link href="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/css/xterm.min.css" rel="stylesheet">
+    <script src="https://cdn.jsdelivr.net/npm/@xterm/xterm@5.5.0/lib/xterm.min.js"></script>
+    <script src="https://cdn.jsdelivr.net/npm/@xterm/addon-fit@0.10.0/lib/addon-fit.min.js"></script>
     <style>
         :root {
             --bg-primary: #0a0e14;
@@ -293,6 +296,11 @@ const indexHTML = `<!DOCTYPE html>
             color: var(--bg-primary);
         }
 
+        .status-paused {
+            background: var(--text-dim);
+            color: var(--bg-primary);
+        }
+
         .instance-type {
             display: inline-block;
             padding: 0.2rem 0.6rem;
@@ -526,6 +534,158 @@ const indexHTML = `<!DOCTYPE html>
             box-shadow: 0 4px 12px rgba(0, 0, 0, 0.3);
         }
 
+        .drop-zone {
+            border: 2px dashed var(--border-color);
+            border-radius: 8px;
+            padding: 2rem 1rem;
+            text-align: center;
+            color: var(--text-dim);
+            cursor: pointer;
+            transition: all 0.3s ease;
+            margin: 1rem 0;
+        }
+
+        .drop-zone.dragover {
+            border-color: var(--accent-green);
+            color: var(--accent-green);
+            background: rgba(0, 255, 136, 0.05);
+        }
+
+        .modal-input {
+            width: 100%;
+            background: var(--bg-secondary);
+            border: 1px solid var(--border-color);
+            border-radius: 6px;
+            padding: 0.6rem;
+            color: var(--text-primary);
+            font-family: 'JetBrains Mono', monospace;
+            font-size: 0.85rem;
+        }
+
+        .transfer-item {
+            font-size: 0.75rem;
+            margin-top: 0.5rem;
+        }
+
+        .progress-bar {
+            height: 6px;
+            background: var(--bg-secondary);
+            border-radius: 3px;
+            overflow: hidden;
+            margin-top: 0.2rem;
+        }
+
+        .progress-fill {
+            height: 100%;
+            width: 0;
+            background: var(--accent-green);
+            transition: width 0.3s ease;
+        }
+
+        .modal-content.terminal-content {
+            max-width: 1100px;
+            height: 80vh;
+            display: flex;
+            flex-direction: column;
+        }
+
+        .terminal-tabs {
+            display: flex;
+            gap: 0.3rem;
+            margin-bottom: 0.5rem;
+            flex-wrap: wrap;
+        }
+
+        .terminal-tab {
+            padding: 0.3rem 0.8rem;
+            border: 1px solid var(--border-color);
+            border-radius: 4px;
+            background: var(--bg-secondary);
+            color: var(--text-secondary);
+            font-size: 0.75rem;
+            cursor: pointer;
+        }
+
+        .terminal-tab.active {
+            border-color: var(--accent-green);
+            color: var(--accent-green);
+        }
+
+        .terminal-tab .tab-close {
+            margin-left: 0.5rem;
+            color: var(--text-dim);
+        }
+
+        .terminal-panes {
+            flex: 1;
+            min-height: 0;
+            background: #000;
+            border-radius: 6px;
+            padding: 0.3rem;
+        }
+
+        .terminal-pane {
+            width: 100%;
+            height: 100%;
+            display: none;
+        }
+
+        .terminal-pane.active {
+            display: block;
+        }
+
+        .conflicts-banner {
+            background: rgba(255, 68, 68, 0.1);
+            border: 1px solid var(--accent-red);
+            border-radius: 6px;
+            color: var(--accent-red);
+            padding: 0.8rem 1rem;
+            margin-bottom: 2rem;
+            font-size: 0.85rem;
+        }
+
+        .images-section {
+            margin-top: 2rem;
+        }
+
+        .image-disk {
+            background: var(--bg-card);
+            border: 1px solid var(--border-color);
+            border-radius: 6px;
+            margin-bottom: 0.6rem;
+            padding: 0.6rem 1rem;
+        }
+
+        .image-disk summary {
+            cursor: pointer;
+            font-family: 'JetBrains Mono', monospace;
+            font-size: 0.85rem;
+        }
+
+        .image-layer {
+            border-left: 2px solid var(--accent-blue);
+            margin: 0.6rem 0 0 0.4rem;
+            padding-left: 0.8rem;
+            font-size: 0.8rem;
+            color: var(--text-secondary);
+        }
+
+        .image-layer .mono {
+            color: var(--text-primary);
+        }
+
+        .impairment-select {
+            margin-top: 0.3rem;
+            width: 100%;
+            background: var(--bg-card);
+            border: 1px solid var(--border-color);
+            border-radius: 4px;
+            color: var(--accent-amber);
+            font-family: 'JetBrains Mono', monospace;
+            font-size: 0.7rem;
+            padding: 0.2rem;
+        }
+
         .no-instances {
             text-align: center;
             padding: 4rem 2rem;
@@ -579,6 +739,10 @@ const indexHTML = `<!DOCTYPE html>
                 <div class="stat-item">
                     <span class="last-updated">Updated: <span class="time" id="last-updated">--</span></span>
                 </div>
+                <div class="stat-item" id="user-info" style="display: none;">
+                    <span class="last-updated"><span id="user-name"></span> (<span id="user-role"></span>)
+                        <a href="#" onclick="logout(); return false;" style="color: var(--accent-blue);">Sign out</a></span>
+                </div>
             </div>
         </div>
     </div>
@@ -592,9 +756,16 @@ const indexHTML = `<!DOCTYPE html>
             <button class="filter-btn" data-filter="custom">Custom</button>
         </div>
 
+        <div id="conflicts-banner" class="conflicts-banner" style="display: none;"></div>
+
         <div id="instances-container">
             <div class="loading">⟳ Loading instances...</div>
         </div>
+
+        <div class="images-section">
+            <h2 style="color: var(--text-dim); font-size: 1rem; margin-bottom: 1rem; text-transform: uppercase; letter-spacing: 1px;">Disk Images</h2>
+            <div id="images-container"><div class="loading">⟳ Loading images...</div></div>
+        </div>
     </div>
 
     <div id="shell-modal" class="modal">
@@ -607,6 +778,51 @@ const indexHTML = `<!DOCTYPE html>
         </div>
     </div>
 
+    <div id="login-modal" class="modal">
+        <div class="modal-content">
+            <div class="modal-header">Sign In</div>
+            <div class="modal-body">
+                <input class="modal-input" id="login-username" placeholder="Username" autocomplete="username">
+                <input class="modal-input" id="login-password" type="password" placeholder="Password" autocomplete="current-password">
+                <div id="login-error" style="color: var(--accent-red); margin-top: 0.5rem;"></div>
+            </div>
+            <div class="modal-actions">
+                <button class="modal-btn" onclick="login()">Sign In</button>
+            </div>
+        </div>
+    </div>
+
+    <div id="files-modal" class="modal">
+        <div class="modal-content">
+            <div class="modal-header">File Transfer: <span id="files-vm-name"></span></div>
+            <div class="modal-body">
+                <div><strong>Guest directory:</strong></div>
+                <input class="modal-input" id="files-upload-dir" value="/tmp">
+                <div class="drop-zone" id="files-drop-zone">Drop files here or click to choose</div>
+                <input type="file" id="files-input" multiple style="display: none;">
+                <div id="files-transfers"></div>
+                <div style="margin-top: 1rem;"><strong>Download guest file:</strong></div>
+                <input class="modal-input" id="files-download-path" placeholder="/var/log/messages">
+            </div>
+            <div class="modal-actions">
+                <button class="modal-btn" onclick="downloadFile()">Download</button>
+                <button class="modal-btn" onclick="closeFilesModal()">Close</button>
+            </div>
+        </div>
+    </div>
+
+    <div id="terminal-modal" class="modal">
+        <div class="modal-content terminal-content">
+            <div class="modal-header">Terminal</div>
+            <div class="terminal-tabs" id="terminal-tabs"></div>
+            <div class="terminal-panes" id="terminal-panes"></div>
+            <div class="modal-actions" style="margin-top: 1rem;">
+                <button class="modal-btn" onclick="openTerminal(activeTerminalVM())">New Tab</button>
+                <button class="modal-btn" onclick="closeTerminalModal()">Hide</button>
+            </div>
+        </div>
+    </div>
+
     <script>
         let currentFilter = 'all';
         let allInstances = [];
@@ -617,6 +833,49 @@ const indexHTML = `<!DOCTYPE html>
             return cpuTime;
         }
 
+        function showLogin() {
+            document.getElementById('login-modal').classList.add('show');
+            document.getElementById('login-username').focus();
+        }
+
+        async function login() {
+            const response = await fetch('/api/login', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    username: document.getElementById('login-username').value,
+                    password: document.getElementById('login-password').value
+                })
+            });
+            if (response.ok) {
+                location.reload();
+                return;
+            }
+            const data = await response.json();
+            document.getElementById('login-error').textContent = data.error;
+        }
+
+        async function logout() {
+            await fetch('/api/logout', { method: 'POST' });
+            location.reload();
+        }
+
+        // whoami returns false when the user must sign in first
+        async function whoami() {
+            const response = await fetch('/api/whoami');
+            if (response.status === 401) {
+                showLogin();
+                return false;
+            }
+            const data = await response.json();
+            if (data.auth_enabled) {
+                document.getElementById('user-name').textContent = data.principal.name;
+                document.getElementById('user-role').textContent = data.principal.role;
+                document.getElementById('user-info').style.display = '';
+            }
+            return true;
+        }
+
         async function loadVMsConfig() {
             try {
                 const response = await fetch('/api/vms');
@@ -626,6 +885,34 @@ const indexHTML = `<!DOCTYPE html>
             }
         }
 
+        let impairmentProfiles = [];
+
+        async function loadImpairmentProfiles() {
+            try {
+                const response = await fetch('/api/impairments');
+                impairmentProfiles = await response.json();
+            } catch (error) {
+                console.error('Failed to load impairment profiles:', error);
+            }
+        }
+
+        async function setImpairment(name, netdev, profile) {
+            try {
+                const response = await fetch('/api/vms/' + encodeURIComponent(name) + '/impairment', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ netdev: netdev, profile: profile })
+                });
+                const data = await response.json();
+                if (data.error) {
+                    alert('Error: ' + data.error);
+                }
+                fetchInstances();
+            } catch (error) {
+                alert('Failed to apply impairment: ' + error.message);
+            }
+        }
+
         function findVMConfig(name) {
             return vmsConfig.vms.find(function(vm) { return vm.name === name; });
         }
@@ -638,15 +925,13 @@ const indexHTML = `<!DOCTYPE html>
             if (!confirm('Start VM: ' + name + '?')) return;
             
             try {
-                const response = await fetch('/api/start', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ name: name })
+                const response = await fetch('/api/v1/vms/' + encodeURIComponent(name) + '/start', {
+                    method: 'POST'
                 });
                 const data = await response.json();
                 
                 if (data.error) {
-                    alert('Error: ' + data.error);
+                    alert('Error: ' + data.error.message);
                 } else {
                     alert('VM started successfully! Refreshing...');
                     setTimeout(fetchInstances, 2000);
@@ -656,26 +941,46 @@ const indexHTML = `<!DOCTYPE html>
             }
         }
 
-        async function stopVM(pid, name, force) {
+        async function cloneVM(name) {
+            const clone = prompt('Name for the linked clone of ' + name + ':', name + '-2');
+            if (!clone) return;
+            try {
+                const response = await fetch('/api/vms/' + encodeURIComponent(name) + '/clone', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ name: clone, mode: 'overlay' })
+                });
+                const data = await response.json();
+                if (data.error) {
+                    alert('Error: ' + data.error);
+                }
+                await loadVMsConfig();
+                fetchInstances();
+            } catch (error) {
+                alert('Failed to clone VM: ' + error);
+            }
+        }
+
+        async function stopVM(id, name, force) {
             if (!force) {
-                if (!confirm('Stop VM: ' + name + ' (PID: ' + pid + ')?\n\nThis will send SIGTERM for graceful shutdown.')) {
+                if (!confirm('Stop VM: ' + name + '?\n\nThis will send SIGTERM for graceful shutdown.')) {
                     return;
                 }
             }
             
             try {
-                const response = await fetch('/api/stop', {
+                const response = await fetch('/api/v1/instances/' + encodeURIComponent(id) + '/stop', {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ pid: pid, force: force || false })
+                    body: JSON.stringify({ force: force || false })
                 });
                 const data = await response.json();
                 
                 if (data.error) {
-                    if (data.error.includes('operation not permitted') || data.error.includes('permission denied')) {
+                    if (data.error.code === 'signal_failed' && data.error.message.includes('operation not permitted')) {
                         alert('Permission denied. You may need to enter your sudo password in the terminal running the server.');
                     } else {
-                        alert('Error: ' + data.error);
+                        alert('Error: ' + data.error.message);
                     }
                 } else {
                     alert('VM ' + data.status + ' successfully! Refreshing...');
@@ -686,24 +991,20 @@ const indexHTML = `<!DOCTYPE html>
             }
         }
 
-        async function forceStopVM(pid, name) {
-            if (!confirm('⚠️ FORCE STOP VM: ' + name + ' (PID: ' + pid + ')?\n\nThis will send SIGKILL and immediately terminate the VM.\nUse this only if graceful shutdown failed.\n\nContinue?')) {
+        async function forceStopVM(id, name) {
+            if (!confirm('⚠️ FORCE STOP VM: ' + name + '?\n\nThis will send SIGKILL and immediately terminate the VM.\nUse this only if graceful shutdown failed.\n\nContinue?')) {
                 return;
             }
-            await stopVM(pid, name, true);
+            await stopVM(id, name, true);
         }
 
         async function showShell(name) {
             try {
-                const response = await fetch('/api/shell', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ name: name })
-                });
+                const response = await fetch('/api/v1/vms/' + encodeURIComponent(name) + '/shell');
                 const data = await response.json();
                 
                 if (data.error) {
-                    alert('Error: ' + data.error);
+                    alert('Error: ' + data.error.message);
                     return;
                 }
 
@@ -717,12 +1018,25 @@ const indexHTML = `<!DOCTYPE html>
                     html += '<div class="modal-code">' + data.ssh_command + '</div>';
                 }
                 
+                if (data.interfaces) {
+                    data.interfaces.forEach(function(iface) {
+                        html += '<div style="margin-top: 1rem;"><strong>' + iface.type + ' (' + iface.id + '):</strong></div>';
+                        iface.ssh_commands.forEach(function(cmd) {
+                            html += '<div class="modal-code">' + cmd + '</div>';
+                        });
+                    });
+                }
+
                 if (data.http_url) {
                     html += '<div style="margin-top: 1rem;"><strong>HTTP:</strong></div>';
                     html += '<div class="modal-code">' + data.http_url + '</div>';
                 }
 
-                if (!data.ssh_command && !data.http_url) {
+                if (data.ssh_command && data.running) {
+                    html += '<div style="margin-top: 1rem;"><button class="modal-btn primary" onclick="openTerminal(\'' + name + '\')">Open Terminal</button></div>';
+                }
+
+                if (!data.ssh_command && !data.http_url && !data.interfaces) {
                     html += '<div style="color: var(--text-dim); margin-top: 1rem;">No shell access configured for this VM</div>';
                 }
 
@@ -737,6 +1051,176 @@ const indexHTML = `<!DOCTYPE html>
             document.getElementById('shell-modal').classList.remove('show');
         }
 
+        let filesVM = '';
+        let transferSeq = 0;
+
+        function showFiles(name) {
+            filesVM = name;
+            document.getElementById('files-vm-name').textContent = name;
+            document.getElementById('files-transfers').innerHTML = '';
+            document.getElementById('files-modal').classList.add('show');
+        }
+
+        function closeFilesModal() {
+            document.getElementById('files-modal').classList.remove('show');
+        }
+
+        function formatBytes(n) {
+            if (n >= 1073741824) return (n / 1073741824).toFixed(1) + ' GB';
+            if (n >= 1048576) return (n / 1048576).toFixed(1) + ' MB';
+            if (n >= 1024) return (n / 1024).toFixed(1) + ' KB';
+            return n + ' B';
+        }
+
+        async function uploadFile(file) {
+            const dir = document.getElementById('files-upload-dir').value.replace(/\/+$/, '');
+            const path = dir + '/' + file.name;
+            const id = 'ui-' + Date.now() + '-' + (++transferSeq);
+
+            const item = document.createElement('div');
+            item.className = 'transfer-item';
+            item.id = 'transfer-' + id;
+            item.innerHTML = '<div class="transfer-label">' + path + ' (' + formatBytes(file.size) + ')</div>' +
+                             '<div class="progress-bar"><div class="progress-fill"></div></div>';
+            document.getElementById('files-transfers').appendChild(item);
+
+            try {
+                const response = await fetch('/api/vms/' + encodeURIComponent(filesVM) + '/files?path=' +
+                                             encodeURIComponent(path) + '&id=' + encodeURIComponent(id), {
+                    method: 'PUT',
+                    body: file
+                });
+                const data = await response.json();
+                if (data.error) {
+                    item.querySelector('.transfer-label').textContent = path + ': ' + data.error;
+                    item.querySelector('.progress-fill').style.background = 'var(--accent-red)';
+                }
+            } catch (error) {
+                item.querySelector('.transfer-label').textContent = path + ': ' + error.message;
+            }
+        }
+
+        function downloadFile() {
+            const path = document.getElementById('files-download-path').value;
+            if (!path) return;
+            window.location = '/api/vms/' + encodeURIComponent(filesVM) + '/files?path=' + encodeURIComponent(path);
+        }
+
+        function onTransferProgress(e) {
+            const ev = JSON.parse(e.data);
+            const item = document.getElementById('transfer-' + ev.data.id);
+            if (!item) return;
+            const pct = ev.data.total > 0 ? Math.min(100, ev.data.bytes * 100 / ev.data.total) : (ev.data.done ? 100 : 0);
+            item.querySelector('.progress-fill').style.width = pct + '%';
+            if (ev.data.done && !ev.data.error) {
+                item.querySelector('.transfer-label').textContent = ev.data.path + ' — ' + formatBytes(ev.data.bytes) + ' uploaded';
+            }
+        }
+
+        let terminals = [];
+        let activeTerminal = null;
+        let terminalSeq = 0;
+
+        function activeTerminalVM() {
+            return activeTerminal ? activeTerminal.vm : '';
+        }
+
+        function openTerminal(name) {
+            if (!name) return;
+            closeShellModal();
+            document.getElementById('terminal-modal').classList.add('show');
+
+            const id = ++terminalSeq;
+            const pane = document.createElement('div');
+            pane.className = 'terminal-pane';
+            document.getElementById('terminal-panes').appendChild(pane);
+
+            const tab = document.createElement('div');
+            tab.className = 'terminal-tab';
+            tab.innerHTML = name + ' #' + id + '<span class="tab-close">✕</span>';
+            document.getElementById('terminal-tabs').appendChild(tab);
+
+            const term = new Terminal({ cursorBlink: true, fontFamily: 'JetBrains Mono, monospace', fontSize: 13 });
+            const fit = new FitAddon.FitAddon();
+            term.loadAddon(fit);
+            term.open(pane);
+
+            const t = { id: id, vm: name, term: term, fit: fit, pane: pane, tab: tab, ws: null };
+            terminals.push(t);
+            selectTerminal(t);
+
+            const proto = location.protocol === 'https:' ? 'wss://' : 'ws://';
+            const ws = new WebSocket(proto + location.host + '/api/vms/' + encodeURIComponent(name) +
+                                     '/terminal?cols=' + term.cols + '&rows=' + term.rows);
+            ws.binaryType = 'arraybuffer';
+            t.ws = ws;
+
+            ws.onmessage = function(e) {
+                term.write(typeof e.data === 'string' ? e.data : new Uint8Array(e.data));
+            };
+            ws.onclose = function() {
+                term.write('\r\n\x1b[33m[session closed]\x1b[0m\r\n');
+            };
+            term.onData(function(data) {
+                if (ws.readyState === WebSocket.OPEN) {
+                    ws.send(JSON.stringify({ type: 'input', data: data }));
+                }
+            });
+            term.onResize(function(size) {
+                if (ws.readyState === WebSocket.OPEN) {
+                    ws.send(JSON.stringify({ type: 'resize', cols: size.cols, rows: size.rows }));
+                }
+            });
+
+            tab.addEventListener('click', function() { selectTerminal(t); });
+            tab.querySelector('.tab-close').addEventListener('click', function(e) {
+                e.stopPropagation();
+                closeTerminal(t);
+            });
+        }
+
+        function selectTerminal(t) {
+            terminals.forEach(function(other) {
+                other.pane.classList.remove('active');
+                other.tab.classList.remove('active');
+            });
+            t.pane.classList.add('active');
+            t.tab.classList.add('active');
+            activeTerminal = t;
+            t.fit.fit();
+            t.term.focus();
+        }
+
+        function closeTerminal(t) {
+            if (t.ws) t.ws.close();
+            t.term.dispose();
+            t.pane.remove();
+            t.tab.remove();
+            terminals = terminals.filter(function(other) { return other !== t; });
+            if (terminals.length > 0) {
+                selectTerminal(terminals[terminals.length - 1]);
+            } else {
+                activeTerminal = null;
+                closeTerminalModal();
+            }
+        }
+
+        function closeTerminalModal() {
+            document.getElementById('terminal-modal').classList.remove('show');
+        }
+
+        window.addEventListener('resize', function() {
+            if (activeTerminal) activeTerminal.fit.fit();
+        });
+
+        // escapeHTML makes a string safe to put in markup and attributes.
+        // Anything a guest reports must go through it.
+        function escapeHTML(value) {
+            return String(value).replace(/[&<>"']/g, function(c) {
+                return {'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;'}[c];
+            });
+        }
+
         function createInstanceCard(instance, index) {
             const statusClass = instance.status.toLowerCase();
             const animationDelay = index * 0.05;
@@ -744,15 +1228,58 @@ const indexHTML = `<!DOCTYPE html>
             let networksHtml = '';
             if (instance.networks && instance.networks.length > 0) {
                 networksHtml = instance.networks.map(function(net) {
+                    let addrs = '';
+                    if (net.addresses && net.addresses.length > 0) {
+                        addrs = net.addresses.map(function(a) {
+                            return '<div class="network-mac" title="last seen ' + escapeHTML(a.last_seen) + '">' +
+                                   escapeHTML(a.ip) + ' <span style="color: var(--text-dim);">(' + escapeHTML(a.source) + ')</span></div>';
+                        }).join('');
+                    }
+                    let impairment = '';
+                    if (net.ifname && impairmentProfiles.length > 0) {
+                        impairment = '<select class="impairment-select" onchange="setImpairment(\'' + instance.name + '\', \'' + net.id + '\', this.value)">' +
+                                     '<option value="">no impairment</option>' +
+                                     impairmentProfiles.map(function(p) {
+                                         return '<option value="' + p.name + '"' + (p.name === net.impairment ? ' selected' : '') + '>' + p.name + '</option>';
+                                     }).join('') +
+                                     '</select>';
+                    }
                     return '<div class="network-item">' +
-                           '<div class="network-type">' + (net.type || 'unknown') + '</div>' +
+                           '<div class="network-type">' + (net.type || 'unknown') + (net.id ? ' · ' + net.id : '') + '</div>' +
                            '<div class="network-mac">' + net.mac + '</div>' +
+                           addrs +
+                           impairment +
                            '</div>';
                 }).join('');
             } else {
                 networksHtml = '<div style="color: var(--text-dim); font-size: 0.75rem;">No networks</div>';
             }
 
+            let guestHtml = '';
+            if (instance.guest_hostname || instance.guest_os) {
+                guestHtml += '<div class="detail-row">' +
+                             '<div class="detail-label">Guest</div>' +
+                             '<div class="detail-value">' + escapeHTML(instance.guest_hostname || '') +
+                             (instance.guest_os ? ' (' + escapeHTML(instance.guest_os) + ')' : '') + '</div>' +
+                             '</div>';
+            }
+            if (instance.guest_ips && instance.guest_ips.length > 0) {
+                guestHtml += '<div class="detail-row">' +
+                             '<div class="detail-label">Guest IPs</div>' +
+                             '<div class="detail-value mono">' + instance.guest_ips.map(escapeHTML).join('<br>') + '</div>' +
+                             '</div>';
+            }
+
+            if (instance.forwards && instance.forwards.length > 0) {
+                guestHtml += '<div class="detail-row">' +
+                             '<div class="detail-label">Forwards</div>' +
+                             '<div class="detail-value mono">' + instance.forwards.map(function(f) {
+                                 return f.protocol + ' :' + f.host + ' → ' + f.guest +
+                                        (f.source === 'runtime' ? ' <span style="color: var(--accent-amber);">(live)</span>' : '');
+                             }).join('<br>') + '</div>' +
+                             '</div>';
+            }
+
             return '<div class="instance-card" style="animation-delay: ' + animationDelay + 's" data-type="' + instance.type + '" data-status="' + instance.status + '">' +
                    '<div class="instance-header">' +
                    '<div class="instance-name">' + (instance.name || 'Unnamed Instance') + '</div>' +
@@ -784,6 +1311,7 @@ const indexHTML = `<!DOCTYPE html>
                    '<div class="detail-label">Disk Image</div>' +
                    '<div class="detail-value mono">' + (instance.disk_image || 'N/A') + '</div>' +
                    '</div>' +
+                   guestHtml +
                    '<div class="detail-row">' +
                    '<div class="detail-label">Networks</div>' +
                    '<div class="detail-value">' +
@@ -792,9 +1320,11 @@ const indexHTML = `<!DOCTYPE html>
                    '</div>' +
                    '</div>' +
                    '<div class="actions">' +
-                   '<button class="action-btn stop" onclick="stopVM(\'' + instance.pid + '\', \'' + (instance.name || 'VM') + '\', false)" title="Graceful shutdown (SIGTERM)">Stop</button>' +
-                   '<button class="action-btn force-stop" onclick="forceStopVM(\'' + instance.pid + '\', \'' + (instance.name || 'VM') + '\')" title="Force kill (SIGKILL)">Kill</button>' +
+                   '<button class="action-btn stop" onclick="stopVM(\'' + instance.id + '\', \'' + (instance.name || 'VM') + '\', false)" title="Graceful shutdown (SIGTERM)">Stop</button>' +
+                   '<button class="action-btn force-stop" onclick="forceStopVM(\'' + instance.id + '\', \'' + (instance.name || 'VM') + '\')" title="Force kill (SIGKILL)">Kill</button>' +
                    '<button class="action-btn shell" onclick="showShell(\'' + (instance.name || '') + '\')">Shell</button>' +
+                   '<button class="action-btn shell" onclick="showFiles(\'' + (instance.name || '') + '\')">Files</button>' +
+                   '<button class="action-btn shell" onclick="openTerminal(\'' + (instance.name || '') + '\')">Term</button>' +
                    '</div>' +
                    '</div>';
         }
@@ -840,6 +1370,7 @@ const indexHTML = `<!DOCTYPE html>
                     html += '<div class="actions">';
                     html += '<button class="action-btn start" onclick="startVM(\'' + vm.name + '\')">Start</button>';
                     html += '<button class="action-btn shell" onclick="showShell(\'' + vm.name + '\')">Shell Info</button>';
+                    html += '<button class="action-btn shell" onclick="cloneVM(\'' + vm.name + '\')">Clone</button>';
                     html += '</div>';
                     html += '</div>';
                 });
@@ -866,10 +1397,22 @@ const indexHTML = `<!DOCTYPE html>
         async function fetchInstances() {
             try {
                 const response = await fetch('/api/instances');
+                if (response.status === 401) {
+                    showLogin();
+                    return;
+                }
                 const data = await response.json();
                 
                 document.getElementById('instance-count').textContent = data.count;
                 document.getElementById('last-updated').textContent = data.last_updated;
+
+                const banner = document.getElementById('conflicts-banner');
+                if (data.conflicts && data.conflicts.length > 0) {
+                    banner.innerHTML = '⚠ Configuration conflicts:<br>' + data.conflicts.join('<br>');
+                    banner.style.display = 'block';
+                } else {
+                    banner.style.display = 'none';
+                }
                 
                 renderInstances(data.instances);
             } catch (error) {
@@ -879,6 +1422,54 @@ const indexHTML = `<!DOCTYPE html>
             }
         }
 
+        function renderImageLayer(layer) {
+            let html = '<div class="image-layer">';
+            html += '<div class="mono">' + layer.filename + '</div>';
+            html += '<div>' + layer.format + ' · virtual ' + formatBytes(layer.virtual_size) +
+                    ' · on disk ' + formatBytes(layer.actual_size) +
+                    (layer.encrypted ? ' · encrypted' + (layer.encryption ? ' (' + layer.encryption + ')' : '') : '') + '</div>';
+            if (layer.snapshots && layer.snapshots.length > 0) {
+                html += '<div>Snapshots: ' + layer.snapshots.map(function(s) {
+                    return s.name + ' (' + new Date(s.date * 1000).toLocaleString() + ')';
+                }).join(', ') + '</div>';
+            }
+            if (layer.bitmaps && layer.bitmaps.length > 0) {
+                html += '<div>Bitmaps: ' + layer.bitmaps.map(function(b) { return b.name; }).join(', ') + '</div>';
+            }
+            if (layer.backing_file) {
+                html += '<div>Backing: <span class="mono">' + layer.backing_file + '</span></div>';
+            }
+            return html + '</div>';
+        }
+
+        async function fetchImages() {
+            const container = document.getElementById('images-container');
+            try {
+                const response = await fetch('/api/images');
+                const data = await response.json();
+                const open = Array.from(container.querySelectorAll('details[open]')).map(function(d) { return d.dataset.path; });
+
+                if (data.images.length === 0) {
+                    container.innerHTML = '<div class="no-instances">No disk images configured</div>';
+                    return;
+                }
+                container.innerHTML = data.images.map(function(img) {
+                    let summary = img.vm + ' — ' + img.path;
+                    if (img.chain && img.chain.length > 0) {
+                        summary += ' (' + img.chain[0].format + ', ' + formatBytes(img.chain[0].virtual_size) +
+                                   (img.chain.length > 1 ? ', ' + img.chain.length + ' layers' : '') + ')';
+                    }
+                    let body = img.error ? '<div class="image-layer" style="color: var(--accent-red);">' + img.error + '</div>'
+                                         : img.chain.map(renderImageLayer).join('');
+                    return '<details class="image-disk" data-path="' + img.path + '"' + (open.includes(img.path) ? ' open' : '') + '>' +
+                           '<summary>' + (img.running ? '● ' : '○ ') + summary + '</summary>' + body + '</details>';
+                }).join('');
+            } catch (error) {
+                console.error('Error fetching images:', error);
+                container.innerHTML = '<div class="no-instances">Error loading images</div>';
+            }
+        }
+
         // Close modal on outside click
         document.getElementById('shell-modal').addEventListener('click', function(e) {
             if (e.target === this) {
@@ -886,6 +1477,37 @@ const indexHTML = `<!DOCTYPE html>
             }
         });
 
+        document.getElementById('files-modal').addEventListener('click', function(e) {
+            if (e.target === this) {
+                closeFilesModal();
+            }
+        });
+
+        // Drag-and-drop upload
+        const dropZone = document.getElementById('files-drop-zone');
+        const fileInput = document.getElementById('files-input');
+        dropZone.addEventListener('click', function() { fileInput.click(); });
+        dropZone.addEventListener('dragover', function(e) {
+            e.preventDefault();
+            dropZone.classList.add('dragover');
+        });
+        dropZone.addEventListener('dragleave', function() {
+            dropZone.classList.remove('dragover');
+        });
+        dropZone.addEventListener('drop', function(e) {
+            e.preventDefault();
+            dropZone.classList.remove('dragover');
+            Array.from(e.dataTransfer.files).forEach(uploadFile);
+        });
+        fileInput.addEventListener('change', function() {
+            Array.from(fileInput.files).forEach(uploadFile);
+            fileInput.value = '';
+        });
+
+        // Live progress from the event stream
+        const events = new EventSource('/api/events');
+        events.addEventListener('transfer_progress', onTransferProgress);
+
         // Filter functionality
         document.querySelectorAll('.filter-btn').forEach(function(btn) {
             btn.addEventListener('click', function() {
@@ -898,11 +1520,20 @@ const indexHTML = `<!DOCTYPE html>
             });
         });
 
+        document.getElementById('login-password').addEventListener('keydown', function(e) {
+            if (e.key === 'Enter') login();
+        });
+
         // Initialize
-        loadVMsConfig().then(function() {
+        whoami().then(function(ok) {
+            if (!ok) return Promise.reject('not signed in');
+            return Promise.all([loadVMsConfig(), loadImpairmentProfiles()]);
+        }).then(function() {
             fetchInstances();
-            setInterval(fetchInstances, 5000);
-        });
+            setInterval(fetchInstances, POLL_INTERVAL_MS);
+            fetchImages();
+            setInterval(fetchImages, 30000);
+        }).catch(function() {});
     </script>
 </body>
 </html>
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ImageJob is an asynchronous qemu-img operation.
+type ImageJob struct {
+	ID         string  `json:"id"`
+	Op         string  `json:"op"` // create, resize, convert, check, compact
+	Path       string  `json:"path"`
+	Output     string  `json:"output,omitempty"`
+	Status     string  `json:"status"` // running, done, failed, cancelled
+	Progress   float64 `json:"progress"`
+	Result     string  `json:"result,omitempty"`
+	Error      string  `json:"error,omitempty"`
+	StartedAt  string  `json:"started_at"`
+	FinishedAt string  `json:"finished_at,omitempty"`
+
+	vm        string
+	cmd       *exec.Cmd
+	cancelled bool
+}
+
+// ImageJobRequest is the body of POST /api/images/jobs. Relative paths are
+// resolved against the working_dir of vm; without vm they must be absolute.
+type ImageJobRequest struct {
+	Op            string `json:"op"`
+	VM            string `json:"vm,omitempty"`
+	Path          string `json:"path"`
+	Format        string `json:"format,omitempty"`         // create/resize/check; output format for convert
+	Size          string `json:"size,omitempty"`           // create/resize, e.g. "20G" or "+5G"
+	Backing       string `json:"backing,omitempty"`        // create an overlay on this base, relative to path
+	BackingFormat string `json:"backing_format,omitempty"` // defaults to qcow2
+	Output        string `json:"output,omitempty"`         // convert target
+	Compress      bool   `json:"compress,omitempty"`       // convert/compact
+	Repair        string `json:"repair,omitempty"`         // check: "leaks" or "all"
+	Shrink        bool   `json:"shrink,omitempty"`         // resize: allow shrinking
+}
+
+// maxFinishedImageJobs is how many finished jobs are kept for listing.
+const maxFinishedImageJobs = 50
+
+var (
+	imageJobSeq int64
+
+	imageJobsMu sync.Mutex
+	imageJobs   = map[string]*ImageJob{}
+)
+
+var qemuImgProgressRegex = regexp.MustCompile(`\((\d+(?:\.\d+)?)/100%\)`)
+
+// imagesInUse maps every file in the backing chains of running VMs' disks
+// to the VM using it. Called with configMu held.
+func imagesInUse() map[string]string {
+	instances, _ := getQEMUInstances()
+	inUse := map[string]string{}
+	for _, inst := range instances {
+		paths := []string{}
+		for _, disk := range inst.Disks {
+			paths = append(paths, instanceDiskPath(inst, disk))
+		}
+		if vm := findVMConfig(inst.Name); vm != nil && vm.Disk != "" {
+			paths = append(paths, resolveVMPath(vm, vm.Disk))
+		}
+		for _, path := range paths {
+			inUse[filepath.Clean(path)] = inst.Name
+			chain, err := imageInfo(path, true)
+			if err != nil {
+				continue
+			}
+			for _, layer := range chain {
+				inUse[filepath.Clean(layer.Filename)] = inst.Name
+			}
+		}
+	}
+	return inUse
+}
+
+// checkImageNotInUse is the guard for operations that write to an image.
+func checkImageNotInUse(path string) error {
+	if vm, ok := imagesInUse()[filepath.Clean(path)]; ok {
+		return newAPIError(http.StatusConflict, "image_busy", "image %s is in use by running VM %s", path, vm)
+	}
+	return nil
+}
+
+func resolveJobPath(vm *VMConfig, path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	if vm != nil {
+		return resolveVMPath(vm, path), nil
+	}
+	if !filepath.IsAbs(path) {
+		return "", statusErrorf(http.StatusBadRequest, "path must be absolute without vm: %s", path)
+	}
+	return path, nil
+}
+
+// imageJobArgs validates a request and returns the qemu-img arguments for
+// it. Compact writes to a temporary file that replaces the image on success.
+func imageJobArgs(req *ImageJobRequest) ([]string, error) {
+	if req.Path == "" {
+		return nil, statusError(http.StatusBadRequest, "path is required")
+	}
+
+	switch req.Op {
+	case "create":
+		if _, err := os.Stat(req.Path); err == nil {
+			return nil, statusErrorf(http.StatusConflict, "image already exists: %s", req.Path)
+		}
+		format := req.Format
+		if format == "" {
+			format = "qcow2"
+		}
+		args := []string{"create", "-f", format}
+		if req.Backing != "" {
+			backingFormat := req.BackingFormat
+			if backingFormat == "" {
+				backingFormat = "qcow2"
+			}
+			args = append(args, "-b", req.Backing, "-F", backingFormat)
+		} else if req.Size == "" {
+			return nil, statusError(http.StatusBadRequest, "size is required for a blank image")
+		}
+		args = append(args, req.Path)
+		if req.Size != "" {
+			args = append(args, req.Size)
+		}
+		return args, nil
+
+	case "resize":
+		if req.Size == "" {
+			return nil, statusError(http.StatusBadRequest, "size is required")
+		}
+		if err := checkImageNotInUse(req.Path); err != nil {
+			return nil, err
+		}
+		args := []string{"resize"}
+		if req.Shrink {
+			args = append(args, "--shrink")
+		}
+		if req.Format != "" {
+			args = append(args, "-f", req.Format)
+		}
+		return append(args, req.Path, req.Size), nil
+
+	case "convert":
+		if req.Output == "" {
+			return nil, statusError(http.StatusBadRequest, "output is required")
+		}
+		if _, err := os.Stat(req.Output); err == nil {
+			return nil, statusErrorf(http.StatusConflict, "output already exists: %s", req.Output)
+		}
+		// A copy of a disk that is being written to is not consistent
+		if err := checkImageNotInUse(req.Path); err != nil {
+			return nil, err
+		}
+		format := req.Format
+		if format == "" {
+			format = "qcow2"
+		}
+		args := []string{"convert", "-p", "-O", format}
+		if req.Compress {
+			if format != "qcow2" {
+				return nil, statusError(http.StatusBadRequest, "compression needs qcow2 output")
+			}
+			args = append(args, "-c")
+		}
+		return append(args, req.Path, req.Output), nil
+
+	case "check":
+		args := []string{"check"}
+		if req.Repair != "" {
+			if req.Repair != "leaks" && req.Repair != "all" {
+				return nil, statusError(http.StatusBadRequest, "repair must be \"leaks\" or \"all\"")
+			}
+			if err := checkImageNotInUse(req.Path); err != nil {
+				return nil, err
+			}
+			args = append(args, "-r", req.Repair)
+		} else if _, inUse := imagesInUse()[filepath.Clean(req.Path)]; inUse {
+			args = append(args, "-U")
+		}
+		if req.Format != "" {
+			args = append(args, "-f", req.Format)
+		}
+		return append(args, req.Path), nil
+
+	case "compact":
+		if err := checkImageNotInUse(req.Path); err != nil {
+			return nil, err
+		}
+		chain, err := imageInfo(req.Path, false)
+		if err != nil {
+			return nil, err
+		}
+		top := chain[0]
+		if top.Format != "qcow2" {
+			return nil, statusErrorf(http.StatusBadRequest, "compact needs a qcow2 image, %s is %s", req.Path, top.Format)
+		}
+		if len(top.Snapshots) > 0 {
+			return nil, statusErrorf(http.StatusConflict, "image has %d internal snapshots, which compacting would drop", len(top.Snapshots))
+		}
+		args := []string{"convert", "-p", "-O", "qcow2"}
+		if req.Compress {
+			args = append(args, "-c")
+		}
+		if top.backingName != "" && len(chain) > 1 {
+			// Keep the image an overlay: only clusters that differ from
+			// the backing file are written
+			args = append(args, "-B", top.backingName, "-F", chain[1].Format)
+		}
+		req.Output = req.Path + ".compact.tmp"
+		return append(args, req.Path, req.Output), nil
+
+	default:
+		return nil, statusErrorf(http.StatusBadRequest, "unknown op: %s", req.Op)
+	}
+}
+
+// scanProgress splits qemu-img -p output, which redraws with \r.
+func scanProgress(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// startImageJob checks a request and starts its qemu-img job. Called with
+// configMu held, since the checks read the VM config.
+func startImageJob(req ImageJobRequest) (*ImageJob, error) {
+	var vm *VMConfig
+	if req.VM != "" {
+		if vm = findVMConfig(req.VM); vm == nil {
+			return nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", req.VM)
+		}
+	}
+	var err error
+	for _, p := range []*string{&req.Path, &req.Output} {
+		if *p, err = resolveJobPath(vm, *p); err != nil {
+			return nil, err
+		}
+	}
+	args, err := imageJobArgs(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &ImageJob{
+		ID:        strconv.FormatInt(atomic.AddInt64(&imageJobSeq, 1), 10),
+		Op:        req.Op,
+		Path:      req.Path,
+		Output:    req.Output,
+		Status:    "running",
+		StartedAt: time.Now().Format("2006-01-02 15:04:05"),
+		vm:        req.VM,
+		cmd:       exec.Command(qemuCommand("qemu-img"), args...),
+	}
+
+	stdout, err := job.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	job.cmd.Stderr = &stderr
+
+	// Check and start under the lock, so two jobs cannot both find a file
+	// free; compact's temporary file is derived from its path
+	imageJobsMu.Lock()
+	for _, path := range []string{job.Path, job.Output} {
+		if path != "" && imageJobBusyLocked(path) {
+			imageJobsMu.Unlock()
+			return nil, newAPIError(http.StatusConflict, "image_busy", "an image job is already running on %s", path)
+		}
+	}
+	if err := job.cmd.Start(); err != nil {
+		imageJobsMu.Unlock()
+		return nil, fmt.Errorf("failed to start qemu-img: %v", err)
+	}
+	imageJobs[job.ID] = job
+	pruneImageJobs()
+	snapshot := *job
+	imageJobsMu.Unlock()
+
+	log.Printf("Started image job %s: qemu-img %s", job.ID, strings.Join(args, " "))
+	publishEvent("image_job", job.vm, snapshot)
+	go runImageJob(job, stdout, &stderr)
+	return &snapshot, nil
+}
+
+func runImageJob(job *ImageJob, stdout io.Reader, stderr *bytes.Buffer) {
+	var output []string
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanProgress)
+	last := time.Now()
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := qemuImgProgressRegex.FindStringSubmatch(line); m != nil {
+			pct, _ := strconv.ParseFloat(m[1], 64)
+			imageJobsMu.Lock()
+			job.Progress = pct
+			snapshot := *job
+			imageJobsMu.Unlock()
+			if time.Since(last) >= progressInterval {
+				last = time.Now()
+				publishEvent("image_job", job.vm, snapshot)
+			}
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			output = append(output, strings.TrimSpace(line))
+		}
+	}
+	err := job.cmd.Wait()
+
+	if err == nil && job.Op == "compact" {
+		err = os.Rename(job.Output, job.Path)
+	}
+
+	imageJobsMu.Lock()
+	job.FinishedAt = time.Now().Format("2006-01-02 15:04:05")
+	job.Result = strings.Join(output, "\n")
+	switch {
+	case job.cancelled:
+		job.Status = "cancelled"
+	case err != nil:
+		job.Status = "failed"
+		job.Error = strings.TrimSpace(stderr.String())
+		if job.Error == "" {
+			job.Error = err.Error()
+		}
+	default:
+		job.Status = "done"
+		job.Progress = 100
+	}
+	snapshot := *job
+	imageJobsMu.Unlock()
+
+	if snapshot.Status != "done" && (job.Op == "compact" || job.Op == "convert") {
+		os.Remove(job.Output)
+	}
+	log.Printf("Image job %s (%s %s) %s", job.ID, job.Op, job.Path, snapshot.Status)
+	publishEvent("image_job", job.vm, snapshot)
+}
+
+// imageJobBusy reports whether a running job reads or writes path.
+func imageJobBusy(path string) bool {
+	imageJobsMu.Lock()
+	defer imageJobsMu.Unlock()
+	return imageJobBusyLocked(path)
+}
+
+func imageJobBusyLocked(path string) bool {
+	path = filepath.Clean(path)
+	for _, job := range imageJobs {
+		if job.Status == "running" && (filepath.Clean(job.Path) == path || (job.Output != "" && filepath.Clean(job.Output) == path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneImageJobs drops the oldest finished jobs beyond
+// maxFinishedImageJobs. Running jobs are always kept.
+func pruneImageJobs() {
+	var finished []int
+	for id, job := range imageJobs {
+		if job.Status != "running" {
+			n, _ := strconv.Atoi(id)
+			finished = append(finished, n)
+		}
+	}
+	if len(finished) <= maxFinishedImageJobs {
+		return
+	}
+	sort.Ints(finished)
+	for _, n := range finished[:len(finished)-maxFinishedImageJobs] {
+		delete(imageJobs, strconv.Itoa(n))
+	}
+}
+
+func cancelImageJob(id string) error {
+	imageJobsMu.Lock()
+	defer imageJobsMu.Unlock()
+	job := imageJobs[id]
+	if job == nil {
+		return statusErrorf(http.StatusNotFound, "image job not found: %s", id)
+	}
+	if job.Status != "running" {
+		return statusErrorf(http.StatusConflict, "image job %s is %s", id, job.Status)
+	}
+	job.cancelled = true
+	return job.cmd.Process.Kill()
+}
+
+func listImageJobs() []ImageJob {
+	imageJobsMu.Lock()
+	defer imageJobsMu.Unlock()
+	jobs := []ImageJob{}
+	for _, job := range imageJobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		a, _ := strconv.Atoi(jobs[i].ID)
+		b, _ := strconv.Atoi(jobs[j].ID)
+		return a > b
+	})
+	return jobs
+}
+
+// handleImageJobs serves /api/images/jobs and /api/images/jobs/{id}[/cancel].
+func handleImageJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !strings.HasPrefix(r.URL.Path, "/api/images/jobs") {
+		http.NotFound(w, r)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/images/jobs"), "/")
+
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(listImageJobs())
+		case http.MethodPost:
+			var req ImageJobRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+				return
+			}
+			configMu.Lock()
+			job, err := startImageJob(req)
+			configMu.Unlock()
+			if err != nil {
+				legacyError(w, r, err)
+				return
+			}
+			json.NewEncoder(w).Encode(job)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if strings.HasSuffix(rest, "/cancel") {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimSuffix(rest, "/cancel")
+		if err := cancelImageJob(id); err != nil {
+			legacyError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "cancelling", "id": id})
+		return
+	}
+
+	imageJobsMu.Lock()
+	job := imageJobs[rest]
+	var snapshot ImageJob
+	if job != nil {
+		snapshot = *job
+	}
+	imageJobsMu.Unlock()
+	if job == nil {
+		legacyError(w, r, statusErrorf(http.StatusNotFound, "image job not found: %s", rest))
+		return
+	}
+	json.NewEncoder(w).Encode(snapshot)
+}
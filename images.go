@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// qemuImgInfo is one element of `qemu-img info --output=json --backing-chain`.
+type qemuImgInfo struct {
+	Filename            string `json:"filename"`
+	Format              string `json:"format"`
+	VirtualSize         int64  `json:"virtual-size"`
+	ActualSize          int64  `json:"actual-size"`
+	Encrypted           bool   `json:"encrypted"`
+	BackingFilename     string `json:"backing-filename"`
+	FullBackingFilename string `json:"full-backing-filename"`
+	Snapshots           []struct {
+		ID          string `json:"id"`
+		Name        string `json:"name"`
+		VMStateSize int64  `json:"vm-state-size"`
+		DateSec     int64  `json:"date-sec"`
+		VMClockSec  int64  `json:"vm-clock-sec"`
+	} `json:"snapshots"`
+	FormatSpecific struct {
+		Type string `json:"type"`
+		Data struct {
+			Bitmaps []ImageBitmap `json:"bitmaps"`
+			Encrypt *struct {
+				Format string `json:"format"`
+			} `json:"encrypt"`
+		} `json:"data"`
+	} `json:"format-specific"`
+}
+
+type ImageSnapshot struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize int64  `json:"vm_state_size"`
+	Date        int64  `json:"date"`     // unix seconds
+	VMClock     int64  `json:"vm_clock"` // guest seconds
+}
+
+type ImageBitmap struct {
+	Name        string   `json:"name"`
+	Granularity int64    `json:"granularity"`
+	Flags       []string `json:"flags,omitempty"`
+}
+
+// ImageLayer is one file in a disk's backing chain, top layer first.
+type ImageLayer struct {
+	Filename    string          `json:"filename"`
+	Format      string          `json:"format"`
+	VirtualSize int64           `json:"virtual_size"`
+	ActualSize  int64           `json:"actual_size"`
+	BackingFile string          `json:"backing_file,omitempty"`
+	Encrypted   bool            `json:"encrypted,omitempty"`
+	Encryption  string          `json:"encryption,omitempty"` // e.g. "luks"
+	Snapshots   []ImageSnapshot `json:"snapshots,omitempty"`
+	Bitmaps     []ImageBitmap   `json:"bitmaps,omitempty"`
+
+	backingName string // as recorded in the image, possibly relative
+}
+
+// DiskImage is a disk attached to a configured or running VM.
+type DiskImage struct {
+	VM      string       `json:"vm"`
+	Path    string       `json:"path"`
+	Running bool         `json:"running"`
+	Chain   []ImageLayer `json:"chain,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// resolveVMPath resolves a path from vms.json against the VM's working_dir,
+// which is where QEMU is launched.
+func resolveVMPath(vm *VMConfig, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(vm.WorkingDir, path)
+}
+
+// instanceDiskPath makes a disk path from a running QEMU command line
+// absolute, using the VM's working_dir or else the process's cwd.
+func instanceDiskPath(inst QEMUInstance, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if vm := findVMConfig(inst.Name); vm != nil {
+		return resolveVMPath(vm, path)
+	}
+	if cwd, err := os.Readlink(filepath.Join("/proc", inst.PID, "cwd")); err == nil {
+		return filepath.Join(cwd, path)
+	}
+	return path
+}
+
+// imageInfo runs qemu-img info over the whole backing chain of path. Images
+// in use by QEMU hold a write lock, so they are opened with -U.
+func imageInfo(path string, inUse bool) ([]ImageLayer, error) {
+	args := []string{"info", "--output=json", "--backing-chain"}
+	if inUse {
+		args = append(args, "-U")
+	}
+	args = append(args, path)
+	return runImageInfo(exec.Command(qemuCommand("qemu-img"), args...))
+}
+
+// runImageInfo runs a qemu-img info --output=json --backing-chain command
+// and parses its output.
+func runImageInfo(cmd *exec.Cmd) ([]ImageLayer, error) {
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("qemu-img info failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+
+	var infos []qemuImgInfo
+	if err := json.Unmarshal(output, &infos); err != nil {
+		return nil, fmt.Errorf("failed to parse qemu-img output: %v", err)
+	}
+
+	chain := []ImageLayer{}
+	for _, info := range infos {
+		layer := ImageLayer{
+			Filename:    info.Filename,
+			Format:      info.Format,
+			VirtualSize: info.VirtualSize,
+			ActualSize:  info.ActualSize,
+			BackingFile: info.FullBackingFilename,
+			Encrypted:   info.Encrypted,
+			Bitmaps:     info.FormatSpecific.Data.Bitmaps,
+			backingName: info.BackingFilename,
+		}
+		if layer.BackingFile == "" {
+			layer.BackingFile = info.BackingFilename
+		}
+		if enc := info.FormatSpecific.Data.Encrypt; enc != nil {
+			layer.Encrypted = true
+			layer.Encryption = enc.Format
+		}
+		for _, s := range info.Snapshots {
+			layer.Snapshots = append(layer.Snapshots, ImageSnapshot{
+				ID:          s.ID,
+				Name:        s.Name,
+				VMStateSize: s.VMStateSize,
+				Date:        s.DateSec,
+				VMClock:     s.VMClockSec,
+			})
+		}
+		chain = append(chain, layer)
+	}
+	return chain, nil
+}
+
+// listDiskImages inspects the disks of every configured VM plus any other
+// disks found on running QEMU command lines, optionally only for one VM.
+func listDiskImages(name string) []DiskImage {
+	running := map[string]bool{}
+	for _, inst := range currentInstances() {
+		running[inst.Name] = true
+	}
+
+	disks := []DiskImage{}
+	seen := map[string]bool{}
+	configMu.Lock()
+	for i := range vmsConfig.VMs {
+		vm := &vmsConfig.VMs[i]
+		if vm.Disk == "" {
+			continue
+		}
+		path := resolveVMPath(vm, vm.Disk)
+		seen[path] = true
+		disks = append(disks, DiskImage{VM: vm.Name, Path: path, Running: running[vm.Name]})
+	}
+	for _, inst := range currentInstances() {
+		for _, disk := range inst.Disks {
+			path := instanceDiskPath(inst, disk)
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			disks = append(disks, DiskImage{VM: inst.Name, Path: path, Running: true})
+		}
+	}
+	configMu.Unlock()
+
+	if name != "" {
+		filtered := []DiskImage{}
+		for _, d := range disks {
+			if d.VM == name {
+				filtered = append(filtered, d)
+			}
+		}
+		disks = filtered
+	}
+
+	for i := range disks {
+		chain, err := imageInfo(disks[i].Path, disks[i].Running)
+		if err != nil {
+			disks[i].Error = err.Error()
+			continue
+		}
+		disks[i].Chain = chain
+	}
+	sort.SliceStable(disks, func(i, j int) bool { return disks[i].VM < disks[j].VM })
+	return disks
+}
+
+// ImageList is the body of GET /api/images.
+type ImageList struct {
+	Images []DiskImage `json:"images"`
+}
+
+func handleImages(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	p := principalFrom(r)
+	disks := []DiskImage{}
+	for _, d := range listDiskImages(r.URL.Query().Get("vm")) {
+		if p.allowsVM(d.VM) {
+			disks = append(disks, d)
+		}
+	}
+	json.NewEncoder(w).Encode(ImageList{Images: disks})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ImpairmentProfile is a named set of netem/tbf parameters.
+type ImpairmentProfile struct {
+	Name         string  `json:"name"`
+	DelayMs      int     `json:"delay_ms,omitempty"`
+	JitterMs     int     `json:"jitter_ms,omitempty"`
+	LossPct      float64 `json:"loss_pct,omitempty"`
+	DuplicatePct float64 `json:"duplicate_pct,omitempty"`
+	CorruptPct   float64 `json:"corrupt_pct,omitempty"`
+	ReorderPct   float64 `json:"reorder_pct,omitempty"`
+	RateKbit     int     `json:"rate_kbit,omitempty"`
+}
+
+var (
+	impairmentsMu      sync.Mutex
+	appliedImpairments = map[string]map[string]string{} // vm -> netdev -> profile
+)
+
+func findImpairmentProfile(name string) *ImpairmentProfile {
+	for i := range vmsConfig.ImpairmentProfiles {
+		if vmsConfig.ImpairmentProfiles[i].Name == name {
+			return &vmsConfig.ImpairmentProfiles[i]
+		}
+	}
+	return nil
+}
+
+func formatPct(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64) + "%"
+}
+
+// netemArgs renders the netem part of a profile.
+func netemArgs(p *ImpairmentProfile) []string {
+	args := []string{}
+	if p.DelayMs > 0 {
+		args = append(args, "delay", fmt.Sprintf("%dms", p.DelayMs))
+		if p.JitterMs > 0 {
+			args = append(args, fmt.Sprintf("%dms", p.JitterMs), "distribution", "normal")
+		}
+	}
+	if p.LossPct > 0 {
+		args = append(args, "loss", formatPct(p.LossPct))
+	}
+	if p.DuplicatePct > 0 {
+		args = append(args, "duplicate", formatPct(p.DuplicatePct))
+	}
+	if p.CorruptPct > 0 {
+		args = append(args, "corrupt", formatPct(p.CorruptPct))
+	}
+	if p.ReorderPct > 0 && p.DelayMs > 0 {
+		args = append(args, "reorder", formatPct(p.ReorderPct))
+	}
+	return args
+}
+
+func runTC(args ...string) error {
+	if helperAvailable() {
+		_, err := callHelper(helperRequest{Op: "tc", Args: args})
+		return err
+	}
+	output, err := privilegedCommand("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s failed: %v - %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// applyImpairment installs a netem root qdisc (with a tbf child for rate
+// limiting) on the NIC's host-side tap, or clears it for an empty profile.
+func applyImpairment(name, netdev, profile string) error {
+	if runtime.GOOS != "linux" {
+		return statusError(http.StatusNotImplemented, "network impairment requires tc on Linux")
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	vm := findVMConfig(name)
+	if vm == nil {
+		return newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	if !isRunning(name) {
+		return newAPIError(http.StatusConflict, "not_running", "VM is not running: %s", name)
+	}
+	var ifname string
+	for _, net := range vm.Networks {
+		if net.ID == netdev {
+			ifname = nicIfname(vm.Name, net)
+			if ifname == "" {
+				return statusErrorf(http.StatusConflict, "netdev %s has no host tap interface", netdev)
+			}
+		}
+	}
+	if ifname == "" {
+		return newAPIError(http.StatusNotFound, "not_found", "netdev not found: %s", netdev)
+	}
+
+	if profile == "" || profile == "none" {
+		// Deleting a missing qdisc fails; that is fine when clearing
+		runTC("qdisc", "del", "dev", ifname, "root")
+		impairmentsMu.Lock()
+		delete(appliedImpairments[name], netdev)
+		impairmentsMu.Unlock()
+		log.Printf("Cleared impairment on %s/%s (%s)", name, netdev, ifname)
+		publishEvent("impairment_changed", name, map[string]string{"netdev": netdev, "profile": ""})
+		return nil
+	}
+
+	p := findImpairmentProfile(profile)
+	if p == nil {
+		return statusErrorf(http.StatusNotFound, "impairment profile not found: %s", profile)
+	}
+
+	netem := append([]string{"qdisc", "replace", "dev", ifname, "root", "handle", "1:", "netem"}, netemArgs(p)...)
+	if err := runTC(netem...); err != nil {
+		return err
+	}
+	if p.RateKbit > 0 {
+		burst := p.RateKbit / 8
+		if burst < 32 {
+			burst = 32
+		}
+		err := runTC("qdisc", "replace", "dev", ifname, "parent", "1:1", "handle", "10:", "tbf",
+			"rate", fmt.Sprintf("%dkbit", p.RateKbit),
+			"burst", fmt.Sprintf("%dkbit", burst),
+			"latency", "400ms")
+		if err != nil {
+			runTC("qdisc", "del", "dev", ifname, "root")
+			return err
+		}
+	}
+
+	impairmentsMu.Lock()
+	if appliedImpairments[name] == nil {
+		appliedImpairments[name] = map[string]string{}
+	}
+	appliedImpairments[name][netdev] = profile
+	impairmentsMu.Unlock()
+
+	log.Printf("Applied impairment %s to %s/%s (%s)", profile, name, netdev, ifname)
+	publishEvent("impairment_changed", name, map[string]string{"netdev": netdev, "profile": profile})
+	return nil
+}
+
+// trackImpairments drops state for VMs that are gone and reports the
+// applied profile and tap interface on each instance NIC.
+func trackImpairments(instances []QEMUInstance) {
+	impairmentsMu.Lock()
+	defer impairmentsMu.Unlock()
+
+	running := map[string]bool{}
+	for i := range instances {
+		inst := &instances[i]
+		running[inst.Name] = true
+		vm := findVMConfig(inst.Name)
+		if vm == nil {
+			continue
+		}
+		for j := range inst.Networks {
+			net := &inst.Networks[j]
+			for _, cfg := range vm.Networks {
+				if cfg.ID == net.ID {
+					net.Ifname = nicIfname(vm.Name, cfg)
+				}
+			}
+			net.Impairment = appliedImpairments[inst.Name][net.ID]
+		}
+	}
+	for name := range appliedImpairments {
+		if !running[name] {
+			delete(appliedImpairments, name)
+		}
+	}
+}
+
+func handleImpairmentProfiles(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	configMu.Lock()
+	profiles := vmsConfig.ImpairmentProfiles
+	configMu.Unlock()
+	if profiles == nil {
+		profiles = []ImpairmentProfile{}
+	}
+	json.NewEncoder(w).Encode(profiles)
+}
+
+func handleImpairment(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Netdev  string `json:"netdev"`
+		Profile string `json:"profile"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Netdev == "" {
+		legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+		return
+	}
+
+	if err := applyImpairment(name, req.Netdev, req.Profile); err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "applied", "name": name, "netdev": req.Netdev, "profile": req.Profile})
+}
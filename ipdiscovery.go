@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResolvedAddress is a guest IP found for a NIC, with where and when it was
+// last observed.
+type ResolvedAddress struct {
+	IP       string `json:"ip"`
+	Source   string `json:"source"` // "arp", "dhcp-lease" or "qga"
+	LastSeen string `json:"last_seen"`
+}
+
+const addressTTL = time.Hour
+
+var (
+	// DHCP lease files checked for guest addresses. bootpd is used by
+	// macOS vmnet, dnsmasq by libvirt and most Linux bridge setups.
+	leaseFiles = []string{
+		"/var/db/dhcpd_leases",
+		"/var/lib/misc/dnsmasq.leases",
+		"/var/lib/dnsmasq/dnsmasq.leases",
+	}
+
+	addressCacheMu sync.Mutex
+	addressCache   = map[string]map[string]*observedAddress{} // mac -> ip -> observation
+)
+
+type observedAddress struct {
+	source   string
+	lastSeen time.Time
+}
+
+// normalizeMAC lowercases a MAC and zero-pads each octet, since macOS arp
+// prints 52:54:0:2d:6e:99 for 52:54:00:2d:6e:99.
+func normalizeMAC(mac string) string {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(mac)), ":")
+	if len(parts) != 6 {
+		return strings.ToLower(mac)
+	}
+	for i, p := range parts {
+		if len(p) == 1 {
+			parts[i] = "0" + p
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+func observeAddress(mac, ip, source string, seen time.Time) {
+	mac = normalizeMAC(mac)
+	if mac == "" || ip == "" {
+		return
+	}
+	addressCacheMu.Lock()
+	defer addressCacheMu.Unlock()
+	if addressCache[mac] == nil {
+		addressCache[mac] = map[string]*observedAddress{}
+	}
+	addressCache[mac][ip] = &observedAddress{source: source, lastSeen: seen}
+}
+
+var arpLineRegex = regexp.MustCompile(`\((\d+\.\d+\.\d+\.\d+)\) at ([0-9a-fA-F:]+)`)
+
+// scanARPTable records neighbours from the host ARP table.
+func scanARPTable(now time.Time) {
+	if runtime.GOOS == "linux" {
+		scanProcNetARP(now)
+		return
+	}
+
+	output, err := exec.Command("arp", "-an").Output()
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if match := arpLineRegex.FindStringSubmatch(line); len(match) > 2 {
+			observeAddress(match[2], match[1], "arp", now)
+		}
+	}
+}
+
+func scanProcNetARP(now time.Time) {
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// IP address, HW type, Flags, HW address, Mask, Device
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		observeAddress(fields[3], fields[0], "arp", now)
+	}
+}
+
+// scanLeaseFiles records active leases from bootpd and dnsmasq lease files.
+func scanLeaseFiles(now time.Time) {
+	for _, path := range leaseFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if strings.Contains(string(data), "hw_address=") {
+			parseBootpdLeases(string(data), now)
+		} else {
+			parseDnsmasqLeases(string(data), now)
+		}
+	}
+}
+
+// parseBootpdLeases handles macOS /var/db/dhcpd_leases blocks:
+//
+//	{
+//		ip_address=192.168.64.5
+//		hw_address=1,52:54:0:2d:6e:99
+//		lease=0x6712a3f0
+//	}
+func parseBootpdLeases(data string, now time.Time) {
+	var ip, mac string
+	var expiry int64
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "{":
+			ip, mac, expiry = "", "", 0
+		case strings.HasPrefix(line, "ip_address="):
+			ip = strings.TrimPrefix(line, "ip_address=")
+		case strings.HasPrefix(line, "hw_address="):
+			hw := strings.TrimPrefix(line, "hw_address=")
+			if i := strings.Index(hw, ","); i >= 0 {
+				hw = hw[i+1:]
+			}
+			mac = hw
+		case strings.HasPrefix(line, "lease="):
+			expiry, _ = strconv.ParseInt(strings.TrimPrefix(line, "lease="), 0, 64)
+		case line == "}":
+			if expiry == 0 || time.Unix(expiry, 0).After(now) {
+				observeAddress(mac, ip, "dhcp-lease", now)
+			}
+		}
+	}
+}
+
+// parseDnsmasqLeases handles "<expiry> <mac> <ip> <hostname> <client-id>" lines.
+func parseDnsmasqLeases(data string, now time.Time) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		expiry, _ := strconv.ParseInt(fields[0], 10, 64)
+		if expiry != 0 && time.Unix(expiry, 0).Before(now) {
+			continue
+		}
+		observeAddress(fields[1], fields[2], "dhcp-lease", now)
+	}
+}
+
+// scanGuestAgentAddresses records addresses reported by qemu-guest-agent.
+func scanGuestAgentAddresses(now time.Time) {
+	guestInfoMu.Lock()
+	defer guestInfoMu.Unlock()
+	for _, info := range guestInfo {
+		if info.Error != "" {
+			continue
+		}
+		for _, iface := range info.Interfaces {
+			for _, addr := range iface.IPAddresses {
+				if addr.Type == "ipv4" {
+					observeAddress(iface.MAC, addr.Address, "qga", now)
+				}
+			}
+		}
+	}
+}
+
+// addressesForMAC returns the unexpired addresses known for a MAC, newest first.
+func addressesForMAC(mac string, now time.Time) []ResolvedAddress {
+	addressCacheMu.Lock()
+	defer addressCacheMu.Unlock()
+
+	mac = normalizeMAC(mac)
+	addrs := []ResolvedAddress{}
+	for ip, obs := range addressCache[mac] {
+		if now.Sub(obs.lastSeen) > addressTTL {
+			delete(addressCache[mac], ip)
+			continue
+		}
+		addrs = append(addrs, ResolvedAddress{
+			IP:       ip,
+			Source:   obs.source,
+			LastSeen: obs.lastSeen.Format("2006-01-02 15:04:05"),
+		})
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].LastSeen > addrs[j].LastSeen })
+	return addrs
+}
+
+// resolveInstanceAddresses refreshes the address sources and fills in
+// Addresses for every NIC of the given instances.
+func resolveInstanceAddresses(instances []QEMUInstance) {
+	now := time.Now()
+	scanARPTable(now)
+	scanLeaseFiles(now)
+	scanGuestAgentAddresses(now)
+
+	for i := range instances {
+		for j := range instances[i].Networks {
+			net := &instances[i].Networks[j]
+			// user-mode NICs sit behind slirp NAT and are only reachable
+			// through host port forwards
+			if net.Type == "user" {
+				continue
+			}
+			net.Addresses = addressesForMAC(net.MAC, now)
+		}
+	}
+}
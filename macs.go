@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strings"
+)
+
+// qemuOUI is the locally administered prefix QEMU uses for its own NICs.
+const qemuOUI = "52:54:00"
+
+// derivedMAC returns a stable MAC for a NIC inside the QEMU OUI, so
+// re-adding a VM or NIC under the same names keeps its DHCP leases.
+func derivedMAC(vmName, netdev string) string {
+	sum := crc32.ChecksumIEEE([]byte(vmName + "/" + netdev))
+	return fmt.Sprintf("%s:%02x:%02x:%02x", qemuOUI, byte(sum>>16), byte(sum>>8), byte(sum))
+}
+
+// deriveMACs fills in the MAC of every NIC that has none in vms.json.
+func deriveMACs() {
+	for i := range vmsConfig.VMs {
+		vm := &vmsConfig.VMs[i]
+		for j := range vm.Networks {
+			net := &vm.Networks[j]
+			if net.macDerived {
+				net.MAC, net.macDerived = "", false
+			}
+			if net.MAC == "" {
+				net.MAC = derivedMAC(vm.Name, net.ID)
+				net.macDerived = true
+			}
+		}
+	}
+}
+
+// validMAC reports whether mac parses and is a unicast address, which is
+// all QEMU accepts for a NIC.
+func validMAC(mac string) bool {
+	hw, err := net.ParseMAC(mac)
+	return err == nil && len(hw) == 6 && hw[0]&1 == 0
+}
+
+// macOwners maps each MAC to the NICs using it, as "vm/netdev", taken from
+// the config and from the running instances.
+func macOwners(instances []QEMUInstance) map[string][]string {
+	owners := map[string][]string{}
+	add := func(mac, owner string) {
+		mac = normalizeMAC(mac)
+		for _, o := range owners[mac] {
+			if o == owner {
+				return
+			}
+		}
+		owners[mac] = append(owners[mac], owner)
+	}
+
+	for _, vm := range vmsConfig.VMs {
+		for _, net := range vm.Networks {
+			add(net.MAC, vm.Name+"/"+net.ID)
+		}
+	}
+	for _, inst := range instances {
+		for i, net := range inst.Networks {
+			id := net.ID
+			if id == "" {
+				id = fmt.Sprintf("nic%d", i)
+			}
+			add(net.MAC, inst.Name+"/"+id)
+		}
+	}
+	return owners
+}
+
+// macConflicts lists invalid MACs in the config and MACs shared by more
+// than one NIC across the config and all running QEMU processes.
+func macConflicts() []string {
+	conflicts := []string{}
+	for _, vm := range vmsConfig.VMs {
+		for _, net := range vm.Networks {
+			if !validMAC(net.MAC) {
+				conflicts = append(conflicts, fmt.Sprintf("VM %s netdev %s has invalid MAC %q", vm.Name, net.ID, net.MAC))
+			}
+		}
+	}
+
+	owners := macOwners(currentInstances())
+	macs := make([]string, 0, len(owners))
+	for mac := range owners {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	for _, mac := range macs {
+		if len(owners[mac]) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("MAC %s is used by %s", mac, strings.Join(owners[mac], ", ")))
+		}
+	}
+	return conflicts
+}
+
+// checkMACConflicts refuses to launch a VM whose NICs share a MAC with any
+// other configured or running NIC.
+func checkMACConflicts(vm *VMConfig) error {
+	owners := macOwners(currentInstances())
+	for _, net := range vm.Networks {
+		if !validMAC(net.MAC) {
+			return fmt.Errorf("netdev %s has invalid MAC %q", net.ID, net.MAC)
+		}
+		self := vm.Name + "/" + net.ID
+		for _, owner := range owners[normalizeMAC(net.MAC)] {
+			if owner != self {
+				return fmt.Errorf("MAC %s of %s is also used by %s", net.MAC, net.ID, owner)
+			}
+		}
+	}
+	return nil
+}
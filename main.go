@@ -1,7 +1,9 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -9,12 +11,13 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type QEMUInstance struct {
+	ID           string    `json:"id"` // "<pid>-<start time>", survives PID reuse
 	PID          string    `json:"pid"`
 	PPID         string    `json:"ppid"`
 	User         string    `json:"user"`
@@ -23,35 +26,60 @@ type QEMUInstance struct {
 	Memory       string    `json:"memory"`
 	CPUCount     string    `json:"cpu_count"`
 	DiskImage    string    `json:"disk_image"`
+	Disks        []string  `json:"disks,omitempty"` // every file= on the command line
 	Name         string    `json:"name"`
 	Machine      string    `json:"machine"`
 	Networks     []Network `json:"networks"`
 	Type         string    `json:"type"` // "multipass" or "custom"
 	Status       string    `json:"status"`
 	Uptime       string    `json:"uptime"`
+	CPUPercent   float64   `json:"cpu_percent"` // of one core, since the last refresh
+	RSS          int64     `json:"rss"`         // resident memory in bytes
+
+	// Populated from qemu-guest-agent when enabled for the VM
+	GuestHostname string   `json:"guest_hostname,omitempty"`
+	GuestOS       string   `json:"guest_os,omitempty"`
+	GuestIPs      []string `json:"guest_ips,omitempty"`
+
+	Forwards []LiveForward `json:"forwards,omitempty"`
 }
 
 type Network struct {
-	Type string `json:"type"`
-	MAC  string `json:"mac"`
+	Type       string            `json:"type"`
+	ID         string            `json:"id,omitempty"`
+	MAC        string            `json:"mac"`
+	Addresses  []ResolvedAddress `json:"addresses,omitempty"`
+	Ifname     string            `json:"ifname,omitempty"`
+	Impairment string            `json:"impairment,omitempty"`
 }
 
 type Response struct {
 	Instances   []QEMUInstance `json:"instances"`
 	Count       int            `json:"count"`
 	LastUpdated string         `json:"last_updated"`
+	Conflicts   []string       `json:"conflicts,omitempty"`
+	LeakedTaps  []string       `json:"leaked_taps,omitempty"`
 }
 
 type VMNetwork struct {
 	Type         string        `json:"type"`
 	ID           string        `json:"id"`
-	MAC          string        `json:"mac"`
+	MAC          string        `json:"mac,omitempty"` // derived from VM name and id when empty
 	PortForwards []PortForward `json:"port_forwards,omitempty"`
+	Segment      string        `json:"segment,omitempty"` // attach to a named virtual LAN instead of Type
+	Ifname       string        `json:"ifname,omitempty"`  // host-side interface for tap-backed NICs
+	Bridge       string        `json:"bridge,omitempty"`  // bridge to attach a tap/bridge NIC to
+	MTU          int           `json:"mtu,omitempty"`
+
+	macDerived bool
 }
 
+// PortForward is (un)marshalled by hand in ports.go so Host can be "auto"
 type PortForward struct {
-	Host  int `json:"host"`
-	Guest int `json:"guest"`
+	Host     int
+	Guest    int
+	Protocol string // "tcp" (default) or "udp"
+	Auto     bool
 }
 
 type VMConfig struct {
@@ -65,17 +93,52 @@ type VMConfig struct {
 	SSHPort    *int        `json:"ssh_port"`
 	HTTPPort   *int        `json:"http_port"`
 	WorkingDir string      `json:"working_dir"`
+	GuestAgent bool        `json:"guest_agent,omitempty"`
+	Parent     string      `json:"parent,omitempty"` // VM whose disk backs this one (linked clones)
+
+	// Live backup schedule and retention, see backups.go
+	Backup *BackupPolicy `json:"backup,omitempty"`
+
+	// Credentials used by the monitor's own SSH/SFTP connections
+	SSHUser     string `json:"ssh_user,omitempty"`
+	SSHPassword string `json:"ssh_password,omitempty"`
+	SSHKey      string `json:"ssh_key,omitempty"`
+
+	// Set when ssh_port/http_port were derived from port_forwards, so they
+	// are not written back to vms.json
+	sshPortDerived  bool
+	httpPortDerived bool
+
+	// Set by the privileged helper for a launch: the -drive for the disk
+	// chain it opened, the fd set of each of those files, and the fds
+	// QEMU's chardev sockets listen on
+	diskDrive  string
+	diskFDSets []int
+	socketFDs  map[string]int
 }
 
 type VMsConfig struct {
-	VMs []VMConfig `json:"vms"`
+	VMs       []VMConfig `json:"vms"`
+	PortRange *PortRange `json:"port_range,omitempty"`
+	Segments  []Segment  `json:"segments,omitempty"`
+
+	ImpairmentProfiles []ImpairmentProfile `json:"impairment_profiles,omitempty"`
 }
 
 var (
+	// instancesMu guards cachedInstances and lastUpdate. A new listing
+	// replaces the slice rather than editing it, so a reader can keep the
+	// one it got from currentInstances.
+	instancesMu     sync.Mutex
 	cachedInstances []QEMUInstance
 	lastUpdate      time.Time
 	vmsConfig       VMsConfig
 	configPath      = "vms.json"
+
+	// configMu guards vmsConfig once the server runs. findVMConfig and
+	// everything that walks the config are called with it held; other
+	// code works on copies from lookupVM or configuredVMs.
+	configMu sync.Mutex
 )
 
 func parseQEMUProcess(fields []string, cmdline string) QEMUInstance {
@@ -130,6 +193,15 @@ func parseQEMUProcess(fields []string, cmdline string) QEMUInstance {
 		instance.Name = strings.TrimSuffix(instance.DiskImage, ".qcow2")
 	}
 
+	// Extract all disk files for image inspection
+	driveRegex := regexp.MustCompile(`-drive\s+(?:[^\s]*,)?file=([^,\s]+)`)
+	for _, match := range driveRegex.FindAllStringSubmatch(cmdline, -1) {
+		// Chains the helper passes as fd sets have no path to inspect
+		if !strings.HasPrefix(match[1], "json:") {
+			instance.Disks = append(instance.Disks, match[1])
+		}
+	}
+
 	// Extract machine type
 	machineRegex := regexp.MustCompile(`-machine\s+([^,\s]+)`)
 	if match := machineRegex.FindStringSubmatch(cmdline); len(match) > 1 {
@@ -137,8 +209,8 @@ func parseQEMUProcess(fields []string, cmdline string) QEMUInstance {
 	}
 
 	// Extract networks
-	macRegex := regexp.MustCompile(`mac=([0-9a-f:]+)`)
-	netTypeRegex := regexp.MustCompile(`-netdev\s+([^,]+)`)
+	macRegex := regexp.MustCompile(`mac=([0-9a-fA-F:]+)`)
+	netTypeRegex := regexp.MustCompile(`-netdev\s+([^,\s]+)(?:,id=([^,\s]+))?`)
 	
 	macMatches := macRegex.FindAllStringSubmatch(cmdline, -1)
 	netTypeMatches := netTypeRegex.FindAllStringSubmatch(cmdline, -1)
@@ -147,6 +219,7 @@ func parseQEMUProcess(fields []string, cmdline string) QEMUInstance {
 		net := Network{MAC: match[1]}
 		if i < len(netTypeMatches) {
 			net.Type = netTypeMatches[i][1]
+			net.ID = netTypeMatches[i][2]
 		}
 		instance.Networks = append(instance.Networks, net)
 	}
@@ -177,7 +250,7 @@ func getQEMUInstances() ([]QEMUInstance, error) {
 	instances := []QEMUInstance{}
 
 	for _, line := range lines {
-		if !strings.Contains(line, "qemu-system-aarch64") || strings.Contains(line, "grep") {
+		if !strings.Contains(line, qemuProcessName()) || strings.Contains(line, "grep") {
 			continue
 		}
 
@@ -195,23 +268,33 @@ func getQEMUInstances() ([]QEMUInstance, error) {
 		}
 		
 		instance := parseQEMUProcess(fields, cmdline)
+		instance.ID = instanceID(instance.PID)
 		instances = append(instances, instance)
 	}
+	sampleProcessStats(instances)
 
 	return instances, nil
 }
 
 func updateInstances() {
-	ticker := time.NewTicker(5 * time.Second)
+	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
 	for {
+		listed := time.Now()
 		instances, err := getQEMUInstances()
 		if err != nil {
 			log.Printf("Error getting instances: %v", err)
 		} else {
-			cachedInstances = instances
-			lastUpdate = time.Now()
+			pollGuestAgents(instances)
+			resolveInstanceAddresses(instances)
+			trackRunStates(instances)
+			configMu.Lock()
+			trackLiveForwards(instances)
+			trackImpairments(instances)
+			reapTaps(instances, listed)
+			configMu.Unlock()
+			setInstances(instances)
 		}
 		<-ticker.C
 	}
@@ -226,7 +309,110 @@ func loadVMsConfig() error {
 		}
 		return err
 	}
-	return json.Unmarshal(data, &vmsConfig)
+	// A fresh value, since Unmarshal would merge into the old slices
+	var cfg VMsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return err
+	}
+	vmsConfig = cfg
+
+	loadPortAssignments()
+	allocatePorts()
+	deriveServicePorts()
+	deriveMACs()
+	for _, conflict := range configConflicts() {
+		log.Printf("Warning: %s", conflict)
+	}
+	return nil
+}
+
+// configConflicts collects every problem found in vms.json that would stop
+// VMs from launching or talking to each other. Called with configMu held
+// once the server runs.
+func configConflicts() []string {
+	conflicts := portConflicts()
+	conflicts = append(conflicts, segmentConflicts()...)
+	conflicts = append(conflicts, macConflicts()...)
+	conflicts = append(conflicts, backupConflicts()...)
+	return conflicts
+}
+
+// saveVMsConfig writes the config back to configPath. Values the monitor
+// fills in at load time (derived service ports and MACs, auto port
+// assignments) are left out so the file keeps the user's intent.
+func saveVMsConfig() error {
+	out := vmsConfig
+	out.VMs = nil
+	for _, vm := range vmsConfig.VMs {
+		if vm.sshPortDerived {
+			vm.SSHPort = nil
+		}
+		if vm.httpPortDerived {
+			vm.HTTPPort = nil
+		}
+		networks := make([]VMNetwork, len(vm.Networks))
+		for i, net := range vm.Networks {
+			if net.macDerived {
+				net.MAC = ""
+			}
+			net.PortForwards = append([]PortForward(nil), net.PortForwards...)
+			for j := range net.PortForwards {
+				if net.PortForwards[j].Auto {
+					net.PortForwards[j].Host = 0
+				}
+			}
+			networks[i] = net
+		}
+		vm.Networks = networks
+		out.VMs = append(out.VMs, vm)
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := configPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, configPath)
+}
+
+// lookupVM returns a copy of a VM's configuration, for code that does not
+// hold configMu while it works.
+func lookupVM(name string) (VMConfig, bool) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if vm := findVMConfig(name); vm != nil {
+		return copyVMConfig(vm), true
+	}
+	return VMConfig{}, false
+}
+
+// vmDefined reports whether vms.json has a VM of that name.
+func vmDefined(name string) bool {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return findVMConfig(name) != nil
+}
+
+// configuredVMs returns a copy of every VM's configuration.
+func configuredVMs() []VMConfig {
+	configMu.Lock()
+	defer configMu.Unlock()
+	vms := make([]VMConfig, len(vmsConfig.VMs))
+	for i := range vmsConfig.VMs {
+		vms[i] = copyVMConfig(&vmsConfig.VMs[i])
+	}
+	return vms
+}
+
+// copyVMConfig copies a VM's configuration deep enough that edits made
+// under configMu, such as persisted forwards, do not show through.
+func copyVMConfig(vm *VMConfig) VMConfig {
+	out := *vm
+	out.Networks = append([]VMNetwork(nil), vm.Networks...)
+	return out
 }
 
 func findVMConfig(name string) *VMConfig {
@@ -238,9 +424,38 @@ func findVMConfig(name string) *VMConfig {
 	return nil
 }
 
+// currentInstances returns the last listing of QEMU processes.
+func currentInstances() []QEMUInstance {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	return cachedInstances
+}
+
+// instancesSnapshot returns the last listing and when it was taken.
+func instancesSnapshot() ([]QEMUInstance, time.Time) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	return cachedInstances, lastUpdate
+}
+
+func setInstances(instances []QEMUInstance) {
+	instancesMu.Lock()
+	defer instancesMu.Unlock()
+	cachedInstances, lastUpdate = instances, time.Now()
+}
+
+func isRunning(name string) bool {
+	for _, inst := range currentInstances() {
+		if inst.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func buildQEMUCommand(vm *VMConfig) *exec.Cmd {
 	args := []string{
-		"qemu-system-aarch64",
+		qemuCommand(qemuBinary),
 		"-nographic",
 		"-accel", "hvf",
 		"-cpu", "cortex-a72",
@@ -249,15 +464,37 @@ func buildQEMUCommand(vm *VMConfig) *exec.Cmd {
 		"-smp", vm.CPUs,
 		"-m", vm.Memory,
 		"-device", "virtio-rng-pci",
-		"-drive", fmt.Sprintf("file=%s,format=qcow2,if=virtio", vm.Disk),
+	}
+	if vm.diskDrive != "" {
+		args = append(args, "-drive", vm.diskDrive)
+	} else {
+		args = append(args, "-drive", fmt.Sprintf("file=%s,format=qcow2,if=virtio", vm.Disk))
 	}
 
 	// Add networks
 	for _, net := range vm.Networks {
+		if net.Segment != "" {
+			netdevArg, err := segmentNetdevArg(vm, net)
+			if err != nil {
+				log.Printf("Skipping netdev %s: %v", net.ID, err)
+				continue
+			}
+			args = append(args, "-netdev", netdevArg)
+			args = append(args, "-device", fmt.Sprintf("virtio-net-pci,netdev=%s,mac=%s", net.ID, net.MAC))
+			continue
+		}
+
+		if isTapNetwork(net) {
+			netdevArg := fmt.Sprintf("tap,id=%s,ifname=%s,script=no,downscript=no", net.ID, nicIfname(vm.Name, net))
+			args = append(args, "-netdev", netdevArg)
+			args = append(args, "-device", fmt.Sprintf("virtio-net-pci,netdev=%s,mac=%s", net.ID, net.MAC))
+			continue
+		}
+
 		netdevArg := net.Type + ",id=" + net.ID
 		if net.Type == "user" && len(net.PortForwards) > 0 {
 			for _, pf := range net.PortForwards {
-				netdevArg += fmt.Sprintf(",hostfwd=tcp::%d-:%d", pf.Host, pf.Guest)
+				netdevArg += fmt.Sprintf(",hostfwd=%s::%d-:%d", forwardProtocol(pf.Protocol), pf.Host, pf.Guest)
 			}
 		}
 		args = append(args, "-netdev", netdevArg)
@@ -267,107 +504,295 @@ func buildQEMUCommand(vm *VMConfig) *exec.Cmd {
 	// Add name
 	args = append(args, "-name", vm.Name)
 
+	// Add qemu-guest-agent channel if enabled
+	if vm.GuestAgent {
+		args = append(args,
+			"-chardev", socketChardev(vm, "qga", qgaSocketPath(vm.Name)),
+			"-device", "virtio-serial",
+			"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+		)
+	}
+
 	// Add snapshot mode if enabled
 	if vm.Snapshot {
 		args = append(args, "-snapshot")
 	}
 
-	// Add serial
-	args = append(args, "-serial", "mon:stdio")
+	// Add QMP socket for runtime control
+	if _, ok := vm.socketFDs["qmp"]; ok {
+		args = append(args, "-chardev", socketChardev(vm, "qmp", ""), "-mon", "chardev=qmp0,mode=control")
+	} else {
+		args = append(args, "-qmp", fmt.Sprintf("unix:%s,server=on,wait=off", qmpSocketPath(vm.Name)))
+	}
+
+	// Add serial console; the monitor attaches to it on demand. The HMP
+	// monitor is deliberately not multiplexed on it: console users could
+	// reach it with Ctrl-A c and run host commands through migrate "exec:"
+	args = append(args,
+		"-chardev", socketChardev(vm, "serial", serialSocketPath(vm.Name)),
+		"-serial", "chardev:serial0",
+	)
 
-	cmd := exec.Command("sudo", args...)
+	cmd := exec.Command(args[0], args[1:]...)
 	if vm.WorkingDir != "" {
 		cmd.Dir = vm.WorkingDir
 	}
 	return cmd
 }
 
+// socketChardev is the -chardev of a listening socket, id <name>0: at path,
+// or on the fd the monitor passed in when the helper launches QEMU, so
+// the socket belongs to the monitor's user rather than root.
+func socketChardev(vm *VMConfig, name, path string) string {
+	if fd, ok := vm.socketFDs[name]; ok {
+		return fmt.Sprintf("socket,fd=%d,server=on,wait=off,id=%s0", fd, name)
+	}
+	return fmt.Sprintf("socket,path=%s,server=on,wait=off,id=%s0", path, name)
+}
+
+var (
+	qemuIDPattern    = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+	qemuMACPattern   = regexp.MustCompile(`^([0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}$`)
+	qemuSizePattern  = regexp.MustCompile(`^[0-9]+[KMGTkmgt]?$`)
+	qemuCountPattern = regexp.MustCompile(`^[0-9]+$`)
+
+	// Netdev types a NIC outside a segment may have
+	qemuNetdevTypes = map[string]bool{"user": true, "tap": true, "bridge": true, "vmnet-shared": true, "vmnet-host": true}
+)
+
+// checkQEMUArgs rejects a VM whose fields would add options to its QEMU
+// command line. QEMU splits option values on commas, so a field such as a
+// netdev type of "tap,script=..." would otherwise run a script, as root
+// when the VM needs privilege.
+func checkQEMUArgs(vm *VMConfig) error {
+	if vm.Name == "" || strings.ContainsAny(vm.Name, ",/") {
+		return fmt.Errorf("invalid VM name %q", vm.Name)
+	}
+	if !qemuCountPattern.MatchString(vm.CPUs) {
+		return fmt.Errorf("invalid cpus %q: must be a number", vm.CPUs)
+	}
+	if !qemuSizePattern.MatchString(vm.Memory) {
+		return fmt.Errorf("invalid memory %q: must be a size such as 4096 or 4G", vm.Memory)
+	}
+	for field, value := range map[string]string{"disk": vm.Disk, "bios": vm.BIOS} {
+		if strings.Contains(value, ",") {
+			return fmt.Errorf("%s path must not contain a comma: %s", field, value)
+		}
+	}
+	for _, net := range vm.Networks {
+		if !qemuIDPattern.MatchString(net.ID) {
+			return fmt.Errorf("invalid netdev id %q", net.ID)
+		}
+		if net.MAC != "" && !qemuMACPattern.MatchString(net.MAC) {
+			return fmt.Errorf("netdev %s has an invalid MAC %q", net.ID, net.MAC)
+		}
+		if net.Segment != "" {
+			if seg, _ := findSegment(net.Segment); seg != nil && strings.Contains(seg.Address+segmentVDEPath(seg), ",") {
+				return fmt.Errorf("segment %s address and path must not contain a comma", seg.Name)
+			}
+			continue
+		}
+		if !qemuNetdevTypes[net.Type] {
+			return fmt.Errorf("netdev %s has an unsupported type %q", net.ID, net.Type)
+		}
+		if strings.ContainsAny(net.Ifname+net.Bridge, ",/") {
+			return fmt.Errorf("netdev %s has an invalid ifname or bridge", net.ID)
+		}
+		for _, pf := range net.PortForwards {
+			if p := forwardProtocol(pf.Protocol); p != "tcp" && p != "udp" {
+				return fmt.Errorf("netdev %s has a forward with unsupported protocol %q", net.ID, pf.Protocol)
+			}
+		}
+	}
+	return nil
+}
+
 func startVM(name string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
 	vm := findVMConfig(name)
 	if vm == nil {
-		return fmt.Errorf("VM configuration not found: %s", name)
+		return newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
 	}
 
 	// Check if already running
-	for _, inst := range cachedInstances {
+	for _, inst := range currentInstances() {
 		if inst.Name == name {
-			return fmt.Errorf("VM already running with PID %s", inst.PID)
+			return newAPIError(http.StatusConflict, "already_running", "VM already running with PID %s", inst.PID).with("pid", inst.PID)
 		}
 	}
 
-	cmd := buildQEMUCommand(vm)
-	
-	// Start in background
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start VM: %v", err)
+	if err := checkQEMUArgs(vm); err != nil {
+		return newAPIError(http.StatusConflict, "start_blocked", "cannot start VM: %v", err)
 	}
 
-	log.Printf("Started VM %s with PID %d", name, cmd.Process.Pid)
-	return nil
-}
+	if err := checkPortConflicts(vm); err != nil {
+		return newAPIError(http.StatusConflict, "start_blocked", "cannot start VM: %v", err)
+	}
 
-func stopVM(pid string) error {
-	pidInt, err := strconv.Atoi(pid)
-	if err != nil {
-		return fmt.Errorf("invalid PID: %s", pid)
+	if err := checkMACConflicts(vm); err != nil {
+		return newAPIError(http.StatusConflict, "start_blocked", "cannot start VM: %v", err)
 	}
 
-	// First try graceful shutdown with SIGTERM
-	cmd := exec.Command("sudo", "kill", "-TERM", pid)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to stop VM (PID %d): %v - %s", pidInt, err, string(output))
+	if imageJobBusy(resolveVMPath(vm, vm.Disk)) {
+		return newAPIError(http.StatusConflict, "start_blocked", "cannot start VM: an image job is still running on its disk")
 	}
 
-	log.Printf("Sent SIGTERM to PID %d", pidInt)
-	return nil
-}
+	if err := checkBaseImage(vm); err != nil {
+		return newAPIError(http.StatusConflict, "start_blocked", "cannot start VM: %v", err)
+	}
 
-func forceStopVM(pid string) error {
-	pidInt, err := strconv.Atoi(pid)
-	if err != nil {
-		return fmt.Errorf("invalid PID: %s", pid)
+	// The segment switches put their sockets in the runtime dir
+	if err := os.MkdirAll(runtimeDir, 0755); err != nil {
+		return newAPIError(http.StatusInternalServerError, "start_failed", "failed to create runtime dir: %v", err)
 	}
 
-	// Force kill with SIGKILL
-	cmd := exec.Command("sudo", "kill", "-9", pid)
-	output, err := cmd.CombinedOutput()
+	if err := ensureSegments(vm); err != nil {
+		if asAPIError(err).Status == http.StatusConflict {
+			return newAPIError(http.StatusConflict, "start_blocked", "cannot start VM: %v", err)
+		}
+		return newAPIError(http.StatusInternalServerError, "start_failed", "cannot start VM: %v", err)
+	}
+
+	if err := provisionTaps(vm); err != nil {
+		if asAPIError(err).Status == http.StatusConflict {
+			return newAPIError(http.StatusConflict, "start_blocked", "cannot start VM: %v", err)
+		}
+		return newAPIError(http.StatusInternalServerError, "start_failed", "cannot start VM: %v", err)
+	}
+
+	pid, err := launchQEMU(vm)
 	if err != nil {
-		return fmt.Errorf("failed to force stop VM (PID %d): %v - %s", pidInt, err, string(output))
+		tapsMu.Lock()
+		taps := provisionedTaps[name]
+		delete(provisionedTaps, name)
+		delete(tapsProvisionedAt, name)
+		tapsMu.Unlock()
+		cleanupTaps(taps)
+		return newAPIError(http.StatusInternalServerError, "launch_failed", "failed to start VM: %v", err)
 	}
 
-	log.Printf("Sent SIGKILL to PID %d", pidInt)
+	liveForwardsMu.Lock()
+	liveForwards[name] = configForwards(vm)
+	liveForwardsMu.Unlock()
+
+	log.Printf("Started VM %s with PID %d", name, pid)
 	return nil
 }
 
-func getShellInfo(name string) (map[string]interface{}, error) {
-	vm := findVMConfig(name)
-	if vm == nil {
-		return nil, fmt.Errorf("VM configuration not found: %s", name)
+// launchQEMU starts QEMU for a VM in the background: unprivileged when the
+// VM allows it, else through the privileged helper, else through sudo.
+func launchQEMU(vm *VMConfig) (int, error) {
+	cmd := buildQEMUCommand(vm)
+	if vmNeedsPrivilege(vm) && os.Geteuid() != 0 {
+		if helperAvailable() {
+			// The monitor listens on the chardev sockets itself and QEMU
+			// inherits them, so they are not root's
+			sockets, err := listenVMSockets(vm)
+			if err != nil {
+				return 0, err
+			}
+			defer closeFiles(sockets)
+			resp, err := callHelper(helperRequest{Op: "launch", VM: vm.Name}, sockets...)
+			if err != nil {
+				return 0, err
+			}
+			return resp.PID, nil
+		}
+		sudo := exec.Command("sudo", cmd.Args...)
+		sudo.Dir = cmd.Dir
+		if err := sudo.Start(); err != nil {
+			return 0, err
+		}
+		go sudo.Wait()
+		go chownVMSockets(vm)
+		return sudo.Process.Pid, nil
 	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
 
-	// Check if VM is running
-	var running bool
-	for _, inst := range cachedInstances {
-		if inst.Name == name {
-			running = true
-			break
-		}
+func stopVM(inst *QEMUInstance) error {
+	// Graceful shutdown with SIGTERM
+	return signalInstance(inst, "TERM")
+}
+
+func forceStopVM(inst *QEMUInstance) error {
+	// Force kill with SIGKILL
+	return signalInstance(inst, "KILL")
+}
+
+// ShellInfo describes how to reach a VM's shell and web ports.
+type ShellInfo struct {
+	Name       string           `json:"name"`
+	Running    bool             `json:"running"`
+	SSHCommand string           `json:"ssh_command,omitempty"`
+	SSHPort    int              `json:"ssh_port,omitempty"`
+	Interfaces []ShellInterface `json:"interfaces,omitempty"`
+	HTTPURL    string           `json:"http_url,omitempty"`
+	HTTPPort   int              `json:"http_port,omitempty"`
+}
+
+// ShellInterface is a NIC whose guest address is known, with the commands
+// to reach it directly.
+type ShellInterface struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	MAC         string            `json:"mac"`
+	Addresses   []ResolvedAddress `json:"addresses"`
+	SSHCommands []string          `json:"ssh_commands"`
+}
+
+func getShellInfo(name string) (*ShellInfo, error) {
+	config, ok := lookupVM(name)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
 	}
+	vm := &config
 
-	info := map[string]interface{}{
-		"name":    name,
-		"running": running,
+	info := &ShellInfo{
+		Name:    name,
+		Running: isRunning(name),
 	}
 
 	if vm.SSHPort != nil {
-		info["ssh_command"] = fmt.Sprintf("ssh -p %d root@localhost", *vm.SSHPort)
-		info["ssh_port"] = *vm.SSHPort
+		info.SSHCommand = fmt.Sprintf("ssh -p %d root@localhost", *vm.SSHPort)
+		info.SSHPort = *vm.SSHPort
+	}
+
+	// Direct access to NICs whose guest IP has been discovered
+	sshUser := vm.SSHUser
+	if sshUser == "" {
+		sshUser = "root"
+	}
+	for _, inst := range currentInstances() {
+		if inst.Name != name {
+			continue
+		}
+		for _, net := range inst.Networks {
+			if len(net.Addresses) == 0 {
+				continue
+			}
+			commands := []string{}
+			for _, addr := range net.Addresses {
+				commands = append(commands, fmt.Sprintf("ssh %s@%s", sshUser, addr.IP))
+			}
+			info.Interfaces = append(info.Interfaces, ShellInterface{
+				ID:          net.ID,
+				Type:        net.Type,
+				MAC:         net.MAC,
+				Addresses:   net.Addresses,
+				SSHCommands: commands,
+			})
+		}
 	}
 
 	if vm.HTTPPort != nil {
-		info["http_url"] = fmt.Sprintf("http://localhost:%d", *vm.HTTPPort)
-		info["http_port"] = *vm.HTTPPort
+		info.HTTPURL = fmt.Sprintf("http://localhost:%d", *vm.HTTPPort)
+		info.HTTPPort = *vm.HTTPPort
 	}
 
 	return info, nil
@@ -375,20 +800,31 @@ func getShellInfo(name string) (map[string]interface{}, error) {
 
 func handleInstances(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	p := principalFrom(r)
+	current, updated := instancesSnapshot()
+	instances := []QEMUInstance{}
+	for _, inst := range current {
+		if p.allowsVM(inst.Name) {
+			instances = append(instances, inst)
+		}
+	}
 
 	response := Response{
-		Instances:   cachedInstances,
-		Count:       len(cachedInstances),
-		LastUpdated: lastUpdate.Format("2006-01-02 15:04:05"),
+		Instances:   instances,
+		Count:       len(instances),
+		LastUpdated: updated.Format("2006-01-02 15:04:05"),
 	}
+	configMu.Lock()
+	response.Conflicts = configConflicts()
+	response.LeakedTaps = leakedTaps()
+	configMu.Unlock()
 
 	json.NewEncoder(w).Encode(response)
 }
 
 func handleStart(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -400,12 +836,16 @@ func handleStart(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+		return
+	}
+
+	if !authorizeVM(w, r, req.Name) {
 		return
 	}
 
 	if err := startVM(req.Name); err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		legacyError(w, r, err)
 		return
 	}
 
@@ -414,7 +854,6 @@ func handleStart(w http.ResponseWriter, r *http.Request) {
 
 func handleStop(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -422,50 +861,56 @@ func handleStop(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		PID   string `json:"pid"`
+		Name  string `json:"name"`
+		ID    string `json:"id"`
+		PID   string `json:"pid"` // no longer accepted, kept to explain the refusal
 		Force bool   `json:"force"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
 		return
 	}
 
-	var err error
-	if req.Force {
-		err = forceStopVM(req.PID)
-	} else {
-		err = stopVM(req.PID)
+	if req.Name == "" && req.ID == "" && req.PID != "" {
+		reason := "stopping by raw PID is not supported, use name or id"
+		logRefusedStop(r, "PID "+req.PID, reason)
+		legacyError(w, r, statusError(http.StatusBadRequest, reason))
+		return
 	}
 
+	inst, err := stopRequested(r, req.Name, req.ID, req.Force)
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		legacyError(w, r, err)
 		return
 	}
-
-	action := "stopped"
-	if req.Force {
-		action = "force stopped"
-	}
-	json.NewEncoder(w).Encode(map[string]string{"status": action, "pid": req.PID})
+	json.NewEncoder(w).Encode(stopResult(inst, req.Force))
 }
 
 func handleShell(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
 	var req struct {
 		Name string `json:"name"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request"})
+		legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+		return
+	}
+
+	if !authorizeVM(w, r, req.Name) {
 		return
 	}
 
 	info, err := getShellInfo(req.Name)
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		legacyError(w, r, err)
 		return
 	}
 
@@ -474,17 +919,123 @@ func handleShell(w http.ResponseWriter, r *http.Request) {
 
 func handleVMsConfig(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	json.NewEncoder(w).Encode(vmsConfig)
+	// Only admins see credentials, and everyone only the VMs they may access
+	p := principalFrom(r)
+	configMu.Lock()
+	out := vmsConfig
+	out.VMs = []VMConfig{}
+	for i := range vmsConfig.VMs {
+		vm := copyVMConfig(&vmsConfig.VMs[i])
+		if !p.allowsVM(vm.Name) {
+			continue
+		}
+		if !p.allows(roleAdmin) && vm.SSHPassword != "" {
+			vm.SSHPassword = "********"
+		}
+		out.VMs = append(out.VMs, vm)
+	}
+	configMu.Unlock()
+	json.NewEncoder(w).Encode(out)
+}
+
+// handleVMRoutes dispatches per-VM sub-resources under /api/vms/{name}/...
+func handleVMRoutes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/vms/")
+	parts := strings.SplitN(rest, "/", 2)
+	name := parts[0]
+	sub := ""
+	if len(parts) > 1 {
+		sub = strings.TrimSuffix(parts[1], "/")
+	}
+
+	switch sub {
+	case "":
+		handleDeleteVM(w, r, name)
+	case "clone":
+		handleClone(w, r, name)
+	case "guest":
+		handleGuestInfo(w, r, name)
+	case "guest/exec":
+		handleGuestExec(w, r, name)
+	case "guest/fsfreeze":
+		handleGuestFSFreeze(w, r, name)
+	case "guest/time":
+		handleGuestTime(w, r, name)
+	case "files":
+		handleFiles(w, r, name)
+	case "impairment":
+		handleImpairment(w, r, name)
+	case "forwards":
+		handleForwards(w, r, name)
+	case "pause", "resume":
+		handlePause(w, r, name, sub == "pause")
+	case "terminal":
+		handleTerminal(w, r, name)
+	case "serial":
+		handleSerial(w, r, name)
+	case "recordings":
+		handleRecordings(w, r, name, "")
+	case "captures":
+		handleCaptures(w, r, name, "")
+	case "backups", "backups/cancel", "backups/restore":
+		handleBackups(w, r, name, strings.TrimPrefix(strings.TrimPrefix(sub, "backups"), "/"))
+	default:
+		if strings.HasPrefix(sub, "recordings/") {
+			handleRecordings(w, r, name, strings.TrimPrefix(sub, "recordings/"))
+			return
+		}
+		if strings.HasPrefix(sub, "captures/") {
+			handleCaptures(w, r, name, strings.TrimPrefix(sub, "captures/"))
+			return
+		}
+		http.NotFound(w, r)
+	}
 }
 
 func handleIndex(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, indexHTML)
+	// The page polls as often as the instances are refreshed
+	fmt.Fprint(w, strings.Replace(indexHTML, "POLL_INTERVAL_MS", fmt.Sprint(pollInterval.Milliseconds()), 1))
 }
 
 func main() {
+	if err := runCommand(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "qemu-monitor: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runServe implements `qemu-monitor serve`, the web UI and API server.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	sf := addSettingsFlags(fs, true)
+	fs.Parse(args)
+	if err := sf.apply(); err != nil {
+		return err
+	}
+	if err := makeSettingsDirs(); err != nil {
+		return err
+	}
+
+	if err := loadAuthConfig(); err != nil {
+		return fmt.Errorf("failed to load %s: %v", authConfigPath, err)
+	}
+	loadAuditLog()
+	if auditSeq > 0 {
+		log.Printf("Audit log at entry %d, hash %s", auditSeq, auditLastHash)
+	}
+
+	// Initial load, before the config so its conflict check sees the
+	// running NICs
+	instances, err := getQEMUInstances()
+	if err != nil {
+		return err
+	}
+	setInstances(instances)
+
 	// Load VM configuration
 	if err := loadVMsConfig(); err != nil {
 		log.Printf("Warning: Failed to load VMs config: %v", err)
@@ -492,16 +1043,9 @@ func main() {
 		log.Printf("Loaded configuration for %d VMs", len(vmsConfig.VMs))
 	}
 
-	// Initial load
-	instances, err := getQEMUInstances()
-	if err != nil {
-		log.Fatal(err)
-	}
-	cachedInstances = instances
-	lastUpdate = time.Now()
-
 	// Start background updater
 	go updateInstances()
+	go backupScheduler()
 
 	http.HandleFunc("/", handleIndex)
 	http.HandleFunc("/api/instances", handleInstances)
@@ -509,8 +1053,51 @@ func main() {
 	http.HandleFunc("/api/stop", handleStop)
 	http.HandleFunc("/api/shell", handleShell)
 	http.HandleFunc("/api/vms", handleVMsConfig)
+	http.HandleFunc("/api/vms/", handleVMRoutes)
+	http.HandleFunc("/api/events", handleEvents)
+	http.HandleFunc("/api/topology", handleTopology)
+	http.HandleFunc("/api/impairments", handleImpairmentProfiles)
+	http.HandleFunc("/api/taps/cleanup", handleTapCleanup)
+	http.HandleFunc("/api/images", handleImages)
+	http.HandleFunc("/api/images/", handleImageJobs)
+	http.HandleFunc("/api/login", handleLogin)
+	http.HandleFunc("/api/logout", handleLogout)
+	http.HandleFunc("/api/whoami", handleWhoami)
+	http.HandleFunc("/api/audit", handleAudit)
+	http.HandleFunc("/api/audit/verify", handleAudit)
+	http.HandleFunc("/api/v1/", handleAPIv1)
+	http.HandleFunc("/api/openapi.json", handleOpenAPI)
+	http.HandleFunc("/api/settings", handleSettings)
+
+	var tlsConfig *tls.Config
+	if tlsSettings := authConfig.TLS; tlsSettings != nil && tlsSettings.Enabled {
+		tlsConfig, err = setupTLS(*tlsSettings)
+		if err != nil {
+			return fmt.Errorf("failed to set up TLS: %v", err)
+		}
+	}
 
-	addr := "0.0.0.0:5450"
-	log.Printf("QEMU Instance Tracker starting on http://%s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	// Every address serves the same handler. Unix sockets are plain HTTP,
+	// since only their file permissions let clients in.
+	handler := authMiddleware(deprecatedAPI(http.DefaultServeMux))
+	errs := make(chan error, len(settings.Listen))
+	for _, addr := range settings.Listen {
+		l, err := listenOn(addr)
+		if err != nil {
+			return err
+		}
+		server := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+		if tlsConfig != nil && !strings.HasPrefix(addr, "unix:") {
+			log.Printf("QEMU Instance Tracker starting on https://%s", addr)
+			go func() { errs <- server.ServeTLS(l, "", "") }()
+			continue
+		}
+		if strings.HasPrefix(addr, "unix:") {
+			log.Printf("QEMU Instance Tracker starting on %s", addr)
+		} else {
+			log.Printf("QEMU Instance Tracker starting on http://%s", addr)
+		}
+		go func() { errs <- server.Serve(l) }()
+	}
+	return <-errs
 }
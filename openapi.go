@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The OpenAPI document is built by reflection from the same Go types the
+// handlers encode, so a renamed field or tag changes the spec with it. The
+// Go client's types in client/types_gen.go are generated from it too.
+
+const apiVersion = "1.0.0"
+
+// apiOperation is one documented endpoint.
+type apiOperation struct {
+	Method   string
+	Path     string
+	ID       string
+	Summary  string
+	Query    []string // optional string query parameters
+	Request  interface{}
+	Optional bool // the request body may be omitted
+	Response interface{}
+	Status   int // success status, default 200
+}
+
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/api/v1/instances", ID: "listInstances", Summary: "List running QEMU instances", Response: Response{}},
+	{Method: "GET", Path: "/api/v1/instances/{id}", ID: "getInstance", Summary: "Get a running instance", Response: QEMUInstance{}},
+	{Method: "POST", Path: "/api/v1/instances/{id}/stop", ID: "stopInstance", Summary: "Stop an instance by ID", Request: StopRequest{}, Optional: true, Response: StatusResult{}},
+	{Method: "GET", Path: "/api/v1/vms", ID: "listVMs", Summary: "List configured VMs", Response: VMsConfig{}},
+	{Method: "GET", Path: "/api/v1/vms/{name}", ID: "getVM", Summary: "Get a VM's configuration", Response: VMConfig{}},
+	{Method: "DELETE", Path: "/api/v1/vms/{name}", ID: "deleteVM", Summary: "Delete a VM, and its disk with disk=1", Query: []string{"disk"}, Response: StatusResult{}},
+	{Method: "POST", Path: "/api/v1/vms/{name}/start", ID: "startVM", Summary: "Start a VM", Response: StatusResult{}, Status: http.StatusAccepted},
+	{Method: "POST", Path: "/api/v1/vms/{name}/stop", ID: "stopVM", Summary: "Stop a VM by name", Request: StopRequest{}, Optional: true, Response: StatusResult{}},
+	{Method: "POST", Path: "/api/v1/vms/{name}/pause", ID: "pauseVM", Summary: "Pause a running VM's vCPUs", Response: StatusResult{}},
+	{Method: "POST", Path: "/api/v1/vms/{name}/resume", ID: "resumeVM", Summary: "Resume a paused VM", Response: StatusResult{}},
+	{Method: "GET", Path: "/api/v1/vms/{name}/shell", ID: "getShellInfo", Summary: "Get SSH and HTTP access details", Response: ShellInfo{}},
+	{Method: "POST", Path: "/api/v1/vms/{name}/clone", ID: "cloneVM", Summary: "Clone a VM", Request: CloneRequest{}, Response: CloneResult{}, Status: http.StatusCreated},
+	{Method: "GET", Path: "/api/v1/vms/{name}/backups", ID: "getBackups", Summary: "List a VM's backups and backup jobs", Response: BackupStatus{}},
+	{Method: "POST", Path: "/api/v1/vms/{name}/backups", ID: "startBackup", Summary: "Start a live backup", Request: BackupRequest{}, Optional: true, Response: BackupJob{}},
+	{Method: "GET", Path: "/api/v1/images", ID: "listImages", Summary: "List disk images and their backing chains", Response: ImageList{}},
+	{Method: "GET", Path: "/api/v1/images/jobs", ID: "listImageJobs", Summary: "List image jobs", Response: []ImageJob{}},
+	{Method: "POST", Path: "/api/v1/images/jobs", ID: "createImageJob", Summary: "Start an image job", Request: ImageJobRequest{}, Response: ImageJob{}},
+	{Method: "GET", Path: "/api/v1/images/jobs/{id}", ID: "getImageJob", Summary: "Get an image job", Response: ImageJob{}},
+	{Method: "GET", Path: "/api/v1/audit", ID: "listAudit", Summary: "Search the audit log", Query: []string{"user", "vm", "action", "outcome", "since", "until", "limit"}, Response: AuditPage{}},
+	{Method: "GET", Path: "/api/v1/audit/verify", ID: "verifyAudit", Summary: "Verify the audit log's hash chain", Response: AuditVerification{}},
+	{Method: "GET", Path: "/api/v1/settings", ID: "getSettings", Summary: "Get the monitor's effective settings", Response: Settings{}},
+	{Method: "GET", Path: "/api/v1/whoami", ID: "whoami", Summary: "Get the authenticated caller", Response: WhoamiResult{}},
+}
+
+// schemaOverrides covers types with hand-written JSON encodings.
+var schemaOverrides = map[reflect.Type]map[string]interface{}{
+	reflect.TypeOf(PortForward{}): {
+		"type":     "object",
+		"required": []string{"host", "guest"},
+		"properties": map[string]interface{}{
+			"host": map[string]interface{}{
+				"description": `A fixed host port, or "auto" to allocate one from port_range`,
+				"oneOf": []interface{}{
+					map[string]interface{}{"type": "integer"},
+					map[string]interface{}{"type": "string", "enum": []string{"auto"}},
+				},
+			},
+			"guest":         map[string]interface{}{"type": "integer"},
+			"protocol":      map[string]interface{}{"type": "string", "enum": []string{"tcp", "udp"}},
+			"assigned_host": map[string]interface{}{"type": "integer", "description": "The port allocated for an auto host port"},
+		},
+	},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonField is an exported struct field as encoding/json sees it.
+type jsonField struct {
+	Field     reflect.StructField
+	Name      string
+	OmitEmpty bool
+}
+
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, jsonField{Field: f, Name: name, OmitEmpty: strings.Contains(opts, "omitempty")})
+	}
+	return fields
+}
+
+// schemaBuilder collects the component schemas of every struct it meets.
+type schemaBuilder struct {
+	components map[string]interface{}
+	types      map[string]reflect.Type
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{components: map[string]interface{}{}, types: map[string]reflect.Type{}}
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		s := b.schema(t.Elem())
+		if _, ref := s["$ref"]; !ref {
+			s["nullable"] = true
+		}
+		return s
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		name := t.Name()
+		if _, seen := b.types[name]; !seen {
+			b.types[name] = t
+			if override, ok := schemaOverrides[t]; ok {
+				b.components[name] = override
+			} else {
+				b.components[name] = b.structSchema(t)
+			}
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{"type": "string"}
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, f := range jsonFields(t) {
+		properties[f.Name] = b.schema(f.Field.Type)
+		if !f.OmitEmpty {
+			required = append(required, f.Name)
+		}
+	}
+	s := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// buildOpenAPI assembles the OpenAPI 3 document for the v1 API.
+func buildOpenAPI() (map[string]interface{}, *schemaBuilder) {
+	b := newSchemaBuilder()
+	errorSchema := b.schema(reflect.TypeOf(ErrorResponse{}))
+
+	paths := map[string]interface{}{}
+	for _, op := range apiOperations {
+		var params []interface{}
+		for _, segment := range strings.Split(op.Path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				params = append(params, map[string]interface{}{
+					"name": strings.Trim(segment, "{}"), "in": "path", "required": true,
+					"schema": map[string]interface{}{"type": "string"},
+				})
+			}
+		}
+		for _, name := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "query",
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		operation := map[string]interface{}{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+			"responses": map[string]interface{}{
+				fmt.Sprint(status): map[string]interface{}{
+					"description": http.StatusText(status),
+					"content":     jsonContent(b.schema(reflect.TypeOf(op.Response))),
+				},
+				"default": map[string]interface{}{
+					"description": "Error",
+					"content":     jsonContent(errorSchema),
+				},
+			},
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": !op.Optional,
+				"content":  jsonContent(b.schema(reflect.TypeOf(op.Request))),
+			}
+		}
+
+		item, _ := paths[op.Path].(map[string]interface{})
+		if item == nil {
+			item = map[string]interface{}{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "qemu-monitor",
+			"version": apiVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": b.components,
+			"securitySchemes": map[string]interface{}{
+				"bearer":  map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"session": map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"session": []string{}},
+		},
+	}
+	return doc, b
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	doc, _ := buildOpenAPI()
+	json.NewEncoder(w).Encode(doc)
+}
+
+// goTypeName renders a field type for the generated client, where every
+// struct keeps its server-side name.
+func goTypeName(t reflect.Type) string {
+	switch {
+	case t == timeType:
+		return "time.Time"
+	case t.Kind() == reflect.Ptr:
+		return "*" + goTypeName(t.Elem())
+	case t.Kind() == reflect.Slice:
+		return "[]" + goTypeName(t.Elem())
+	case t.Kind() == reflect.Map:
+		return "map[" + goTypeName(t.Key()) + "]" + goTypeName(t.Elem())
+	case t.Kind() == reflect.Interface:
+		return "interface{}"
+	case t.Kind() == reflect.Struct:
+		return t.Name()
+	}
+	return t.Kind().String()
+}
+
+// generateClientTypes writes the Go declarations of every schema in the
+// spec. Types with hand-written encodings are left to the client package.
+func generateClientTypes(pkg string) ([]byte, error) {
+	_, b := buildOpenAPI()
+	names := make([]string, 0, len(b.types))
+	for name := range b.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by qemu-monitor openapi -go; DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	body := &bytes.Buffer{}
+	for _, name := range names {
+		t := b.types[name]
+		if _, ok := schemaOverrides[t]; ok {
+			continue
+		}
+		fmt.Fprintf(body, "type %s struct {\n", name)
+		for _, f := range jsonFields(t) {
+			tag := f.Name
+			if f.OmitEmpty {
+				tag += ",omitempty"
+			}
+			fmt.Fprintf(body, "\t%s %s `json:%q`\n", f.Field.Name, goTypeName(f.Field.Type), tag)
+		}
+		body.WriteString("}\n\n")
+	}
+	if bytes.Contains(body.Bytes(), []byte("time.Time")) {
+		buf.WriteString("import \"time\"\n\n")
+	}
+	buf.Write(body.Bytes())
+	return format.Source(buf.Bytes())
+}
+
+// runOpenAPI implements `qemu-monitor openapi`: print the spec, or with -go
+// write the client's generated types.
+func runOpenAPI(args []string) error {
+	fs := flag.NewFlagSet("openapi", flag.ExitOnError)
+	goOut := fs.String("go", "", "write Go client types to this file instead of printing the spec")
+	pkg := fs.String("package", "client", "package name of the generated Go file")
+	fs.Parse(args)
+
+	if *goOut == "" {
+		doc, _ := buildOpenAPI()
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	}
+	src, err := generateClientTypes(*pkg)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*goOut, src, 0644)
+}
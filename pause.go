@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var (
+	runStatesMu sync.Mutex
+	runStates   = map[string]bool{} // paused, by instance ID
+)
+
+// pauseVM stops or resumes the vCPUs of a running VM through QMP. The
+// process keeps running, so memory and open connections are kept.
+func pauseVM(name string, pause bool) error {
+	if !vmDefined(name) {
+		return newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	id, found := "", false
+	for _, inst := range currentInstances() {
+		if inst.Name == name && ownedInstance(&inst) {
+			id, found = inst.ID, true
+		}
+	}
+	if !found {
+		return newAPIError(http.StatusConflict, "not_running", "VM is not running: %s", name)
+	}
+
+	command, done := "cont", "resumed"
+	if pause {
+		command, done = "stop", "paused"
+	}
+	if err := qmpExecute(name, command, nil, nil); err != nil {
+		return newAPIError(http.StatusInternalServerError, "qmp_failed", "%v", err)
+	}
+
+	// The next refresh derives the instance status from this
+	runStatesMu.Lock()
+	runStates[id] = pause
+	runStatesMu.Unlock()
+	log.Printf("VM %s %s", name, done)
+	publishEvent("vm_"+done, name, nil)
+	return nil
+}
+
+// trackRunStates marks paused instances. The run state is asked over QMP
+// once per instance, since a VM may have been paused before the monitor
+// started; after that pauseVM keeps it current.
+func trackRunStates(instances []QEMUInstance) {
+	runStatesMu.Lock()
+	defer runStatesMu.Unlock()
+
+	seen := map[string]bool{}
+	for i := range instances {
+		inst := &instances[i]
+		if inst.ID == "" || !ownedInstance(inst) {
+			continue
+		}
+		seen[inst.ID] = true
+		paused, known := runStates[inst.ID]
+		if !known {
+			var status struct {
+				Status string `json:"status"`
+			}
+			paused = qmpExecute(inst.Name, "query-status", nil, &status) == nil && status.Status == "paused"
+			runStates[inst.ID] = paused
+		}
+		if paused {
+			inst.Status = "paused"
+		}
+	}
+	for id := range runStates {
+		if !seen[id] {
+			delete(runStates, id)
+		}
+	}
+}
+
+func handlePause(w http.ResponseWriter, r *http.Request, name string, pause bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := pauseVM(name, pause); err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(pauseResult(name, pause))
+}
+
+func pauseResult(name string, pause bool) StatusResult {
+	if pause {
+		return StatusResult{Status: "paused", Name: name}
+	}
+	return StatusResult{Status: "running", Name: name}
+}
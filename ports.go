@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PortRange is the pool "auto" host ports are allocated from.
+type PortRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+var (
+	defaultPortRange = PortRange{Start: 20000, End: 20999}
+	portStatePath    = "port-assignments.json"
+
+	// Persisted auto assignments keyed by "vm/netdev/guest"
+	portAssignments = map[string]int{}
+
+	// Set by `config validate`, which must not write state files
+	readOnlyState bool
+)
+
+// PortForward host ports are either a fixed number or "auto". Auto ports
+// are resolved into Host at load time and reported back as assigned_host.
+func (pf *PortForward) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Host     json.RawMessage `json:"host"`
+		Guest    int             `json:"guest"`
+		Protocol string          `json:"protocol"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	pf.Guest = raw.Guest
+	pf.Protocol = raw.Protocol
+	if string(raw.Host) == `"auto"` {
+		pf.Auto = true
+		return nil
+	}
+	if len(raw.Host) == 0 {
+		return fmt.Errorf("port forward for guest port %d has no host port", raw.Guest)
+	}
+	if err := json.Unmarshal(raw.Host, &pf.Host); err != nil {
+		return fmt.Errorf("invalid host port %s: must be a number or \"auto\"", raw.Host)
+	}
+	return nil
+}
+
+func (pf PortForward) MarshalJSON() ([]byte, error) {
+	if pf.Auto {
+		return json.Marshal(struct {
+			Host         string `json:"host"`
+			Guest        int    `json:"guest"`
+			Protocol     string `json:"protocol,omitempty"`
+			AssignedHost int    `json:"assigned_host,omitempty"`
+		}{"auto", pf.Guest, pf.Protocol, pf.Host})
+	}
+	return json.Marshal(struct {
+		Host     int    `json:"host"`
+		Guest    int    `json:"guest"`
+		Protocol string `json:"protocol,omitempty"`
+	}{pf.Host, pf.Guest, pf.Protocol})
+}
+
+func portAssignmentKey(vm, netID string, guest int) string {
+	return fmt.Sprintf("%s/%s/%d", vm, netID, guest)
+}
+
+func loadPortAssignments() {
+	data, err := ioutil.ReadFile(portStatePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: failed to read %s: %v", portStatePath, err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &portAssignments); err != nil {
+		log.Printf("Warning: failed to parse %s: %v", portStatePath, err)
+	}
+}
+
+func savePortAssignments() error {
+	data, err := json.MarshalIndent(portAssignments, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(portStatePath, data, 0644)
+}
+
+// hostPortFree reports whether nothing on the host is bound to port for
+// the forward's protocol.
+func hostPortFree(port int, protocol string) bool {
+	addr := ":" + strconv.Itoa(port)
+	if forwardProtocol(protocol) == "udp" {
+		c, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return false
+		}
+		c.Close()
+		return true
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// claimedHostPorts returns every fixed or already-assigned host port in the
+// config, mapped to the VMs claiming it.
+func claimedHostPorts() map[int][]string {
+	claimed := map[int][]string{}
+	for _, vm := range vmsConfig.VMs {
+		for _, net := range vm.Networks {
+			for _, pf := range net.PortForwards {
+				if pf.Host != 0 {
+					claimed[pf.Host] = append(claimed[pf.Host], vm.Name)
+				}
+			}
+		}
+	}
+	return claimed
+}
+
+func portRangeConfig() PortRange {
+	if r := vmsConfig.PortRange; r != nil && r.Start > 0 && r.End >= r.Start {
+		return *r
+	}
+	return defaultPortRange
+}
+
+// reserveAssignedPorts adds the persisted auto assignments to claimed, so
+// a new port never takes one held for a VM that is stopped or comes later
+// in the config.
+func reserveAssignedPorts(claimed map[int][]string) {
+	for key, port := range portAssignments {
+		vm := strings.SplitN(key, "/", 2)[0]
+		held := false
+		for _, name := range claimed[port] {
+			held = held || name == vm
+		}
+		if !held {
+			claimed[port] = append(claimed[port], vm)
+		}
+	}
+}
+
+// findFreePort returns the first port in portRange that is neither claimed
+// nor in use on the host, or 0 if the range is exhausted.
+func findFreePort(portRange PortRange, claimed map[int][]string, protocol string) int {
+	for port := portRange.Start; port <= portRange.End; port++ {
+		if len(claimed[port]) == 0 && hostPortFree(port, protocol) {
+			return port
+		}
+	}
+	return 0
+}
+
+// allocatePorts resolves every "auto" host port in the config, reusing
+// persisted assignments where they are still valid. All of those are
+// restored before any new port is picked, so no VM takes a port held for
+// one later in the config.
+func allocatePorts() {
+	portRange := portRangeConfig()
+	claimed := claimedHostPorts()
+	changed := false
+
+	type pendingForward struct {
+		pf      *PortForward
+		vm, key string
+	}
+	var pending []pendingForward
+	for i := range vmsConfig.VMs {
+		vm := &vmsConfig.VMs[i]
+		for j := range vm.Networks {
+			net := &vm.Networks[j]
+			for k := range net.PortForwards {
+				pf := &net.PortForwards[k]
+				if !pf.Auto || pf.Host != 0 {
+					continue
+				}
+				key := portAssignmentKey(vm.Name, net.ID, pf.Guest)
+				if port, ok := portAssignments[key]; ok && len(claimed[port]) == 0 {
+					pf.Host = port
+					claimed[port] = append(claimed[port], vm.Name)
+					continue
+				}
+				pending = append(pending, pendingForward{pf, vm.Name, key})
+			}
+		}
+	}
+
+	reserveAssignedPorts(claimed)
+	for _, p := range pending {
+		p.pf.Host = findFreePort(portRange, claimed, p.pf.Protocol)
+		if p.pf.Host == 0 {
+			log.Printf("Warning: no free host port in %d-%d for %s", portRange.Start, portRange.End, p.key)
+			continue
+		}
+		claimed[p.pf.Host] = append(claimed[p.pf.Host], p.vm)
+		portAssignments[p.key] = p.pf.Host
+		changed = true
+		log.Printf("Assigned host port %d to %s", p.pf.Host, p.key)
+	}
+
+	// The privileged helper only reads the state the monitor owns
+	if changed && !helperMode && !readOnlyState {
+		if err := savePortAssignments(); err != nil {
+			log.Printf("Warning: failed to save %s: %v", portStatePath, err)
+		}
+	}
+}
+
+// deriveServicePorts fills ssh_port/http_port from the guest 22/80 forward
+// rules when they are not set explicitly.
+func deriveServicePorts() {
+	for i := range vmsConfig.VMs {
+		vm := &vmsConfig.VMs[i]
+		if vm.sshPortDerived {
+			vm.SSHPort, vm.sshPortDerived = nil, false
+		}
+		if vm.httpPortDerived {
+			vm.HTTPPort, vm.httpPortDerived = nil, false
+		}
+		for _, net := range vm.Networks {
+			for _, pf := range net.PortForwards {
+				if pf.Host == 0 {
+					continue
+				}
+				port := pf.Host
+				if pf.Guest == 22 && vm.SSHPort == nil {
+					vm.SSHPort = &port
+					vm.sshPortDerived = true
+				}
+				if pf.Guest == 80 && vm.HTTPPort == nil {
+					vm.HTTPPort = &port
+					vm.httpPortDerived = true
+				}
+			}
+		}
+	}
+}
+
+// portConflicts lists host port collisions between VMs in the config.
+func portConflicts() []string {
+	conflicts := []string{}
+	for port, vms := range claimedHostPorts() {
+		if len(vms) > 1 {
+			conflicts = append(conflicts, fmt.Sprintf("host port %d claimed by %s", port, strings.Join(vms, ", ")))
+		}
+	}
+	sort.Strings(conflicts)
+	return conflicts
+}
+
+// checkPortConflicts refuses a launch whose host ports are claimed by
+// another VM or already in use on the host.
+func checkPortConflicts(vm *VMConfig) error {
+	claimed := claimedHostPorts()
+	for _, net := range vm.Networks {
+		for _, pf := range net.PortForwards {
+			if pf.Host == 0 {
+				return fmt.Errorf("no host port assigned for guest port %d on %s", pf.Guest, net.ID)
+			}
+			for _, other := range claimed[pf.Host] {
+				if other != vm.Name {
+					return fmt.Errorf("host port %d is also claimed by VM %s", pf.Host, other)
+				}
+			}
+			if !hostPortFree(pf.Host, pf.Protocol) {
+				return fmt.Errorf("host port %d is already in use", pf.Host)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// procSample is the CPU time a process had used when it was last sampled
+// and the usage computed then.
+type procSample struct {
+	cpu     time.Duration
+	when    time.Time
+	percent float64
+}
+
+// minSampleInterval keeps listings made in quick succession, like the one
+// before a stop, from measuring CPU over a few milliseconds.
+const minSampleInterval = time.Second
+
+var (
+	procSamplesMu sync.Mutex
+	procSamples   = map[string]procSample{} // by instance ID
+)
+
+// sampleProcessStats fills in the CPU usage and resident memory of the
+// instances with a single ps call. CPU is the share of one core used since
+// the previous sample, so it shows current load rather than the average
+// since the process started; the first sample falls back to the latter.
+func sampleProcessStats(instances []QEMUInstance) {
+	if len(instances) == 0 {
+		return
+	}
+	pids := make([]string, 0, len(instances))
+	for _, inst := range instances {
+		pids = append(pids, inst.PID)
+	}
+	out, err := exec.Command("ps", "-o", "pid=,time=,rss=,pcpu=", "-p", strings.Join(pids, ",")).Output()
+	if err != nil && len(out) == 0 {
+		return
+	}
+
+	type stats struct {
+		cpu  time.Duration
+		rss  int64
+		pcpu float64
+	}
+	byPID := map[string]stats{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			continue
+		}
+		cpu, ok := parseCPUTime(fields[1])
+		if !ok {
+			continue
+		}
+		rss, _ := strconv.ParseInt(fields[2], 10, 64)
+		pcpu, _ := strconv.ParseFloat(fields[3], 64)
+		byPID[fields[0]] = stats{cpu, rss * 1024, pcpu}
+	}
+
+	now := time.Now()
+	procSamplesMu.Lock()
+	defer procSamplesMu.Unlock()
+	seen := map[string]bool{}
+	for i := range instances {
+		inst := &instances[i]
+		s, ok := byPID[inst.PID]
+		if !ok {
+			continue
+		}
+		inst.RSS = s.rss
+		if inst.ID == "" {
+			inst.CPUPercent = s.pcpu
+			continue
+		}
+		seen[inst.ID] = true
+		prev, ok := procSamples[inst.ID]
+		switch {
+		case !ok:
+			procSamples[inst.ID] = procSample{s.cpu, now, s.pcpu}
+		case now.Sub(prev.when) >= minSampleInterval:
+			percent := float64(s.cpu-prev.cpu) / float64(now.Sub(prev.when)) * 100
+			if percent < 0 {
+				percent = 0
+			}
+			procSamples[inst.ID] = procSample{s.cpu, now, percent}
+		}
+		inst.CPUPercent = procSamples[inst.ID].percent
+	}
+	for id := range procSamples {
+		if !seen[id] {
+			delete(procSamples, id)
+		}
+	}
+}
+
+// parseCPUTime parses the cumulative CPU time ps prints: [[dd-]hh:]mm:ss,
+// with fractional seconds on macOS.
+func parseCPUTime(s string) (time.Duration, bool) {
+	var days int
+	if i := strings.Index(s, "-"); i >= 0 {
+		d, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, false
+		}
+		days, s = d, s[i+1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	secs, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, false
+	}
+	total := secs + float64(days)*86400
+	for i, unit := range []float64{60, 3600} {
+		if len(parts)-2-i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(parts[len(parts)-2-i])
+		if err != nil {
+			return 0, false
+		}
+		total += float64(n) * unit
+	}
+	return time.Duration(total * float64(time.Second)), true
+}
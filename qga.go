@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// GuestInfo is the last data collected from a VM's qemu-guest-agent.
+type GuestInfo struct {
+	AgentVersion string           `json:"agent_version"`
+	Hostname     string           `json:"hostname"`
+	OS           GuestOSInfo      `json:"os"`
+	Interfaces   []GuestInterface `json:"interfaces"`
+	Filesystems  []GuestFS        `json:"filesystems"`
+	LastSeen     string           `json:"last_seen"`
+	Error        string           `json:"error,omitempty"`
+}
+
+type GuestOSInfo struct {
+	ID            string `json:"id,omitempty"`
+	Name          string `json:"name,omitempty"`
+	PrettyName    string `json:"pretty-name,omitempty"`
+	Version       string `json:"version,omitempty"`
+	KernelRelease string `json:"kernel-release,omitempty"`
+	Machine       string `json:"machine,omitempty"`
+}
+
+type GuestInterface struct {
+	Name        string           `json:"name"`
+	MAC         string           `json:"hardware-address"`
+	IPAddresses []GuestIPAddress `json:"ip-addresses"`
+}
+
+type GuestIPAddress struct {
+	Type    string `json:"ip-address-type"`
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+type GuestFS struct {
+	Name       string `json:"name"`
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	UsedBytes  uint64 `json:"used-bytes,omitempty"`
+	TotalBytes uint64 `json:"total-bytes,omitempty"`
+}
+
+type GuestExecResult struct {
+	PID      int    `json:"pid"`
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	Signal   int    `json:"signal,omitempty"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+}
+
+const qgaTimeout = 3 * time.Second
+
+const (
+	defaultGuestExecTimeout = 30 * time.Second
+	maxGuestExecTimeout     = 300 * time.Second
+	guestExecPollInterval   = 200 * time.Millisecond
+)
+
+var (
+	runtimeDir = filepath.Join(os.TempDir(), "qemu-monitor")
+
+	guestInfoMu sync.Mutex
+	guestInfo   = map[string]*GuestInfo{}
+
+	// qgaLocks hold one lock per VM: the agent channel serves one client
+	// at a time, and a second connection would resync away the first
+	// one's replies.
+	qgaLocksMu sync.Mutex
+	qgaLocks   = map[string]*sync.Mutex{}
+)
+
+func qgaLock(name string) *sync.Mutex {
+	qgaLocksMu.Lock()
+	defer qgaLocksMu.Unlock()
+	l := qgaLocks[name]
+	if l == nil {
+		l = &sync.Mutex{}
+		qgaLocks[name] = l
+	}
+	return l
+}
+
+func qgaSocketPath(name string) string {
+	return filepath.Join(runtimeDir, name+".qga")
+}
+
+type qgaClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	lock   *sync.Mutex
+}
+
+type qgaResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// dialQGA connects to the guest agent socket of a VM and synchronises the
+// channel so stale replies from an earlier client are discarded. It holds
+// the VM's agent lock until Close.
+func dialQGA(name string) (*qgaClient, error) {
+	lock := qgaLock(name)
+	lock.Lock()
+	return connectQGA(name, lock)
+}
+
+// tryDialQGA is dialQGA for the poller: it returns nil without waiting
+// when another client holds the agent.
+func tryDialQGA(name string) (*qgaClient, error) {
+	lock := qgaLock(name)
+	if !lock.TryLock() {
+		return nil, nil
+	}
+	return connectQGA(name, lock)
+}
+
+func connectQGA(name string, lock *sync.Mutex) (*qgaClient, error) {
+	conn, err := net.DialTimeout("unix", qgaSocketPath(name), qgaTimeout)
+	if err != nil {
+		lock.Unlock()
+		return nil, newAPIError(http.StatusConflict, "agent_unavailable", "guest agent not reachable: %v", err)
+	}
+	c := &qgaClient{conn: conn, reader: bufio.NewReader(conn), lock: lock}
+	if err := c.sync(); err != nil {
+		c.Close()
+		return nil, newAPIError(http.StatusConflict, "agent_unavailable", "%v", err)
+	}
+	return c, nil
+}
+
+func (c *qgaClient) Close() error {
+	defer c.lock.Unlock()
+	return c.conn.Close()
+}
+
+func (c *qgaClient) sync() error {
+	id := rand.Int63n(1 << 31)
+	c.conn.SetDeadline(time.Now().Add(qgaTimeout))
+	req, _ := json.Marshal(map[string]interface{}{
+		"execute":   "guest-sync",
+		"arguments": map[string]int64{"id": id},
+	})
+	if _, err := c.conn.Write(append(req, '\n')); err != nil {
+		return fmt.Errorf("guest-sync failed: %v", err)
+	}
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("guest-sync failed: %v", err)
+		}
+		var resp struct {
+			Return int64 `json:"return"`
+		}
+		if json.Unmarshal(line, &resp) == nil && resp.Return == id {
+			return nil
+		}
+	}
+}
+
+// execute runs a QGA command and decodes its "return" value into out.
+func (c *qgaClient) execute(command string, args interface{}, out interface{}) error {
+	c.conn.SetDeadline(time.Now().Add(qgaTimeout))
+	msg := map[string]interface{}{"execute": command}
+	if args != nil {
+		msg["arguments"] = args
+	}
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(append(req, '\n')); err != nil {
+		return newAPIError(http.StatusInternalServerError, "agent_failed", "%s failed: %v", command, err)
+	}
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return newAPIError(http.StatusInternalServerError, "agent_failed", "%s failed: %v", command, err)
+	}
+	var resp qgaResponse
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return newAPIError(http.StatusInternalServerError, "agent_failed", "%s: invalid response: %v", command, err)
+	}
+	if resp.Error != nil {
+		return newAPIError(http.StatusInternalServerError, "agent_failed", "%s: %s", command, resp.Error.Desc)
+	}
+	if out != nil && len(resp.Return) > 0 {
+		return json.Unmarshal(resp.Return, out)
+	}
+	return nil
+}
+
+// queryGuestInfo collects a fresh GuestInfo, or returns nil when a
+// request is using the agent.
+func queryGuestInfo(name string) *GuestInfo {
+	info := &GuestInfo{LastSeen: time.Now().Format("2006-01-02 15:04:05")}
+
+	c, err := tryDialQGA(name)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	if c == nil {
+		return nil
+	}
+	defer c.Close()
+
+	var agent struct {
+		Version string `json:"version"`
+	}
+	if err := c.execute("guest-info", nil, &agent); err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.AgentVersion = agent.Version
+
+	var host struct {
+		Hostname string `json:"host-name"`
+	}
+	if err := c.execute("guest-get-host-name", nil, &host); err == nil {
+		info.Hostname = host.Hostname
+	}
+	if err := c.execute("guest-get-osinfo", nil, &info.OS); err != nil {
+		log.Printf("QGA %s: %v", name, err)
+	}
+	if err := c.execute("guest-network-get-interfaces", nil, &info.Interfaces); err != nil {
+		log.Printf("QGA %s: %v", name, err)
+	}
+	if err := c.execute("guest-get-fsinfo", nil, &info.Filesystems); err != nil {
+		log.Printf("QGA %s: %v", name, err)
+	}
+	return info
+}
+
+// pollGuestAgents refreshes guest info for every running instance that has
+// the guest agent enabled and copies the summary onto the instances. The
+// agents are queried in parallel so one that does not answer costs a
+// single timeout per poll. A VM whose agent is busy keeps its last info.
+func pollGuestAgents(instances []QEMUInstance) {
+	enabled := map[string]bool{}
+	configMu.Lock()
+	for _, vm := range vmsConfig.VMs {
+		enabled[vm.Name] = vm.GuestAgent
+	}
+	configMu.Unlock()
+
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for i := range instances {
+		if !enabled[instances[i].Name] {
+			continue
+		}
+		seen[instances[i].Name] = true
+
+		wg.Add(1)
+		go func(inst *QEMUInstance) {
+			defer wg.Done()
+			info := queryGuestInfo(inst.Name)
+
+			guestInfoMu.Lock()
+			if info == nil {
+				info = guestInfo[inst.Name]
+			} else {
+				guestInfo[inst.Name] = info
+			}
+			guestInfoMu.Unlock()
+
+			if info != nil {
+				applyGuestInfo(inst, info)
+			}
+		}(&instances[i])
+	}
+	wg.Wait()
+
+	guestInfoMu.Lock()
+	for name := range guestInfo {
+		if !seen[name] {
+			delete(guestInfo, name)
+		}
+	}
+	guestInfoMu.Unlock()
+}
+
+func applyGuestInfo(instance *QEMUInstance, info *GuestInfo) {
+	instance.GuestHostname = info.Hostname
+	instance.GuestOS = info.OS.PrettyName
+	if instance.GuestOS == "" {
+		instance.GuestOS = info.OS.Name
+	}
+	instance.GuestIPs = nil
+	for _, iface := range info.Interfaces {
+		if iface.Name == "lo" {
+			continue
+		}
+		for _, addr := range iface.IPAddresses {
+			instance.GuestIPs = append(instance.GuestIPs, addr.Address)
+		}
+	}
+}
+
+func getGuestInfo(name string) (*GuestInfo, error) {
+	vm, ok := lookupVM(name)
+	if !ok {
+		return nil, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name)
+	}
+	if !vm.GuestAgent {
+		return nil, newAPIError(http.StatusConflict, "agent_unavailable", "guest agent not enabled for VM: %s", name)
+	}
+
+	guestInfoMu.Lock()
+	info := guestInfo[name]
+	guestInfoMu.Unlock()
+	if info == nil {
+		return nil, newAPIError(http.StatusNotFound, "not_found", "no guest agent data for VM: %s", name)
+	}
+	return info, nil
+}
+
+// guestExec runs a program in the guest and waits up to timeout (at most
+// maxGuestExecTimeout) for it to exit, returning its captured output. The
+// agent is only held for each request, so polls and other callers can use
+// it while the program runs.
+func guestExec(name, path string, args []string, input string, timeout time.Duration) (*GuestExecResult, error) {
+	if timeout <= 0 {
+		timeout = defaultGuestExecTimeout
+	}
+	if timeout > maxGuestExecTimeout {
+		timeout = maxGuestExecTimeout
+	}
+
+	req := map[string]interface{}{
+		"path":           path,
+		"arg":            args,
+		"capture-output": true,
+	}
+	if input != "" {
+		req["input-data"] = base64.StdEncoding.EncodeToString([]byte(input))
+	}
+
+	var started struct {
+		PID int `json:"pid"`
+	}
+	if err := qgaExecute(name, "guest-exec", req, &started); err != nil {
+		return nil, err
+	}
+
+	result := &GuestExecResult{PID: started.PID}
+	deadline := time.Now().Add(timeout)
+	for {
+		var status struct {
+			Exited   bool   `json:"exited"`
+			ExitCode int    `json:"exitcode"`
+			Signal   int    `json:"signal"`
+			OutData  string `json:"out-data"`
+			ErrData  string `json:"err-data"`
+		}
+		if err := qgaExecute(name, "guest-exec-status", map[string]int{"pid": started.PID}, &status); err != nil {
+			return nil, err
+		}
+		if status.Exited {
+			stdout, _ := base64.StdEncoding.DecodeString(status.OutData)
+			stderr, _ := base64.StdEncoding.DecodeString(status.ErrData)
+			result.Exited = true
+			result.ExitCode = status.ExitCode
+			result.Signal = status.Signal
+			result.Stdout = string(stdout)
+			result.Stderr = string(stderr)
+			return result, nil
+		}
+		if time.Now().After(deadline) {
+			return result, nil
+		}
+		time.Sleep(guestExecPollInterval)
+	}
+}
+
+// qgaExecute is a one-shot helper that dials, runs a command and closes,
+// so the agent lock is held for that command only.
+func qgaExecute(name, command string, args interface{}, out interface{}) error {
+	c, err := dialQGA(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.execute(command, args, out)
+}
+
+// guestFSFreeze freezes, thaws or reports the freeze state of guest filesystems.
+func guestFSFreeze(name, action string) (interface{}, error) {
+	var command string
+	switch action {
+	case "freeze":
+		command = "guest-fsfreeze-freeze"
+	case "thaw":
+		command = "guest-fsfreeze-thaw"
+	case "status", "":
+		command = "guest-fsfreeze-status"
+	default:
+		return nil, statusErrorf(http.StatusBadRequest, "invalid fsfreeze action: %s", action)
+	}
+
+	c, err := dialQGA(name)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	var result interface{}
+	if err := c.execute(command, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// guestSetTime sets the guest clock. A zero nsec syncs from the host clock.
+func guestSetTime(name string, nsec int64) error {
+	c, err := dialQGA(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if nsec == 0 {
+		nsec = time.Now().UnixNano()
+	}
+	return c.execute("guest-set-time", map[string]int64{"time": nsec}, nil)
+}
+
+func handleGuestInfo(w http.ResponseWriter, r *http.Request, name string) {
+	info, err := getGuestInfo(name)
+	if err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+func handleGuestExec(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Path    string   `json:"path"`
+		Args    []string `json:"args"`
+		Input   string   `json:"input"`
+		Timeout int      `json:"timeout"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+		legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+		return
+	}
+	result, err := guestExec(name, req.Path, req.Args, req.Input, time.Duration(req.Timeout)*time.Second)
+	if err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	log.Printf("Guest exec on %s: %s (exit %d)", name, req.Path, result.ExitCode)
+	json.NewEncoder(w).Encode(result)
+}
+
+func handleGuestFSFreeze(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Action string `json:"action"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+		return
+	}
+
+	result, err := guestFSFreeze(name, req.Action)
+	if err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "action": req.Action, "result": result})
+}
+
+func handleGuestTime(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Time int64 `json:"time"`
+	}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			legacyError(w, r, statusError(http.StatusBadRequest, "Invalid request"))
+			return
+		}
+	}
+
+	if err := guestSetTime(name, req.Time); err != nil {
+		legacyError(w, r, err)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "time set", "name": name})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const qmpTimeout = 5 * time.Second
+
+func qmpSocketPath(name string) string {
+	return filepath.Join(runtimeDir, name+".qmp")
+}
+
+type qmpClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Event  string          `json:"event"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+}
+
+// dialQMP connects to a VM's QMP socket and negotiates capabilities.
+func dialQMP(name string) (*qmpClient, error) {
+	conn, err := net.DialTimeout("unix", qmpSocketPath(name), qmpTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("QMP not reachable for %s: %v", name, err)
+	}
+	c := &qmpClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	// Greeting
+	c.conn.SetDeadline(time.Now().Add(qmpTimeout))
+	if _, err := c.reader.ReadBytes('\n'); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("QMP greeting failed: %v", err)
+	}
+	if err := c.execute("qmp_capabilities", nil, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *qmpClient) Close() error {
+	return c.conn.Close()
+}
+
+// execute runs a QMP command and decodes its "return" value into out.
+// Asynchronous events received while waiting are skipped.
+func (c *qmpClient) execute(command string, args interface{}, out interface{}) error {
+	c.conn.SetDeadline(time.Now().Add(qmpTimeout))
+	msg := map[string]interface{}{"execute": command}
+	if args != nil {
+		msg["arguments"] = args
+	}
+	req, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(append(req, '\n')); err != nil {
+		return fmt.Errorf("%s failed: %v", command, err)
+	}
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			return fmt.Errorf("%s failed: %v", command, err)
+		}
+		var resp qmpResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return fmt.Errorf("%s: invalid response: %v", command, err)
+		}
+		if resp.Event != "" {
+			continue
+		}
+		if resp.Error != nil {
+			return fmt.Errorf("%s: %s", command, resp.Error.Desc)
+		}
+		if out != nil && len(resp.Return) > 0 {
+			return json.Unmarshal(resp.Return, out)
+		}
+		return nil
+	}
+}
+
+// hmp runs a human monitor command through the QMP passthrough. HMP
+// commands report most failures as text output rather than QMP errors, so
+// callers must inspect the returned output.
+func (c *qmpClient) hmp(commandLine string) (string, error) {
+	var output string
+	err := c.execute("human-monitor-command", map[string]string{"command-line": commandLine}, &output)
+	return strings.TrimSpace(output), err
+}
+
+// qmpExecute is a one-shot helper that dials, runs a command and closes.
+func qmpExecute(name, command string, args interface{}, out interface{}) error {
+	c, err := dialQMP(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.execute(command, args, out)
+}
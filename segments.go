@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Segment is a named virtual LAN that VM NICs can attach to.
+type Segment struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`              // "udp-mcast", "stream" or "vde"
+	Address string `json:"address,omitempty"` // mcast group or stream listen host
+	Port    int    `json:"port,omitempty"`    // defaults to segmentBasePort + index
+	Path    string `json:"path,omitempty"`    // vde switch directory
+}
+
+type SegmentMember struct {
+	VM      string `json:"vm"`
+	Netdev  string `json:"netdev"`
+	MAC     string `json:"mac"`
+	Running bool   `json:"running"`
+	Role    string `json:"role,omitempty"` // "server" or "client" for stream segments
+}
+
+type SegmentTopology struct {
+	Segment
+	Endpoint string          `json:"endpoint"`
+	Members  []SegmentMember `json:"members"`
+}
+
+const (
+	segmentBasePort   = 24000
+	defaultMcastGroup = "230.0.0.1"
+)
+
+func findSegment(name string) (*Segment, int) {
+	for i := range vmsConfig.Segments {
+		if vmsConfig.Segments[i].Name == name {
+			return &vmsConfig.Segments[i], i
+		}
+	}
+	return nil, -1
+}
+
+func segmentPort(seg *Segment, index int) int {
+	if seg.Port != 0 {
+		return seg.Port
+	}
+	return segmentBasePort + index
+}
+
+func segmentVDEPath(seg *Segment) string {
+	if seg.Path != "" {
+		return seg.Path
+	}
+	return filepath.Join(runtimeDir, "vde-"+seg.Name)
+}
+
+// segmentMembers lists the NICs attached to a segment, in config order.
+func segmentMembers(name string) []SegmentMember {
+	members := []SegmentMember{}
+	for _, vm := range vmsConfig.VMs {
+		for _, net := range vm.Networks {
+			if net.Segment == name {
+				members = append(members, SegmentMember{
+					VM:      vm.Name,
+					Netdev:  net.ID,
+					MAC:     net.MAC,
+					Running: isRunning(vm.Name),
+				})
+			}
+		}
+	}
+	return members
+}
+
+// segmentNetdevArg renders the -netdev argument for a NIC on a segment.
+// For stream segments the first member in config order listens and the
+// other connects to it.
+func segmentNetdevArg(vm *VMConfig, net VMNetwork) (string, error) {
+	seg, index := findSegment(net.Segment)
+	if seg == nil {
+		return "", statusErrorf(http.StatusConflict, "segment not found: %s", net.Segment)
+	}
+	port := segmentPort(seg, index)
+
+	switch seg.Kind {
+	case "udp-mcast":
+		group := seg.Address
+		if group == "" {
+			group = defaultMcastGroup
+		}
+		return fmt.Sprintf("socket,id=%s,mcast=%s:%d", net.ID, group, port), nil
+	case "stream":
+		host := seg.Address
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		members := segmentMembers(seg.Name)
+		if len(members) > 2 {
+			return "", statusErrorf(http.StatusConflict, "stream segment %s is point-to-point but has %d members", seg.Name, len(members))
+		}
+		if members[0].VM == vm.Name && members[0].Netdev == net.ID {
+			return fmt.Sprintf("stream,id=%s,server=on,addr.type=inet,addr.host=%s,addr.port=%d", net.ID, host, port), nil
+		}
+		return fmt.Sprintf("stream,id=%s,server=off,reconnect=1,addr.type=inet,addr.host=%s,addr.port=%d", net.ID, host, port), nil
+	case "vde":
+		return fmt.Sprintf("vde,id=%s,sock=%s", net.ID, segmentVDEPath(seg)), nil
+	default:
+		return "", statusErrorf(http.StatusConflict, "segment %s has unknown kind: %s", seg.Name, seg.Kind)
+	}
+}
+
+// ensureSegments validates the VM's segment attachments and starts a
+// vde_switch for any vde segment that is not already running.
+func ensureSegments(vm *VMConfig) error {
+	for _, net := range vm.Networks {
+		if net.Segment == "" {
+			continue
+		}
+		if _, err := segmentNetdevArg(vm, net); err != nil {
+			return err
+		}
+		seg, _ := findSegment(net.Segment)
+		if seg.Kind != "vde" {
+			continue
+		}
+		path := segmentVDEPath(seg)
+		if _, err := os.Stat(filepath.Join(path, "ctl")); err == nil {
+			continue
+		}
+		cmd := exec.Command("vde_switch", "--sock", path, "--daemon")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to start vde_switch for %s: %v - %s", seg.Name, err, string(output))
+		}
+		log.Printf("Started vde_switch for segment %s at %s", seg.Name, path)
+	}
+	return nil
+}
+
+// segmentConflicts reports segment references and memberships that cannot
+// be wired up.
+func segmentConflicts() []string {
+	conflicts := []string{}
+	for _, vm := range vmsConfig.VMs {
+		for _, net := range vm.Networks {
+			if net.Segment == "" {
+				continue
+			}
+			if seg, _ := findSegment(net.Segment); seg == nil {
+				conflicts = append(conflicts, fmt.Sprintf("VM %s netdev %s references unknown segment %s", vm.Name, net.ID, net.Segment))
+			}
+		}
+	}
+	for i, seg := range vmsConfig.Segments {
+		switch seg.Kind {
+		case "udp-mcast", "vde":
+		case "stream":
+			if n := len(segmentMembers(seg.Name)); n > 2 {
+				conflicts = append(conflicts, fmt.Sprintf("stream segment %s has %d members, at most 2 allowed", seg.Name, n))
+			}
+		default:
+			conflicts = append(conflicts, fmt.Sprintf("segment %s has unknown kind %q", seg.Name, seg.Kind))
+		}
+		for j, other := range vmsConfig.Segments[:i] {
+			if other.Name == seg.Name {
+				conflicts = append(conflicts, fmt.Sprintf("segment %s is defined twice", seg.Name))
+			} else if other.Kind != "vde" && seg.Kind != "vde" && segmentPort(&other, j) == segmentPort(&seg, i) {
+				conflicts = append(conflicts, fmt.Sprintf("segments %s and %s share port %d", other.Name, seg.Name, segmentPort(&seg, i)))
+			}
+		}
+	}
+	return conflicts
+}
+
+func getTopology() []SegmentTopology {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	topology := []SegmentTopology{}
+	for i := range vmsConfig.Segments {
+		seg := vmsConfig.Segments[i]
+		t := SegmentTopology{Segment: seg, Members: segmentMembers(seg.Name)}
+		switch seg.Kind {
+		case "udp-mcast":
+			group := seg.Address
+			if group == "" {
+				group = defaultMcastGroup
+			}
+			t.Endpoint = fmt.Sprintf("%s:%d", group, segmentPort(&seg, i))
+		case "stream":
+			host := seg.Address
+			if host == "" {
+				host = "127.0.0.1"
+			}
+			t.Endpoint = fmt.Sprintf("%s:%d", host, segmentPort(&seg, i))
+			for j := range t.Members {
+				if j == 0 {
+					t.Members[j].Role = "server"
+				} else {
+					t.Members[j].Role = "client"
+				}
+			}
+		case "vde":
+			t.Endpoint = segmentVDEPath(&seg)
+		}
+		topology = append(topology, t)
+	}
+	return topology
+}
+
+func handleTopology(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"segments": getTopology()})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serialBacklog is how much recent serial output is replayed to a client
+// that attaches, so a boot log or login prompt is not lost.
+const serialBacklog = 64 * 1024
+
+func serialSocketPath(name string) string {
+	return filepath.Join(runtimeDir, name+".serial")
+}
+
+// serialConsole holds the one connection QEMU accepts on a VM's serial
+// socket and fans its output out to every attached client. It stays
+// connected after the last client leaves so the backlog keeps filling,
+// until the VM exits.
+type serialConsole struct {
+	name    string
+	conn    net.Conn
+	mu      sync.Mutex
+	backlog []byte
+	clients map[chan []byte]struct{}
+}
+
+var (
+	serialConsolesMu sync.Mutex
+	serialConsoles   = map[string]*serialConsole{}
+)
+
+// attachSerial connects to a VM's serial console, dialing the socket on
+// first use. The channel receives output until the console closes; the
+// backlog is what was printed before.
+func attachSerial(name string) (*serialConsole, chan []byte, []byte, error) {
+	serialConsolesMu.Lock()
+	defer serialConsolesMu.Unlock()
+
+	sc := serialConsoles[name]
+	if sc == nil {
+		if !isRunning(name) {
+			return nil, nil, nil, newAPIError(http.StatusConflict, "not_running", "VM is not running: %s", name)
+		}
+		conn, err := net.DialTimeout("unix", serialSocketPath(name), qmpTimeout)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("serial console not reachable for %s: %v", name, err)
+		}
+		sc = &serialConsole{name: name, conn: conn, clients: map[chan []byte]struct{}{}}
+		serialConsoles[name] = sc
+		go sc.read()
+	}
+
+	ch := make(chan []byte, 256)
+	sc.mu.Lock()
+	sc.clients[ch] = struct{}{}
+	backlog := append([]byte(nil), sc.backlog...)
+	sc.mu.Unlock()
+	return sc, ch, backlog, nil
+}
+
+func (sc *serialConsole) read() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := sc.conn.Read(buf)
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			sc.mu.Lock()
+			sc.backlog = append(sc.backlog, data...)
+			if over := len(sc.backlog) - serialBacklog; over > 0 {
+				sc.backlog = sc.backlog[over:]
+			}
+			for ch := range sc.clients {
+				select {
+				case ch <- data:
+				default:
+				}
+			}
+			sc.mu.Unlock()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	serialConsolesMu.Lock()
+	delete(serialConsoles, sc.name)
+	serialConsolesMu.Unlock()
+	sc.conn.Close()
+	sc.mu.Lock()
+	for ch := range sc.clients {
+		close(ch)
+	}
+	sc.clients = nil
+	sc.mu.Unlock()
+}
+
+// detach stops delivering output to a client.
+func (sc *serialConsole) detach(ch chan []byte) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.clients[ch]; ok {
+		delete(sc.clients, ch)
+		close(ch)
+	}
+}
+
+func (sc *serialConsole) Write(p []byte) (int, error) {
+	sc.conn.SetWriteDeadline(time.Now().Add(qmpTimeout))
+	return sc.conn.Write(p)
+}
+
+// handleSerial bridges a WebSocket to a VM's serial console. It speaks the
+// terminal protocol: output as binary messages, keystrokes as "input"
+// messages. The console has no size, so "resize" is ignored.
+func handleSerial(w http.ResponseWriter, r *http.Request, name string) {
+	// Attach first, so a client learns why it cannot connect
+	sc, output, backlog, err := attachSerial(name)
+	if err != nil {
+		audit(r, principalFrom(r), "serial.open", name, nil, "error", err.Error())
+		w.Header().Set("Content-Type", "application/json")
+		legacyError(w, r, err)
+		return
+	}
+	defer sc.detach(output)
+
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Serial console upgrade failed for %s: %v", name, err)
+		return
+	}
+	defer ws.Close()
+	log.Printf("Serial console of %s opened from %s", name, r.RemoteAddr)
+	audit(r, principalFrom(r), "serial.open", name, nil, "ok", "")
+	opened := time.Now()
+	defer func() {
+		audit(r, principalFrom(r), "serial.close", name,
+			map[string]interface{}{"duration": time.Since(opened).Round(time.Second).String()}, "ok", "")
+	}()
+
+	// Client input -> guest
+	go func() {
+		defer sc.detach(output)
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg terminalMessage
+			if json.Unmarshal(data, &msg) == nil && msg.Type == "input" {
+				sc.Write([]byte(msg.Data))
+			}
+		}
+	}()
+
+	// Guest output -> client
+	if len(backlog) > 0 && ws.WriteMessage(websocket.BinaryMessage, backlog) != nil {
+		return
+	}
+	for data := range output {
+		if ws.WriteMessage(websocket.BinaryMessage, data) != nil {
+			return
+		}
+	}
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "console closed"))
+}
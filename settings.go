@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Settings are the monitor's own options, as opposed to the VMs it
+// manages. Each comes from a flag, else the environment, else the settings
+// file, else its default, so the defaults keep the monitor working from
+// its directory as before.
+type Settings struct {
+	Listen       []string          `json:"listen"` // host:port or unix:/path
+	PollInterval string            `json:"poll_interval"`
+	Config       string            `json:"config"`
+	StateDir     string            `json:"state_dir"`   // port assignments, backups, captures, TLS files
+	LogDir       string            `json:"log_dir"`     // audit log and terminal recordings
+	RuntimeDir   string            `json:"runtime_dir"` // QMP, guest agent and serial sockets
+	QEMUPath     []string          `json:"qemu_path"`   // searched for QEMU binaries before $PATH
+	QEMUBinary   string            `json:"qemu_binary"`
+	File         string            `json:"file,omitempty"` // the settings file read, if any
+	Sources      map[string]string `json:"sources"`        // "flag", "env", "file" or "default" per setting
+}
+
+// settingDef describes one setting. Its flag is the key with dashes.
+type settingDef struct {
+	key   string
+	env   string
+	def   string
+	sep   string // separator of list values, "" for single values
+	path  bool   // relative paths in the settings file are relative to it
+	usage string
+}
+
+const defaultSettingsFile = "qemu-monitor.json"
+
+var settingDefs = []settingDef{
+	{"listen", "QEMU_MONITOR_LISTEN", "0.0.0.0:5450", ",", false, "address to serve on, host:port or unix:/path; repeat for several"},
+	{"poll_interval", "QEMU_MONITOR_POLL_INTERVAL", "5s", "", false, "how often QEMU processes are listed"},
+	{"config", "QEMU_MONITOR_CONFIG", "vms.json", "", true, "VM configuration file"},
+	{"state_dir", "QEMU_MONITOR_STATE_DIR", ".", "", true, "directory for port assignments, backups, captures and TLS files"},
+	{"log_dir", "QEMU_MONITOR_LOG_DIR", ".", "", true, "directory for the audit log and terminal recordings"},
+	{"runtime_dir", "QEMU_MONITOR_RUNTIME_DIR", filepath.Join(os.TempDir(), "qemu-monitor"), "", true, "directory for VM control sockets"},
+	{"qemu_path", "QEMU_MONITOR_QEMU_PATH", "", string(os.PathListSeparator), true, "directories searched for QEMU binaries before $PATH"},
+	{"qemu_binary", "QEMU_MONITOR_QEMU_BINARY", "qemu-system-aarch64", "", false, "QEMU system emulator to launch and to list processes of"},
+}
+
+var (
+	settings     Settings
+	pollInterval = 5 * time.Second
+	qemuBinary   = "qemu-system-aarch64"
+	qemuPath     []string
+)
+
+// listFlag is a flag that may be given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// settingsFlags are the settings flags of one command.
+type settingsFlags struct {
+	fs   *flag.FlagSet
+	file string
+}
+
+// addSettingsFlags registers --settings on a command, and with all every
+// setting as a flag. Commands that only talk to a server need just the
+// file, for the address to reach it on.
+func addSettingsFlags(fs *flag.FlagSet, all bool) *settingsFlags {
+	sf := &settingsFlags{fs: fs}
+	fs.StringVar(&sf.file, "settings", "", "settings file (default $QEMU_MONITOR_SETTINGS, else "+defaultSettingsFile+" when present)")
+	if !all {
+		return sf
+	}
+	for _, def := range settingDefs {
+		name := strings.ReplaceAll(def.key, "_", "-")
+		if def.key == "listen" {
+			fs.Var(&listFlag{}, name, def.usage)
+			continue
+		}
+		fs.String(name, "", def.usage)
+	}
+	return sf
+}
+
+// apply resolves the settings once the flags are parsed and puts them in
+// effect.
+func (sf *settingsFlags) apply() error {
+	flags := map[string]string{}
+	sf.fs.Visit(func(f *flag.Flag) {
+		flags[strings.ReplaceAll(f.Name, "-", "_")] = f.Value.String()
+	})
+	s, err := resolveSettings(sf.file, flags)
+	if err != nil {
+		return err
+	}
+	applySettings(s)
+	return nil
+}
+
+// resolveSettings layers flags over the environment over the settings
+// file over the defaults.
+func resolveSettings(file string, flags map[string]string) (Settings, error) {
+	s := Settings{Sources: map[string]string{}}
+
+	explicit := true
+	if file == "" {
+		file = os.Getenv("QEMU_MONITOR_SETTINGS")
+	}
+	if file == "" {
+		file, explicit = defaultSettingsFile, false
+	}
+	fromFile := map[string]string{}
+	data, err := ioutil.ReadFile(file)
+	switch {
+	case err == nil:
+		if fromFile, err = parseSettingsFile(file, data); err != nil {
+			return s, err
+		}
+		s.File = file
+	case explicit || !os.IsNotExist(err):
+		return s, err
+	}
+
+	values := map[string]string{}
+	for _, def := range settingDefs {
+		value, source := def.def, "default"
+		if v, ok := fromFile[def.key]; ok {
+			value, source = v, "file"
+		}
+		if v := os.Getenv(def.env); v != "" {
+			value, source = v, "env"
+		}
+		if v, ok := flags[def.key]; ok {
+			value, source = v, "flag"
+		}
+		values[def.key] = value
+		s.Sources[def.key] = source
+	}
+
+	s.Listen = splitSetting(values["listen"], ",")
+	s.PollInterval = values["poll_interval"]
+	s.Config = values["config"]
+	s.StateDir = values["state_dir"]
+	s.LogDir = values["log_dir"]
+	s.RuntimeDir = values["runtime_dir"]
+	s.QEMUPath = splitSetting(values["qemu_path"], string(os.PathListSeparator))
+	s.QEMUBinary = values["qemu_binary"]
+	return s, s.validate()
+}
+
+// parseSettingsFile reads a settings file: a JSON object of settings,
+// with lists as arrays.
+func parseSettingsFile(file string, data []byte) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, jsonErrorPosition(data, err))
+	}
+	values := map[string]string{}
+	for key, msg := range raw {
+		var def *settingDef
+		for i := range settingDefs {
+			if settingDefs[i].key == key {
+				def = &settingDefs[i]
+			}
+		}
+		if def == nil {
+			return nil, fmt.Errorf("%s: unknown setting %q", file, key)
+		}
+
+		var items []string
+		var single string
+		if json.Unmarshal(msg, &single) == nil {
+			items = []string{single}
+		} else if def.sep == "" {
+			return nil, fmt.Errorf("%s: %s must be a string", file, key)
+		} else if json.Unmarshal(msg, &items) != nil {
+			return nil, fmt.Errorf("%s: %s must be a string or a list of strings", file, key)
+		}
+		for i, item := range items {
+			if def.path && item != "" && !filepath.IsAbs(item) {
+				items[i] = filepath.Join(filepath.Dir(file), item)
+			}
+		}
+		values[key] = strings.Join(items, def.sep)
+	}
+	return values, nil
+}
+
+func splitSetting(value, sep string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (s Settings) validate() error {
+	if len(s.Listen) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	for _, addr := range s.Listen {
+		if strings.HasPrefix(addr, "unix:") {
+			if strings.TrimPrefix(addr, "unix:") == "" {
+				return fmt.Errorf("invalid listen address: %s", addr)
+			}
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listen address: %s", addr)
+		}
+	}
+	if d, err := time.ParseDuration(s.PollInterval); err != nil || d < time.Second {
+		return fmt.Errorf("invalid poll_interval %q: must be a duration of at least 1s", s.PollInterval)
+	}
+	for key, value := range map[string]string{"config": s.Config, "state_dir": s.StateDir, "log_dir": s.LogDir, "runtime_dir": s.RuntimeDir, "qemu_binary": s.QEMUBinary} {
+		if value == "" {
+			return fmt.Errorf("%s must not be empty", key)
+		}
+	}
+	return nil
+}
+
+// applySettings points the monitor's files at the configured directories.
+func applySettings(s Settings) {
+	settings = s
+	pollInterval, _ = time.ParseDuration(s.PollInterval)
+	configPath = s.Config
+	portStatePath = filepath.Join(s.StateDir, "port-assignments.json")
+	backupsDir = filepath.Join(s.StateDir, "backups")
+	capturesDir = filepath.Join(s.StateDir, "captures")
+	tlsDir = filepath.Join(s.StateDir, "tls")
+	auditLogPath = filepath.Join(s.LogDir, "audit.log")
+	auditHeadPath = filepath.Join(s.StateDir, "audit-head.json")
+	recordingsDir = filepath.Join(s.LogDir, "recordings")
+	runtimeDir = s.RuntimeDir
+	qemuBinary = s.QEMUBinary
+	qemuPath = s.QEMUPath
+}
+
+// makeSettingsDirs creates the state and log directories for a process
+// that writes to them.
+func makeSettingsDirs() error {
+	for _, dir := range []string{settings.StateDir, settings.LogDir} {
+		if dir == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// qemuCommand finds a QEMU program, such as qemu-img, in qemu_path. Other
+// names are left to $PATH, and to sudo's own path when launched through
+// it. A name with a directory is used as is.
+func qemuCommand(name string) string {
+	if strings.ContainsRune(name, filepath.Separator) {
+		return name
+	}
+	for _, dir := range qemuPath {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return path
+		}
+	}
+	return name
+}
+
+// listenOn opens a listen address. A stale unix socket left by an earlier
+// run is replaced; the new one is for its owner and group only.
+func listenOn(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// qemuProcessName is what QEMU processes are recognised by in ps output.
+func qemuProcessName() string {
+	return filepath.Base(qemuBinary)
+}
+
+// defaultServer is the URL client commands reach the server on: the first
+// TCP listen address, on loopback when it listens on all interfaces, or
+// else its first unix socket.
+func defaultServer() (string, string) {
+	socket := ""
+	for _, addr := range settings.Listen {
+		if strings.HasPrefix(addr, "unix:") {
+			if socket == "" {
+				socket = strings.TrimPrefix(addr, "unix:")
+			}
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		return "http://" + net.JoinHostPort(host, port), ""
+	}
+	return "http://localhost", socket
+}
+
+// handleSettings reports the effective settings.
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(settings)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// processStartTime returns when a process started, as reported by ps. Its
+// PID plus start time identifies a process even after the PID is reused.
+func processStartTime(pid string) (time.Time, error) {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", pid).Output()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("no process with PID %s", pid)
+	}
+	lstart := strings.Join(strings.Fields(string(out)), " ")
+	return time.ParseInLocation("Mon Jan 2 15:04:05 2006", lstart, time.Local)
+}
+
+// instanceID is the stable ID of a QEMU process, "<pid>-<start unix time>".
+func instanceID(pid string) string {
+	started, err := processStartTime(pid)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%d", pid, started.Unix())
+}
+
+// ownedInstance reports whether the monitor manages a process: a custom
+// QEMU instance whose name is defined in vms.json.
+func ownedInstance(inst *QEMUInstance) bool {
+	return inst.Type == "custom" && inst.Name != "" && vmDefined(inst.Name)
+}
+
+// findStopTarget looks up the instance to stop by VM name or instance ID in
+// a fresh process listing rather than the cached one.
+func findStopTarget(name, id string) (*QEMUInstance, error) {
+	instances, err := getQEMUInstances()
+	if err != nil {
+		return nil, err
+	}
+	var found []QEMUInstance
+	for _, inst := range instances {
+		if (id != "" && inst.ID == id) || (id == "" && inst.Name == name) {
+			found = append(found, inst)
+		}
+	}
+	switch {
+	case len(found) == 0 && id != "":
+		return nil, newAPIError(http.StatusNotFound, "instance_not_found", "no running QEMU instance with ID %s", id)
+	case len(found) == 0:
+		return nil, newAPIError(http.StatusNotFound, "instance_not_found", "no running QEMU instance named %s", name)
+	case len(found) > 1:
+		return nil, newAPIError(http.StatusConflict, "ambiguous_name", "%d QEMU instances are named %s, stop by ID instead", len(found), name).
+			with("count", len(found))
+	}
+	return &found[0], nil
+}
+
+// instanceAlive re-checks a discovered instance's start time, so a PID that
+// exited and was reused since the listing is never signalled.
+func instanceAlive(inst *QEMUInstance) bool {
+	return inst.ID != "" && instanceID(inst.PID) == inst.ID
+}
+
+// signalInstance signals a QEMU process directly when the monitor started
+// it unprivileged, and otherwise through the privileged helper or sudo.
+func signalInstance(inst *QEMUInstance, sig string) error {
+	pid, err := strconv.Atoi(inst.PID)
+	if err != nil {
+		return fmt.Errorf("invalid PID: %s", inst.PID)
+	}
+	signum := syscall.SIGTERM
+	if sig == "KILL" {
+		signum = syscall.SIGKILL
+	}
+
+	err = syscall.Kill(pid, signum)
+	switch {
+	case err == nil:
+	case err != syscall.EPERM:
+		return fmt.Errorf("failed to signal VM %s (PID %s): %v", inst.Name, inst.PID, err)
+	case helperAvailable():
+		if _, err := callHelper(helperRequest{Op: "signal", ID: inst.ID, Signal: sig}); err != nil {
+			return fmt.Errorf("failed to signal VM %s (PID %s): %v", inst.Name, inst.PID, err)
+		}
+	default:
+		cmd := exec.Command("sudo", "kill", "-"+sig, inst.PID)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to signal VM %s (PID %s): %v - %s", inst.Name, inst.PID, err, string(output))
+		}
+	}
+	log.Printf("Sent SIG%s to %s (PID %s)", sig, inst.Name, inst.PID)
+	return nil
+}
+
+// logRefusedStop records a stop request that was turned down, with who
+// asked for it and from where.
+func logRefusedStop(r *http.Request, target, reason string) {
+	p := principalFrom(r)
+	log.Printf("Refused stop of %s by %s %s from %s: %s", target, p.Kind, p.Name, r.RemoteAddr, reason)
+}
+
+// stopInstance stops the instance named by VM name or instance ID, after
+// checking it is live, owned by the monitor and allowed by allowsVM.
+func stopInstance(name, id string, force bool, allowsVM func(string) bool) (*QEMUInstance, error) {
+	if name == "" && id == "" {
+		return nil, newAPIError(http.StatusBadRequest, "invalid_request", "name or id is required")
+	}
+	inst, err := findStopTarget(name, id)
+	if err != nil {
+		return nil, asAPIError(err)
+	}
+	if !ownedInstance(inst) {
+		return nil, newAPIError(http.StatusForbidden, "not_managed",
+			"instance %s (PID %s) is not a VM defined in %s", inst.Name, inst.PID, configPath)
+	}
+	if !allowsVM(inst.Name) {
+		return nil, newAPIError(http.StatusForbidden, "forbidden", "permission denied for VM %s", inst.Name)
+	}
+	if !instanceAlive(inst) {
+		return nil, newAPIError(http.StatusConflict, "instance_gone",
+			"instance %s (PID %s) is no longer running", inst.Name, inst.PID)
+	}
+
+	if force {
+		err = forceStopVM(inst)
+	} else {
+		err = stopVM(inst)
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "signal_failed", "%v", err)
+	}
+	return inst, nil
+}
+
+// stopRequested stops the instance a request names for the caller. Every
+// refusal is logged.
+func stopRequested(r *http.Request, name, id string, force bool) (*QEMUInstance, error) {
+	inst, err := stopInstance(name, id, force, principalFrom(r).allowsVM)
+	if err != nil {
+		if apiErr := asAPIError(err); apiErr.Code != "signal_failed" {
+			target := name
+			if id != "" {
+				target = "ID " + id
+			}
+			logRefusedStop(r, target, apiErr.Message)
+		}
+		return nil, err
+	}
+	return inst, nil
+}
+
+func stopResult(inst *QEMUInstance, force bool) StatusResult {
+	action := "stopped"
+	if force {
+		action = "force stopped"
+	}
+	return StatusResult{Status: action, Name: inst.Name, ID: inst.ID, PID: inst.PID}
+}
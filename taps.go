@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tapPrefix = "qm"
+
+// Only taps the monitor created, or that carry a name it generated, are
+// tracked; taps named with an explicit ifname that already existed belong
+// to the host and are never deleted.
+var (
+	tapsMu            sync.Mutex
+	provisionedTaps   = map[string][]string{}  // vm -> tap interfaces created for it
+	tapsProvisionedAt = map[string]time.Time{} // vm -> when they were
+)
+
+// monitorTapName reports whether a tap's name was generated by the monitor
+// rather than given in vms.json.
+func monitorTapName(net VMNetwork) bool {
+	return isTapNetwork(net) && net.Ifname == ""
+}
+
+// privilegedCommand runs a host networking tool with elevated privileges,
+// through sudo unless the process already runs as root.
+func privilegedCommand(name string, args ...string) *exec.Cmd {
+	if os.Geteuid() == 0 {
+		return exec.Command(name, args...)
+	}
+	return exec.Command("sudo", append([]string{name}, args...)...)
+}
+
+// tapUser is the user new taps belong to, which lets an unprivileged QEMU
+// attach to them.
+func tapUser() string {
+	if tapOwner != "" || os.Geteuid() == 0 {
+		return tapOwner
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+func runIP(args ...string) error {
+	output, err := privilegedCommand("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %v - %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func isTapNetwork(net VMNetwork) bool {
+	return net.Type == "tap" || net.Type == "bridge"
+}
+
+func hasTapNetworks(vm *VMConfig) bool {
+	for _, net := range vm.Networks {
+		if isTapNetwork(net) {
+			return true
+		}
+	}
+	return false
+}
+
+// nicIfname returns the host-side interface of a tap-backed NIC. Unnamed
+// taps get a stable name derived from the VM and netdev id, kept within
+// the 15 character interface name limit.
+func nicIfname(vmName string, net VMNetwork) string {
+	if net.Ifname != "" || !isTapNetwork(net) {
+		return net.Ifname
+	}
+	return fmt.Sprintf("%s%08x", tapPrefix, crc32.ChecksumIEEE([]byte(vmName+"/"+net.ID)))
+}
+
+func linkExists(ifname string) bool {
+	_, err := ioutil.ReadFile(filepath.Join("/sys/class/net", ifname, "ifindex"))
+	return err == nil
+}
+
+// tapOwnedBy reports whether ifname is a tap device that belongs to uid.
+func tapOwnedBy(ifname string, uid int) bool {
+	if _, err := ioutil.ReadFile(filepath.Join("/sys/class/net", ifname, "tun_flags")); err != nil {
+		return false
+	}
+	owner, err := ioutil.ReadFile(filepath.Join("/sys/class/net", ifname, "owner"))
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(owner)))
+	return err == nil && n == uid
+}
+
+// provisionTaps creates, configures and attaches the tap devices of a VM
+// before launch. Taps already present from a previous run are reused.
+func provisionTaps(vm *VMConfig) error {
+	if helperAvailable() && hasTapNetworks(vm) {
+		resp, err := callHelper(helperRequest{Op: "create-taps", VM: vm.Name})
+		if err != nil {
+			return err
+		}
+		tapsMu.Lock()
+		provisionedTaps[vm.Name] = resp.Taps
+		tapsProvisionedAt[vm.Name] = time.Now()
+		tapsMu.Unlock()
+		return nil
+	}
+
+	owner := tapUser()
+	var created, owned []string
+	for _, net := range vm.Networks {
+		if !isTapNetwork(net) {
+			continue
+		}
+		if runtime.GOOS != "linux" {
+			return statusErrorf(http.StatusConflict, "%s networking is only supported on Linux", net.Type)
+		}
+		if net.Type == "bridge" && net.Bridge == "" {
+			return statusErrorf(http.StatusConflict, "netdev %s: bridge networks need a bridge name", net.ID)
+		}
+
+		ifname := nicIfname(vm.Name, net)
+		if !linkExists(ifname) {
+			args := []string{"tuntap", "add", "dev", ifname, "mode", "tap"}
+			if owner != "" {
+				args = append(args, "user", owner)
+			}
+			if err := runIP(args...); err != nil {
+				cleanupTaps(created)
+				return err
+			}
+			created = append(created, ifname)
+			owned = append(owned, ifname)
+		} else if monitorTapName(net) {
+			owned = append(owned, ifname)
+		}
+
+		if net.MTU > 0 {
+			if err := runIP("link", "set", "dev", ifname, "mtu", strconv.Itoa(net.MTU)); err != nil {
+				cleanupTaps(created)
+				return err
+			}
+		}
+		if net.Bridge != "" {
+			if !linkExists(net.Bridge) {
+				// helperCheckTaps refused this already; root never
+				// creates bridges for the user
+				if helperMode {
+					cleanupTaps(created)
+					return fmt.Errorf("bridge %s does not exist", net.Bridge)
+				}
+				if err := runIP("link", "add", "name", net.Bridge, "type", "bridge"); err != nil {
+					cleanupTaps(created)
+					return err
+				}
+				runIP("link", "set", "dev", net.Bridge, "up")
+				log.Printf("Created bridge %s", net.Bridge)
+			}
+			if err := runIP("link", "set", "dev", ifname, "master", net.Bridge); err != nil {
+				cleanupTaps(created)
+				return err
+			}
+		}
+		if err := runIP("link", "set", "dev", ifname, "up"); err != nil {
+			cleanupTaps(created)
+			return err
+		}
+		log.Printf("Provisioned tap %s for %s/%s", ifname, vm.Name, net.ID)
+	}
+
+	if len(owned) > 0 {
+		tapsMu.Lock()
+		provisionedTaps[vm.Name] = owned
+		tapsProvisionedAt[vm.Name] = time.Now()
+		tapsMu.Unlock()
+	}
+	return nil
+}
+
+func cleanupTaps(taps []string) {
+	if len(taps) > 0 && helperAvailable() {
+		if _, err := callHelper(helperRequest{Op: "delete-taps", Ifnames: taps}); err != nil {
+			log.Printf("Failed to remove taps %v: %v", taps, err)
+		}
+		return
+	}
+	for _, ifname := range taps {
+		if err := runIP("link", "del", "dev", ifname); err != nil {
+			log.Printf("Failed to remove tap %s: %v", ifname, err)
+		} else {
+			log.Printf("Removed tap %s", ifname)
+		}
+	}
+}
+
+// reapTaps removes taps of VMs that have exited since the last poll.
+// Monitor-named taps of VMs found running (e.g. after a monitor restart)
+// are adopted first. listed is when instances were listed: taps provisioned
+// since belong to a VM that may not have shown up in the list yet.
+func reapTaps(instances []QEMUInstance, listed time.Time) {
+	running := map[string]bool{}
+	tapsMu.Lock()
+	for _, inst := range instances {
+		running[inst.Name] = true
+		if _, ok := provisionedTaps[inst.Name]; ok {
+			continue
+		}
+		if vm := findVMConfig(inst.Name); vm != nil {
+			for _, net := range vm.Networks {
+				if monitorTapName(net) {
+					provisionedTaps[inst.Name] = append(provisionedTaps[inst.Name], nicIfname(vm.Name, net))
+				}
+			}
+		}
+	}
+
+	var stale []string
+	for name, taps := range provisionedTaps {
+		if !running[name] && !tapsProvisionedAt[name].After(listed) {
+			stale = append(stale, taps...)
+			delete(provisionedTaps, name)
+			delete(tapsProvisionedAt, name)
+		}
+	}
+	tapsMu.Unlock()
+
+	cleanupTaps(stale)
+}
+
+// leakedTaps lists tap interfaces on the host that carry a name the monitor
+// generates but whose VM is not running. Taps named in vms.json are left
+// alone, since they may have existed before the monitor used them. Called
+// with configMu held.
+func leakedTaps() []string {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir("/sys/class/net")
+	if err != nil {
+		return nil
+	}
+
+	owner := map[string]string{}
+	for _, vm := range vmsConfig.VMs {
+		for _, net := range vm.Networks {
+			if isTapNetwork(net) {
+				owner[nicIfname(vm.Name, net)] = vm.Name
+			}
+		}
+	}
+
+	// Taps still tracked are reaped with their VM, and may belong to one
+	// that is starting
+	tracked := map[string]bool{}
+	tapsMu.Lock()
+	for _, taps := range provisionedTaps {
+		for _, ifname := range taps {
+			tracked[ifname] = true
+		}
+	}
+	tapsMu.Unlock()
+
+	leaked := []string{}
+	for _, e := range entries {
+		ifname := e.Name()
+		if _, err := ioutil.ReadFile(filepath.Join("/sys/class/net", ifname, "tun_flags")); err != nil {
+			continue
+		}
+		if !strings.HasPrefix(ifname, tapPrefix) {
+			continue
+		}
+		if vm, known := owner[ifname]; known && isRunning(vm) || tracked[ifname] {
+			continue
+		}
+		leaked = append(leaked, ifname)
+	}
+	return leaked
+}
+
+func handleTapCleanup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	configMu.Lock()
+	leaked := leakedTaps()
+	configMu.Unlock()
+	cleanupTaps(leaked)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "cleaned", "removed": leaked})
+}
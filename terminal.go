@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	recordingsDir  = "recordings"
+	recordSessions = true
+
+	// Browsers send cookies on cross-site WebSocket handshakes too, so
+	// only the monitor's own pages may open one
+	wsUpgrader = websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     sameOrigin,
+	}
+)
+
+// terminalMessage is a control message sent by the browser terminal.
+type terminalMessage struct {
+	Type string `json:"type"` // "input" or "resize"
+	Data string `json:"data,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
+type Recording struct {
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mod_time"`
+}
+
+// castRecorder writes a terminal session in asciinema v2 format.
+type castRecorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	start time.Time
+}
+
+// newCastRecorder starts a recording. Sessions can show passwords and
+// other secrets typed back by the guest, so recordings are only readable
+// by the monitor's user, as are directories made by older versions.
+func newCastRecorder(name string, cols, rows int) (*castRecorder, error) {
+	dir := filepath.Join(recordingsDir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	for _, d := range []string{recordingsDir, dir} {
+		if err := os.Chmod(d, 0700); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	path := filepath.Join(dir, start.Format("20060102-150405.000")+".cast")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	header, _ := json.Marshal(map[string]interface{}{
+		"version":   2,
+		"width":     cols,
+		"height":    rows,
+		"timestamp": start.Unix(),
+		"title":     name,
+	})
+	f.Write(append(header, '\n'))
+	return &castRecorder{f: f, start: start}, nil
+}
+
+func (c *castRecorder) record(kind, data string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	line, _ := json.Marshal([]interface{}{time.Since(c.start).Seconds(), kind, data})
+	c.f.Write(append(line, '\n'))
+}
+
+func (c *castRecorder) Close() error {
+	return c.f.Close()
+}
+
+// handleTerminal bridges a WebSocket to an interactive SSH shell on the guest.
+func handleTerminal(w http.ResponseWriter, r *http.Request, name string) {
+	cols, _ := strconv.Atoi(r.URL.Query().Get("cols"))
+	rows, _ := strconv.Atoi(r.URL.Query().Get("rows"))
+	if cols <= 0 {
+		cols = 80
+	}
+	if rows <= 0 {
+		rows = 24
+	}
+
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Terminal upgrade failed for %s: %v", name, err)
+		return
+	}
+	defer ws.Close()
+
+	params := map[string]interface{}{"cols": cols, "rows": rows}
+	fail := func(err error) {
+		ws.WriteMessage(websocket.TextMessage, []byte("\r\n\x1b[31m"+err.Error()+"\x1b[0m\r\n"))
+		audit(r, principalFrom(r), "terminal.open", name, params, "error", err.Error())
+	}
+
+	client, err := dialGuestSSH(name)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		fail(fmt.Errorf("ssh session failed: %v", err))
+		return
+	}
+	defer session.Close()
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		fail(fmt.Errorf("pty request failed: %v", err))
+		return
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	var rec *castRecorder
+	if recordSessions {
+		rec, err = newCastRecorder(name, cols, rows)
+		if err != nil {
+			log.Printf("Terminal recording disabled for %s: %v", name, err)
+		} else {
+			defer rec.Close()
+		}
+	}
+
+	if err := session.Shell(); err != nil {
+		fail(fmt.Errorf("shell failed: %v", err))
+		return
+	}
+	log.Printf("Terminal session opened to %s from %s", name, r.RemoteAddr)
+	defer log.Printf("Terminal session to %s closed", name)
+	audit(r, principalFrom(r), "terminal.open", name, params, "ok", "")
+	opened := time.Now()
+	defer func() {
+		audit(r, principalFrom(r), "terminal.close", name,
+			map[string]interface{}{"duration": time.Since(opened).Round(time.Second).String()}, "ok", "")
+	}()
+
+	// Guest output -> browser
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 8192)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				if rec != nil {
+					rec.record("o", string(buf[:n]))
+				}
+				if werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Browser input -> guest
+	go func() {
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				session.Close()
+				return
+			}
+			var msg terminalMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				continue
+			}
+			switch msg.Type {
+			case "input":
+				stdin.Write([]byte(msg.Data))
+			case "resize":
+				if msg.Cols > 0 && msg.Rows > 0 {
+					session.WindowChange(msg.Rows, msg.Cols)
+					if rec != nil {
+						rec.record("r", fmt.Sprintf("%dx%d", msg.Cols, msg.Rows))
+					}
+				}
+			}
+		}
+	}()
+
+	<-done
+	session.Wait()
+}
+
+func listRecordings(name string) ([]Recording, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(recordingsDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Recording{}, nil
+		}
+		return nil, err
+	}
+
+	recordings := []Recording{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".cast") {
+			continue
+		}
+		recordings = append(recordings, Recording{
+			File:    e.Name(),
+			Size:    e.Size(),
+			ModTime: e.ModTime().Format("2006-01-02 15:04:05"),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].File > recordings[j].File })
+	return recordings, nil
+}
+
+func handleRecordings(w http.ResponseWriter, r *http.Request, name, file string) {
+	if !vmDefined(name) {
+		legacyError(w, r, newAPIError(http.StatusNotFound, "vm_not_found", "VM configuration not found: %s", name))
+		return
+	}
+
+	if file == "" {
+		recordings, err := listRecordings(name)
+		if err != nil {
+			legacyError(w, r, err)
+			return
+		}
+		json.NewEncoder(w).Encode(recordings)
+		return
+	}
+
+	if file != filepath.Base(file) || !strings.HasSuffix(file, ".cast") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file))
+	http.ServeFile(w, r, filepath.Join(recordingsDir, name, file))
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TLSSettings is the "tls" section of auth.json.
+type TLSSettings struct {
+	Enabled    bool   `json:"enabled"`
+	Cert       string `json:"cert,omitempty"`        // default tls/server.crt
+	Key        string `json:"key,omitempty"`         // default tls/server.key
+	ClientCA   string `json:"client_ca,omitempty"`   // CA for client certificates
+	ClientAuth string `json:"client_auth,omitempty"` // "optional" (default with client_ca) or "require"
+}
+
+// AuthClientCert maps verified client certificates, by subject common name,
+// to a role.
+type AuthClientCert struct {
+	CommonName string   `json:"common_name"` // glob pattern
+	Role       string   `json:"role"`
+	VMs        []string `json:"vms,omitempty"`
+}
+
+var tlsDir = "tls"
+
+// certReloader serves the current certificate and client CA pool, and
+// picks up replaced files without a restart.
+type certReloader struct {
+	settings TLSSettings
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+func (s TLSSettings) certPath() string {
+	if s.Cert != "" {
+		return s.Cert
+	}
+	return filepath.Join(tlsDir, "server.crt")
+}
+
+func (s TLSSettings) keyPath() string {
+	if s.Key != "" {
+		return s.Key
+	}
+	return filepath.Join(tlsDir, "server.key")
+}
+
+// filesModTime is the newest modification time of the TLS files.
+func (c *certReloader) filesModTime() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.settings.certPath(), c.settings.keyPath(), c.settings.ClientCA} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (c *certReloader) load() error {
+	modTime := c.filesModTime()
+	cert, err := tls.LoadX509KeyPair(c.settings.certPath(), c.settings.keyPath())
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if c.settings.ClientCA != "" {
+		data, err := ioutil.ReadFile(c.settings.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", c.settings.ClientCA)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert, c.pool, c.modTime = &cert, pool, modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// watch reloads the files when they change on disk or on SIGHUP. A failed
+// reload keeps serving the previous certificate.
+func (c *certReloader) watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		forced := false
+		select {
+		case <-hup:
+			forced = true
+		case <-ticker.C:
+		}
+		c.mu.RLock()
+		changed := c.filesModTime().After(c.modTime)
+		c.mu.RUnlock()
+		if !forced && !changed {
+			continue
+		}
+		if err := c.load(); err != nil {
+			log.Printf("Failed to reload TLS certificate: %v", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate from %s", c.settings.certPath())
+	}
+}
+
+func (c *certReloader) tlsConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	if c.settings.ClientCA != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+		if c.settings.ClientAuth == "require" {
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return c.cert, nil
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientAuth = clientAuth
+		cfg.ClientCAs = c.pool
+		return cfg, nil
+	}
+	return base
+}
+
+// setupTLS prepares the server's TLS config, generating a self-signed CA
+// and server certificate on first run when none are configured.
+func setupTLS(settings TLSSettings) (*tls.Config, error) {
+	if settings.Cert == "" && settings.Key == "" {
+		if _, err := os.Stat(settings.certPath()); os.IsNotExist(err) {
+			if err := generateSelfSignedCerts(); err != nil {
+				return nil, fmt.Errorf("failed to generate certificates: %v", err)
+			}
+		}
+	}
+	c := &certReloader{settings: settings}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	go c.watch()
+	return c.tlsConfig(), nil
+}
+
+func writePEM(path, blockType string, der []byte, mode os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), mode)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// generateSelfSignedCerts creates tls/ca.crt and a server certificate it
+// signs, valid for this host's name and addresses. Clients trust ca.crt,
+// which can also sign client certificates for mutual TLS.
+func generateSelfSignedCerts() error {
+	if err := os.MkdirAll(tlsDir, 0700); err != nil {
+		return err
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "qemu-monitor CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	if serial, err = newSerial(); err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(2, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				template.IPAddresses = append(template.IPAddresses, ipnet.IP)
+			}
+		}
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(tlsDir, "ca.crt"), "CERTIFICATE", caDER, 0644); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(tlsDir, "ca.key"), "EC PRIVATE KEY", caKeyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(tlsDir, "server.key"), "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(tlsDir, "server.crt"), "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	log.Printf("Generated self-signed CA and server certificate in %s/", tlsDir)
+	return nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+
+	"qemu-monitor/client"
+)
+
+// `top` is a full-screen dashboard for terminals: the web UI's instance
+// list with live CPU and memory, refreshed through the same backend as the
+// other commands, and keys to act on the selected VM.
+
+// topFilters are the filters of the web UI.
+var topFilters = []string{"all", "running", "suspended", "multipass", "custom"}
+
+var topSorts = []string{"name", "cpu", "memory", "status"}
+
+const topHelp = "↑↓ select  s sort  f filter  S start  T stop  K kill  p pause/resume  c console  q quit"
+
+// topRow is a running instance, or a configured VM that is stopped.
+type topRow struct {
+	Name   string
+	Status string
+	PID    string
+	CPU    float64
+	RSS    int64
+	CPUs   string
+	Memory string
+	Uptime string
+	Type   string
+}
+
+type topView struct {
+	b         cliBackend
+	source    string
+	rows      []topRow
+	conflicts []string
+	updated   string
+	err       error
+	filter    int
+	sortBy    int
+	cursor    int
+	selected  string // kept across refreshes and re-sorting
+	message   string
+	confirm   func() // run when the next key is "y"
+}
+
+func runTop(args []string) error {
+	fs, o := newCLIFlags("top")
+	interval := fs.Duration("d", 2*time.Second, "refresh interval")
+	if len(parseArgs(fs, args)) > 0 {
+		return fmt.Errorf("usage: qemu-monitor top [-d INTERVAL]")
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return fmt.Errorf("top needs a terminal")
+	}
+	b, err := o.backend()
+	if err != nil {
+		return err
+	}
+
+	v := &topView{b: b, source: "local"}
+	if remote, ok := b.(*remoteBackend); ok {
+		v.source = remote.c.BaseURL
+	}
+	v.refresh()
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+	// Alternate screen without a cursor, as full-screen programs do
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	defer os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+
+	input := readInput()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	for {
+		v.draw()
+		select {
+		case <-ticker.C:
+			v.refresh()
+		case <-winch:
+		case data, ok := <-input:
+			if !ok {
+				return nil
+			}
+			for _, key := range topKeys(data) {
+				if !v.key(key, input) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// topKeys splits terminal input into keys, naming the arrow keys.
+func topKeys(data []byte) []string {
+	var keys []string
+	for len(data) > 0 {
+		if data[0] == 0x1b && len(data) >= 3 && (data[1] == '[' || data[1] == 'O') {
+			switch data[2] {
+			case 'A':
+				keys = append(keys, "up")
+			case 'B':
+				keys = append(keys, "down")
+			case 'H':
+				keys = append(keys, "home")
+			case 'F':
+				keys = append(keys, "end")
+			}
+			data = data[3:]
+			continue
+		}
+		keys = append(keys, string(data[:1]))
+		data = data[1:]
+	}
+	return keys
+}
+
+func (v *topView) refresh() {
+	resp, err := v.b.Instances()
+	if err != nil {
+		v.err = err
+		return
+	}
+	vms, err := v.b.VMs()
+	if err != nil {
+		v.err = err
+		return
+	}
+	v.err = nil
+
+	rows := []topRow{}
+	running := map[string]bool{}
+	for _, inst := range resp.Instances {
+		running[inst.Name] = true
+		rows = append(rows, topRow{inst.Name, inst.Status, inst.PID, inst.CPUPercent, inst.RSS,
+			inst.CPUCount, inst.Memory, inst.Uptime, inst.Type})
+	}
+	for _, vm := range vms.VMs {
+		if !running[vm.Name] {
+			rows = append(rows, topRow{Name: vm.Name, Status: "stopped", CPUs: vm.CPUs, Memory: vm.Memory, Type: "custom"})
+		}
+	}
+	v.rows, v.conflicts, v.updated = rows, resp.Conflicts, resp.LastUpdated
+}
+
+// visible returns the rows the filter lets through, sorted. As in the web
+// UI, stopped VMs are only listed without a filter.
+func (v *topView) visible() []topRow {
+	filter := topFilters[v.filter]
+	var rows []topRow
+	for _, r := range v.rows {
+		switch {
+		case filter == "all":
+		case filter == "running" || filter == "suspended":
+			if r.Status != filter {
+				continue
+			}
+		case r.Status == "stopped" || r.Type != filter:
+			continue
+		}
+		rows = append(rows, r)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch topSorts[v.sortBy] {
+		case "cpu":
+			if a.CPU != b.CPU {
+				return a.CPU > b.CPU
+			}
+		case "memory":
+			if a.RSS != b.RSS {
+				return a.RSS > b.RSS
+			}
+		case "status":
+			if a.Status != b.Status {
+				return a.Status < b.Status
+			}
+		}
+		return a.Name < b.Name
+	})
+
+	v.cursor = 0
+	for i, r := range rows {
+		if r.Name == v.selected {
+			v.cursor = i
+		}
+	}
+	return rows
+}
+
+// key handles one key press and reports whether top keeps running.
+func (v *topView) key(key string, input <-chan []byte) bool {
+	if v.confirm != nil {
+		confirm := v.confirm
+		v.confirm, v.message = nil, ""
+		if key == "y" || key == "Y" {
+			confirm()
+		}
+		return true
+	}
+
+	rows := v.visible()
+	var row *topRow
+	if v.cursor < len(rows) {
+		row = &rows[v.cursor]
+	}
+	move := func(i int) {
+		if len(rows) == 0 {
+			return
+		}
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(rows) {
+			i = len(rows) - 1
+		}
+		v.selected = rows[i].Name
+	}
+
+	switch key {
+	case "q", "\x03":
+		return false
+	case "up", "k":
+		move(v.cursor - 1)
+	case "down", "j":
+		move(v.cursor + 1)
+	case "home", "g":
+		move(0)
+	case "end", "G":
+		move(len(rows) - 1)
+	case "s":
+		v.sortBy = (v.sortBy + 1) % len(topSorts)
+	case "f":
+		v.filter = (v.filter + 1) % len(topFilters)
+	case "1", "2", "3", "4", "5":
+		v.filter = int(key[0] - '1')
+	}
+	if row == nil {
+		return true
+	}
+
+	name := row.Name
+	switch key {
+	case "S":
+		v.act(func() (*client.StatusResult, error) { return v.b.StartVM(name) })
+	case "T", "K":
+		force := key == "K"
+		verb := "Stop"
+		if force {
+			verb = "Kill"
+		}
+		v.message = fmt.Sprintf("%s %s? (y/n)", verb, name)
+		v.confirm = func() {
+			v.act(func() (*client.StatusResult, error) { return v.b.StopVM(name, force) })
+		}
+	case "p":
+		pause := row.Status != "paused"
+		v.act(func() (*client.StatusResult, error) { return v.b.PauseVM(name, pause) })
+	case "c":
+		v.console(name, input)
+	}
+	return true
+}
+
+func (v *topView) act(action func() (*client.StatusResult, error)) {
+	result, err := action()
+	if err != nil {
+		v.message = "\x1b[31m" + err.Error() + "\x1b[0m"
+		return
+	}
+	v.message = fmt.Sprintf("%s: %s", result.Name, result.Status)
+	v.refresh()
+}
+
+// console attaches to a VM's serial console in place of the dashboard
+// until the detach key.
+func (v *topView) console(name string, input <-chan []byte) {
+	stream, err := v.b.Serial(name)
+	if err != nil {
+		v.message = "\x1b[31m" + err.Error() + "\x1b[0m"
+		return
+	}
+	fmt.Printf("\x1b[H\x1b[2J\x1b[?25h\x1b[7m Serial console of %s, Ctrl-] to return \x1b[0m\r\n", name)
+	err = relaySerial(stream, input)
+	os.Stdout.WriteString("\x1b[0m\x1b[?25l\x1b[H\x1b[2J")
+	v.message = "Detached from " + name
+	if err != nil {
+		v.message = "\x1b[31m" + err.Error() + "\x1b[0m"
+	}
+	v.refresh()
+}
+
+func (v *topView) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	rows := v.visible()
+
+	var lines []string
+	header := fmt.Sprintf("qemu-monitor top - %s - %d rows, updated %s", v.source, len(v.rows), dash(v.updated))
+	lines = append(lines, "\x1b[1m"+clip(header, width)+"\x1b[0m")
+	var filters []string
+	for i, f := range topFilters {
+		if i == v.filter {
+			f = "[" + f + "]"
+		}
+		filters = append(filters, f)
+	}
+	lines = append(lines, clip(fmt.Sprintf("filter: %s   sort: %s", strings.Join(filters, " "), topSorts[v.sortBy]), width))
+	for _, conflict := range v.conflicts {
+		lines = append(lines, "\x1b[33m"+clip("Warning: "+conflict, width)+"\x1b[0m")
+	}
+
+	nameWidth := 4
+	for _, r := range rows {
+		if len(r.Name) > nameWidth {
+			nameWidth = len(r.Name)
+		}
+	}
+	if nameWidth > 24 {
+		nameWidth = 24
+	}
+	format := fmt.Sprintf("%%-%ds  %%-9s %%7s %%6s %%8s %%6s %%4s %%10s  %%s", nameWidth)
+	lines = append(lines, "\x1b[7m"+clip(fmt.Sprintf(format, "NAME", "STATUS", "PID", "CPU%", "RSS", "MEM", "CPUS", "UPTIME", "TYPE"), width)+"\x1b[K\x1b[0m")
+
+	// Scroll so the selected row stays on screen
+	space := height - len(lines) - 2
+	if space < 1 {
+		space = 1
+	}
+	first := 0
+	if v.cursor >= space {
+		first = v.cursor - space + 1
+	}
+	for i := first; i < len(rows) && i < first+space; i++ {
+		r := rows[i]
+		cpu, rss := "-", "-"
+		if r.Status != "stopped" {
+			cpu, rss = fmt.Sprintf("%.1f", r.CPU), humanSize(r.RSS)
+		}
+		name := r.Name
+		if len(name) > nameWidth {
+			name = name[:nameWidth]
+		}
+		line := clip(fmt.Sprintf(format, name, r.Status, dash(r.PID), cpu, rss, dash(r.Memory), dash(r.CPUs), dash(r.Uptime), r.Type), width)
+		if color, at := topStatusColor(r.Status), nameWidth+2; color != "" && len(line) >= at+len(r.Status) {
+			line = line[:at] + color + r.Status + "\x1b[39m" + line[at+len(r.Status):]
+		}
+		if i == v.cursor {
+			line = "\x1b[7m" + line + "\x1b[K\x1b[0m"
+		}
+		lines = append(lines, line)
+	}
+	if len(rows) == 0 {
+		lines = append(lines, "No instances match the filter")
+	}
+	for len(lines) < height-2 {
+		lines = append(lines, "")
+	}
+
+	message := v.message
+	if v.err != nil {
+		message = "\x1b[31m" + v.err.Error() + "\x1b[0m"
+	}
+	lines = append(lines, message, "\x1b[2m"+clip(topHelp, width)+"\x1b[0m")
+
+	var out strings.Builder
+	out.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			out.WriteString("\r\n")
+		}
+		out.WriteString(line + "\x1b[K")
+	}
+	out.WriteString("\x1b[J")
+	os.Stdout.WriteString(out.String())
+}
+
+// topStatusColor matches the status badges of the web UI.
+func topStatusColor(status string) string {
+	switch status {
+	case "running":
+		return "\x1b[32m"
+	case "suspended":
+		return "\x1b[33m"
+	case "snapshot":
+		return "\x1b[34m"
+	case "paused", "stopped":
+		return "\x1b[90m"
+	}
+	return ""
+}
+
+// clip cuts a line to the terminal width.
+func clip(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s
+}